@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/config"
+	"io"
+	"os"
+)
+
+// Export writes an archive of the metadata and the blobs of a stopped server, for example
+//
+//	server export -o full.tar
+//	server export -since 42 -o incremental.tar
+//
+// A running server holds the metadata store, back it up with GET /api/backup instead.
+func Export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	since := fs.Uint64("since", 0, "include the changes made from this version on, 0 makes a full backup")
+	out := fs.String("o", "-", "archive to write, - means stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	backup, err := store.Backup(*since)
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, createErr := os.Create(*out)
+		if createErr != nil {
+			return createErr
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if err = backup.WriteArchive(w); err != nil {
+		return err
+	}
+
+	m := backup.Manifest
+	fmt.Fprintf(os.Stderr, "exported %d records and %d blobs, pass -since %d for the next incremental export\n",
+		m.Records, len(m.Blobs), m.Version)
+
+	return nil
+}
+
+// Import loads an archive made by export into the metadata store and the storage of a stopped server,
+// for example
+//
+//	server import -file full.tar
+//
+// Incremental archives are imported after the full one in the order they were made.
+func Import(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := fs.String("file", "", "archive to restore")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	archive, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	m, err := store.Restore(archive)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported %d records, %d removals and %d blobs\n", m.Records, m.Removed, len(m.Blobs))
+
+	return nil
+}
+
+// openFileStore opens the metadata store and the storage configured for the server.
+func openFileStore() (storage.FileStore, error) {
+	cfg, err := config.Load(context.Background(), configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	kv, err := OpenMetadata(cfg.GetMetadataDriver(), cfg.GetMetadataPath())
+	if err != nil {
+		return nil, err
+	}
+
+	return storage.NewStore(kv, MustFilesystem(cfg)), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/pkg/config"
+)
+
+// CheckConfig validates the config without starting the server, for example
+//
+//	server config check
+//	server config check -config server.yaml
+//
+// It fails listing every invalid field, so it can run before a deploy or a reload.
+func CheckConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New("usage: server config check [-config file]")
+	}
+
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	file := fs.String("config", configFile, "YAML or TOML config file, environment variables take precedence")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	if _, err := config.Load(context.Background(), *file); err != nil {
+		return err
+	}
+
+	fmt.Println("config is valid")
+
+	return nil
+}
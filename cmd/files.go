@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/config"
+	"github.com/labi-le/server/pkg/log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Files inspects and deletes the files of a stopped server by short ID, for example
+//
+//	server files list -owner owner
+//	server files info abc123
+//	server files delete abc123
+//
+// Deletions are recorded in the audit log with the actor cli.
+func Files(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: server files list|info|delete [flags] [short ID]")
+	}
+
+	switch args[0] {
+	case "list":
+		return listFiles(args[1:])
+	case "info":
+		return fileInfo(args[1:])
+	case "delete":
+		return deleteFile(args[1:])
+	default:
+		return fmt.Errorf("unknown files command %q, must be list, info or delete", args[0])
+	}
+}
+
+func listFiles(args []string) error {
+	fs := flag.NewFlagSet("files list", flag.ContinueOnError)
+	owner := fs.String("owner", "", "list only the files uploaded with this key name")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SHORT ID\tSIZE\tCONTENT TYPE\tOWNER\tUPLOADED")
+	for _, f := range files {
+		if *owner != "" && f.Owner != *owner {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", f.ShortID, f.Size, f.ContentType, f.Owner, f.UploadedAt.Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+func fileInfo(args []string) error {
+	fs := flag.NewFlagSet("files info", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: server files info <short ID>")
+	}
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	f, err := store.Lookup(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("%s: %w", fs.Arg(0), err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(f.Public())
+}
+
+func deleteFile(args []string) error {
+	fs := flag.NewFlagSet("files delete", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: server files delete <short ID>")
+	}
+	k := fs.Arg(0)
+
+	cfg, err := config.Load(context.Background(), configFile)
+	if err != nil {
+		return err
+	}
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	auditLog, err := audit.Open(cfg.GetAuditPath(), log.New())
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	if err = store.Delete(k); err != nil {
+		return fmt.Errorf("%s: %w", k, err)
+	}
+
+	auditLog.Record(context.Background(), audit.Event{
+		Action: audit.ActionDelete,
+		Actor:  "cli",
+		Target: k,
+		Detail: map[string]any{"via": "cli"},
+	})
+
+	fmt.Printf("deleted %s\n", k)
+
+	return nil
+}
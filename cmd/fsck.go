@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"os"
+)
+
+// Fsck compares the metadata with the blobs of a stopped server and prints the report as JSON, for example
+//
+//	server fsck -checksums
+//	server fsck -repair quarantine
+//
+// It fails when problems are left unrepaired. A running server is checked with GET /api/fsck instead.
+func Fsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	repair := fs.String("repair", "", "quarantine or delete the broken records and blobs")
+	checksums := fs.Bool("checksums", false, "read every blob to verify its checksum")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	opts := storage.CheckOptions{Repair: storage.Repair(*repair), Checksums: *checksums}
+	if opts.Repair != storage.RepairNone && opts.Repair != storage.RepairQuarantine && opts.Repair != storage.RepairDelete {
+		return fmt.Errorf("unknown repair %q", *repair)
+	}
+
+	store, err := openFileStore()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := store.Check(opts)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err = enc.Encode(report); err != nil {
+		return err
+	}
+
+	if len(report.Problems) > 0 && opts.Repair == storage.RepairNone {
+		return fmt.Errorf("%d problems found", len(report.Problems))
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/pkg/config"
+)
+
+// GC rewrites the badger value log files of a stopped server to reclaim the space of deleted records,
+// for example
+//
+//	server gc
+//	server gc -discard-ratio 0.2
+//
+// A running server does it on JOB_VALUE_LOG_GC_SCHEDULE or with POST /api/jobs/value-log-gc.
+func GC(args []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	ratio := fs.Float64("discard-ratio", valueLogDiscardRatio, "share of stale data that makes a file rewritten")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *ratio <= 0 || *ratio >= 1 {
+		return fmt.Errorf("-discard-ratio %v must be between 0 and 1", *ratio)
+	}
+
+	cfg, err := config.Load(context.Background(), configFile)
+	if err != nil {
+		return err
+	}
+
+	store, err := OpenMetadata(cfg.GetMetadataDriver(), cfg.GetMetadataPath())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	gc, ok := store.(garbageCollector)
+	if !ok {
+		return fmt.Errorf("the %s metadata driver has no value log", cfg.GetMetadataDriver())
+	}
+
+	if err = gc.CollectGarbage(*ratio); err != nil {
+		return err
+	}
+
+	fmt.Println("value log collected")
+
+	return nil
+}
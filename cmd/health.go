@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/config"
+	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/health"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// pinger is implemented by metadata stores able to tell whether they accept writes.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// MustHealth registers the checks of the metadata store, the blob storage and, with HTTPS on, the certificates.
+func MustHealth(cfg config.Config, store storage.Store, fs filesystem.Storage, certs *autocert.Manager) *health.Checker {
+	opts := cfg.GetHealthOptions()
+	c := health.New(opts.Timeout)
+
+	c.Add("metadata", health.Liveness, func(ctx context.Context) (string, error) {
+		if p, ok := store.(pinger); ok {
+			return "written", p.Ping(ctx)
+		}
+
+		// stores without Ping are only read
+		_, err := store.Get("health", &storage.File{})
+		return "read", err
+	})
+	c.Add("storage", health.Readiness, health.Writable(fs))
+	c.Add("free_space", health.Readiness, health.FreeSpace(fs, opts.MinFreeBytes, opts.MinFreePercent))
+
+	if certs != nil {
+		c.Add("certificates", health.Readiness, health.Certificates(certs.Cache, cfg.GetWhiteListDomains(), opts.CertMinValidity))
+	}
+
+	return c
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/config"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/scheduler"
+	"time"
+)
+
+// valueLogDiscardRatio is the share of stale data that makes badger rewrite a value log file.
+const valueLogDiscardRatio = 0.5
+
+// garbageCollector is implemented by metadata stores that reclaim disk space on request.
+type garbageCollector interface {
+	CollectGarbage(discardRatio float64) error
+}
+
+// MustScheduler registers the background jobs, the value log GC only for metadata stores that have one.
+func MustScheduler(logger log.Logger, cfg config.Config, store storage.Store, service storage.Service, auditLog *audit.Log) *scheduler.Scheduler {
+	s := scheduler.New(cfg.GetParallelGoroutines(), logger)
+
+	if gc, ok := store.(garbageCollector); ok {
+		MustAddJob(s, cfg, config.JobValueLogGC, func(context.Context) error {
+			return gc.CollectGarbage(valueLogDiscardRatio)
+		})
+	}
+
+	MustAddJob(s, cfg, config.JobReapExpired, func(ctx context.Context) error {
+		return reapExpired(ctx, service, auditLog)
+	})
+
+	opts := storage.CheckOptions{Repair: storage.Repair(cfg.GetScrubRepair()), Checksums: cfg.GetScrubChecksums()}
+	MustAddJob(s, cfg, config.JobScrub, func(ctx context.Context) error {
+		return scrub(ctx, service, auditLog, opts)
+	})
+
+	return s
+}
+
+// reapExpired deletes the files past their expiry date, they are already hidden from clients.
+func reapExpired(ctx context.Context, service storage.Service, auditLog *audit.Log) error {
+	deleted, err := service.DeleteExpired(ctx, time.Now())
+	for _, k := range deleted {
+		auditLog.Record(ctx, audit.Event{
+			Action: audit.ActionDelete,
+			Actor:  config.JobReapExpired,
+			Target: k,
+			Detail: map[string]any{"via": "expiry"},
+		})
+	}
+
+	return err
+}
+
+// scrub checks the records against the blobs, the problems left unrepaired fail the run.
+func scrub(ctx context.Context, service storage.Service, auditLog *audit.Log, opts storage.CheckOptions) error {
+	report, err := service.Check(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	if len(report.Problems) == 0 {
+		return nil
+	}
+
+	if opts.Repair == storage.RepairNone {
+		return fmt.Errorf("%d problems found, see GET /api/fsck", len(report.Problems))
+	}
+
+	auditLog.Record(ctx, audit.Event{
+		Action: audit.ActionRepair,
+		Actor:  config.JobScrub,
+		Detail: map[string]any{"repair": opts.Repair, "problems": len(report.Problems)},
+	})
+
+	return nil
+}
+
+func MustAddJob(s *scheduler.Scheduler, cfg config.Config, name string, run func(ctx context.Context) error) {
+	err := s.Add(scheduler.Job{
+		Name:     name,
+		Schedule: cfg.GetJobSchedule(name),
+		Disabled: !cfg.JobIsEnabled(name),
+		Run:      run,
+	})
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/config"
+	"github.com/labi-le/server/pkg/keys"
+	"github.com/labi-le/server/pkg/log"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// Keys manages the API keys, for example
+//
+//	server keys list
+//	server keys add alice
+//	server keys revoke alice
+//	server keys generate
+//
+// add and revoke change KEYS_PATH of a stopped server and record the change in the audit log,
+// a running server is changed through /api/keys. generate prints a random key to put in OWNER_KEY.
+func Keys(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: server keys list|add|revoke|generate [flags]")
+	}
+
+	switch args[0] {
+	case "list":
+		return listKeys(args[1:])
+	case "add":
+		return addKey(args[1:])
+	case "revoke":
+		return revokeKey(args[1:])
+	case "generate":
+		return generateKey(args[1:])
+	default:
+		return fmt.Errorf("unknown keys command %q, must be list, add, revoke or generate", args[0])
+	}
+}
+
+func listKeys(args []string) error {
+	fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+	reveal := fs.Bool("reveal", false, "print the keys in full")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.Load(context.Background(), configFile)
+	if err != nil {
+		return err
+	}
+
+	keyStore, err := keys.Open(cfg.GetKeysPath(), storage.OwnerName)
+	if err != nil {
+		return err
+	}
+
+	shown := func(key string) string {
+		if *reveal {
+			return key
+		}
+		return keys.Mask(key)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tKEY\tSET BY\tCREATED\tREVOKED")
+	fmt.Fprintf(w, "%s\t%s\t%s\t-\t-\n", storage.OwnerName, shown(cfg.GetOwnerKey()), "OWNER_KEY")
+	for _, k := range keyStore.List() {
+		revoked := "-"
+		if k.Revoked() {
+			revoked = k.RevokedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.Name, shown(k.Key), "KEYS_PATH", k.CreatedAt.Format(time.RFC3339), revoked)
+	}
+
+	return w.Flush()
+}
+
+func addKey(args []string) error {
+	fs := flag.NewFlagSet("keys add", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: server keys add <name>")
+	}
+
+	return changeKeys(func(keyStore *keys.Store, auditLog *audit.Log) error {
+		k, err := keyStore.Add(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fs.Arg(0), err)
+		}
+
+		recordKeyChange(auditLog, audit.ActionKeyCreate, k.Name)
+		// the only time the key is shown in full without -reveal
+		fmt.Printf("added %s: %s\n", k.Name, k.Key)
+
+		return nil
+	})
+}
+
+func revokeKey(args []string) error {
+	fs := flag.NewFlagSet("keys revoke", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: server keys revoke <name>")
+	}
+
+	return changeKeys(func(keyStore *keys.Store, auditLog *audit.Log) error {
+		k, err := keyStore.Revoke(fs.Arg(0))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fs.Arg(0), err)
+		}
+
+		recordKeyChange(auditLog, audit.ActionKeyRevoke, k.Name)
+		fmt.Printf("revoked %s\n", k.Name)
+
+		return nil
+	})
+}
+
+// changeKeys opens the key file and the audit log for a change made from the command line.
+func changeKeys(change func(keyStore *keys.Store, auditLog *audit.Log) error) error {
+	cfg, err := config.Load(context.Background(), configFile)
+	if err != nil {
+		return err
+	}
+
+	keyStore, err := keys.Open(cfg.GetKeysPath(), storage.OwnerName)
+	if err != nil {
+		return err
+	}
+
+	auditLog, err := audit.Open(cfg.GetAuditPath(), log.New())
+	if err != nil {
+		return err
+	}
+	defer auditLog.Close()
+
+	return change(keyStore, auditLog)
+}
+
+func recordKeyChange(auditLog *audit.Log, action, name string) {
+	auditLog.Record(context.Background(), audit.Event{
+		Action: action,
+		Actor:  "cli",
+		Target: name,
+		Detail: map[string]any{"via": "cli"},
+	})
+}
+
+func generateKey(args []string) error {
+	fs := flag.NewFlagSet("keys generate", flag.ContinueOnError)
+	size := fs.Int("bytes", keys.DefaultSize, "random bytes in the key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *size < 16 {
+		return errors.New("-bytes must be at least 16")
+	}
+
+	key, err := keys.Generate(*size)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(key)
+
+	return nil
+}
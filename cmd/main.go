@@ -2,64 +2,269 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"github.com/dgraph-io/badger"
 	"github.com/dgraph-io/badger/options"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/favicon"
+	"github.com/labi-le/server/internal/server/admin"
 	"github.com/labi-le/server/internal/server/basic"
+	"github.com/labi-le/server/internal/server/health"
 	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/audit"
 	"github.com/labi-le/server/pkg/badgerdb"
+	"github.com/labi-le/server/pkg/bboltdb"
 	"github.com/labi-le/server/pkg/config"
 	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/keys"
 	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/media"
+	"github.com/labi-le/server/pkg/metrics"
+	"github.com/labi-le/server/pkg/ratelimit"
 	"github.com/labi-le/server/pkg/response"
+	"github.com/labi-le/server/pkg/sqlitedb"
+	"github.com/labi-le/server/pkg/tracing"
 	"go.uber.org/zap"
 	"golang.org/x/crypto/acme/autocert"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 )
 
+// command is a subcommand of the server binary.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// commands are listed by help in this order, the first one runs when no command is named.
+// They take the flags of their own after the name, the maintenance ones work on the badger
+// directory and the storage of a stopped server.
+var commands = []command{
+	{"serve", "run the server", Serve},
+	{"version", "print the version", Version},
+	{"config", "check the config", CheckConfig},
+	{"keys", "list, add and revoke the API keys", Keys},
+	{"files", "list, show and delete files by short ID", Files},
+	{"gc", "reclaim the space of the badger value log", GC},
+	{"fsck", "compare the metadata with the blobs", Fsck},
+	{"export", "write an archive of the metadata and the blobs", Export},
+	{"import", "load an archive made by export", Import},
+	{"migrate-metadata", "copy the file records to another metadata driver", MigrateMetadata},
+}
+
+// aliases are the former names of commands.
+var aliases = map[string]string{
+	"backup":  "export",
+	"restore": "import",
+}
+
+// configFile is the YAML or TOML file the config is read from under the environment.
+var configFile string
+
+// debugMode is the -debug flag given before the command, serve takes it after the name as well.
+var debugMode bool
+
 func main() {
-	var debugMode bool
 	flag.BoolVar(&debugMode, "debug", false, "debug mode")
+	flag.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file, environment variables take precedence")
+	flag.Usage = usage
 	flag.Parse()
 
-	cfg := MustConfig(context.Background())
+	name, args := commands[0].name, []string{}
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+
+	if name == "help" {
+		usage()
+		return
+	}
 
-	logger := MustLogger(debugMode, cfg.GetLogLevel())
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// lookupCommand returns the command with the given name or alias.
+func lookupCommand(name string) (command, bool) {
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return command{}, false
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [-config file] [-debug] [command] [flags]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %-18s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(out, "\nThe server is run when no command is given, -h after a command lists its flags.\n\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// Serve runs the server until SIGINT or SIGTERM, for example
+//
+//	server serve -debug
+//
+// It is the command run when none is given.
+func Serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.BoolVar(&debugMode, "debug", debugMode, "debug mode")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
 
-	server := MustServer(cfg, logger)
+	// a second signal kills the process right away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	live := MustConfig(ctx, configFile)
+	cfg := live.Config()
+
+	logger, logLevel, closeLog := MustLogger(debugMode, cfg.GetLogLevel(), cfg.GetLogOptions())
+
+	flushSpans := MustTracing(ctx, cfg)
+
+	m := metrics.New()
+
+	server := MustServer(live, logger, m)
 
 	reply := response.New(logger)
-	MustBasic(server, reply, cfg.GetDiscordLink())
 
-	store := MustStorage(server, logger, cfg, reply)
-	defer store.Close()
+	MustRateLimit(server, reply, live)
+
+	// background work outlives the signal until the requests that feed it are drained
+	work, stopWork := context.WithCancel(context.Background())
+	fs := MustFilesystem(cfg)
+	store, service, analyzer := MustStorage(work, logger, cfg, fs)
+
+	auditLog := MustAudit(cfg, logger)
+	keyStore := MustKeys(cfg)
 
-	if cfg.GetEnableHTTPS() {
-		go UpTLSServer(logger, server, cfg)
+	jobs := MustScheduler(logger, cfg, store, service, auditLog)
+	jobs.Start(work)
+
+	certs := MustCertManager(cfg)
+
+	// the S3 API shares the paths with the other handlers and picks the signed requests first
+	storage.RegisterS3Handlers(server, service, StorageOptions(live, m, auditLog, keyStore), reply)
+	MustBasic(server, reply, live)
+	admin.RegisterHandlers(server, jobs, logLevel, auditLog, keyStore, cfg.GetOwnerKey(), reply)
+	health.RegisterHandlers(server, MustHealth(cfg, store, fs, certs), reply)
+	MustMetrics(server, m, store, service)
+	storage.RegisterHandlers(server, service, StorageOptions(live, m, auditLog, keyStore), reply)
+
+	WatchReload(ctx, live, logger, logLevel, auditLog)
+
+	if certs != nil {
+		UpTLSServer(logger, server, certs)
 	}
 
-	if httpServerErr := server.Listen(cfg.GetServerConn()); httpServerErr != nil {
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- server.Listen(cfg.GetServerConn())
+	}()
+
+	select {
+	case <-ctx.Done():
+		logger.Info("shutting down")
+	case httpServerErr := <-listenErr:
 		logger.Warn(httpServerErr)
 	}
+	stop()
 
+	// closes the listeners, the TLS one included, and waits for the requests in flight
+	if err := server.ShutdownWithTimeout(cfg.GetShutdownTimeout()); err != nil {
+		logger.Warn("requests were cut off: ", err)
+	}
+
+	stopWork()
+	analyzer.Wait()
+	jobs.Wait()
+
+	// badger doesn't sync writes, they are flushed on close
+	if err := store.Close(); err != nil {
+		logger.Error("can't close the metadata store: ", err)
+	}
+
+	if err := auditLog.Close(); err != nil {
+		logger.Error("can't close the audit log: ", err)
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), cfg.GetShutdownTimeout())
+	defer cancelFlush()
+	if err := flushSpans(flushCtx); err != nil {
+		logger.Warn("spans were not exported: ", err)
+	}
+
+	if err := closeLog(); err != nil {
+		fmt.Fprintln(os.Stderr, "can't close the log:", err)
+	}
+
+	return nil
+}
+
+// MustConfig loads the config, it exits listing the invalid fields.
+func MustConfig(ctx context.Context, file string) *config.Live {
+	live, err := config.NewLive(ctx, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return live
 }
 
-func MustConfig(ctx context.Context) config.Config {
-	cfg, err := config.NewFromENV(ctx)
+// MustTracing sets up the propagation and the export of spans, the returned function flushes them.
+func MustTracing(ctx context.Context, cfg config.Config) func(ctx context.Context) error {
+	flush, err := tracing.Setup(ctx, cfg.GetTracingOptions())
 	if err != nil {
 		panic(err)
 	}
-	return cfg
+	return flush
 }
 
-func MustServer(cfg config.Config, logger log.Logger) *fiber.App {
+func MustServer(live *config.Live, logger log.Logger, m *metrics.Metrics) *fiber.App {
+	cfg := live.Config()
 	r := fiber.New(fiber.Config{
 		DisableStartupMessage: false,
 		BodyLimit:             cfg.GetMaxUploadSize(),
+		RequestMethods:        append(fiber.DefaultMethods[:len(fiber.DefaultMethods):len(fiber.DefaultMethods)], storage.WebDAVMethods...),
 	})
 
-	r.Use(log.LoggerMiddleware(logger))
+	// streamed responses are still being sent when the handlers return
+	r.Server().ConnState = m.ConnState
+
+	r.Use(tracing.Middleware())
+	r.Use(m.Middleware())
+	r.Use(log.LoggerMiddleware(logger, func() log.MiddlewareOptions {
+		return live.Config().GetAccessLogOptions()
+	}))
 	//r.Use(cache.New(cache.Config{
 	//	Next: func(c *fiber.Ctx) bool {
 	//		return c.Query("refresh") == "true"
@@ -76,72 +281,202 @@ func MustServer(cfg config.Config, logger log.Logger) *fiber.App {
 	return r
 }
 
-func MustBasic(r *fiber.App, reply *response.Reply, link string) {
-	basic.RegisterHandlers(r, reply, link)
+// MustRateLimit limits the requests per minute of every client IP to RATE_LIMIT,
+// probes and metric scrapes are not limited.
+func MustRateLimit(r *fiber.App, reply *response.Reply, live *config.Live) {
+	limit := func() int {
+		return live.Config().GetRateLimit()
+	}
+
+	r.Use(ratelimit.Middleware(ratelimit.New(time.Minute), limit, reply, "/healthz", "/readyz", "/metrics"))
+}
+
+func MustBasic(r *fiber.App, reply *response.Reply, live *config.Live) {
+	basic.RegisterHandlers(r, reply, func() string {
+		return live.Config().GetDiscordLink()
+	})
 }
 
-func MustStorage(r *fiber.App, log log.Logger, cfg config.Config, reply *response.Reply) badgerdb.Store {
-	defaultOpt := badger.DefaultOptions("db")
-	defaultOpt.SyncWrites = false
-	defaultOpt.TableLoadingMode = options.LoadToRAM
-	// defaultOpt.ValueLogLoadingMode = options.MemoryMap
+// MustStorage opens the stores of files, the media analysis runs until ctx is done.
+func MustStorage(ctx context.Context, log log.Logger, cfg config.Config, fs filesystem.Storage) (storage.Store, storage.Service, *storage.Analyzer) {
+	client, err := OpenMetadata(cfg.GetMetadataDriver(), cfg.GetMetadataPath())
+	if err != nil {
+		panic(err)
+	}
+
+	if a, ok := fs.(filesystem.AtomicCreator); ok {
+		// nothing is written yet, whatever is pending was interrupted
+		if err = a.RemovePending(); err != nil {
+			log.Warn("can't remove interrupted uploads: ", err)
+		}
+	}
+
+	fileStore := storage.NewStore(client, fs)
 
-	db, dbErr := badger.Open(defaultOpt)
-	client := badgerdb.NewWithBadger(db)
-	if dbErr != nil {
-		log.Error(dbErr)
+	// uploads interrupted by a crash leave their staged blobs behind
+	if removed, removeErr := fileStore.RemoveStaged(time.Now()); removeErr != nil {
+		log.Warn("can't remove interrupted uploads: ", removeErr)
+	} else if len(removed) > 0 {
+		log.Infof("removed %d interrupted uploads", len(removed))
 	}
 
-	storage.RegisterHandlers(
-		r,
-		storage.NewService(
-			storage.NewStore(client,
-				filesystem.New(cfg.GetVirtualFSPath()),
-			),
-		),
-		cfg.GetOwnerKey(),
-		reply,
-	)
+	analyzer := NewAnalyzer(ctx, fileStore, log, cfg)
 
-	return client
+	return client, storage.NewService(fileStore, analyzer), analyzer
 }
 
-func UpTLSServer(logger log.Logger, r *fiber.App, cfg config.Config) {
+// OpenMetadata opens the key-value store of file records, an empty path means the default of the driver.
+func OpenMetadata(driver, path string) (storage.Store, error) {
+	switch driver {
+	case "badger":
+		if path == "" {
+			path = "db"
+		}
+
+		defaultOpt := badger.DefaultOptions(path)
+		defaultOpt.SyncWrites = false
+		defaultOpt.TableLoadingMode = options.LoadToRAM
+		// defaultOpt.ValueLogLoadingMode = options.MemoryMap
+
+		db, err := badger.Open(defaultOpt)
+		if err != nil {
+			return nil, err
+		}
+		return badgerdb.NewWithBadger(db), nil
+	case "sqlite":
+		return sqlitedb.NewStore(sqlitedb.Options{Path: path})
+	case "bbolt":
+		return bboltdb.NewStore(bboltdb.Options{Path: path})
+	default:
+		return nil, fmt.Errorf("unknown metadata driver: %s", driver)
+	}
+}
+
+// StorageOptions configures the file handlers, the reloadable settings are read from live on every request.
+func StorageOptions(live *config.Live, m *metrics.Metrics, auditLog *audit.Log, keyStore *keys.Store) storage.Options {
+	cfg := live.Config()
+	return storage.Options{
+		OwnerKey: cfg.GetOwnerKey(),
+		Keys:     keyStore,
+		StripMetadata: func() bool {
+			return live.Config().GetStripMetadata()
+		},
+		Redirect: func() bool {
+			return live.Config().GetS3Redirect()
+		},
+		Quota: func() int64 {
+			return live.Config().GetUploadQuota()
+		},
+		Bucket:   cfg.GetS3APIBucket(),
+		Rejected: m.Rejected,
+		Audit:    auditLog,
+	}
+}
+
+// MustAudit opens the audit log at AUDIT_PATH.
+func MustAudit(cfg config.Config, logger log.Logger) *audit.Log {
+	auditLog, err := audit.Open(cfg.GetAuditPath(), logger)
+	if err != nil {
+		panic(err)
+	}
+
+	return auditLog
+}
+
+// MustKeys loads the API keys added besides OWNER_KEY from KEYS_PATH.
+func MustKeys(cfg config.Config) *keys.Store {
+	keyStore, err := keys.Open(cfg.GetKeysPath(), storage.OwnerName)
+	if err != nil {
+		panic(err)
+	}
+
+	return keyStore
+}
+
+// MustFilesystem returns the storage for file blobs selected by STORAGE_DRIVER.
+func MustFilesystem(cfg config.Config) filesystem.Storage {
+	switch cfg.GetStorageDriver() {
+	case "fs":
+		return filesystem.New(cfg.GetVirtualFSPath())
+	case "s3":
+		s3, err := filesystem.NewS3(cfg.GetS3Options())
+		if err != nil {
+			panic(err)
+		}
+		return s3
+	default:
+		panic("unknown storage driver: " + cfg.GetStorageDriver())
+	}
+}
+
+// NewAnalyzer starts the background media analysis,
+// it returns nil and leaves uploads unprocessed when ffmpeg is not installed.
+func NewAnalyzer(ctx context.Context, store storage.FileStore, log log.Logger, cfg config.Config) *storage.Analyzer {
+	prober, err := media.NewFFmpeg(cfg.GetFFprobePath(), cfg.GetFFmpegPath())
+	if err != nil {
+		log.Warn("media analysis is disabled: ", err)
+		return nil
+	}
+
+	analyzer := storage.NewAnalyzer(store, prober, log)
+	analyzer.Run(ctx, cfg.GetMediaWorkers())
+
+	return analyzer
+}
+
+// MustCertManager returns the manager of the certificates of the whitelisted domains, nil when HTTPS is off.
+// It is set up as autocert.NewListener does with the cache directory taken from the config.
+func MustCertManager(cfg config.Config) *autocert.Manager {
+	if !cfg.GetEnableHTTPS() {
+		return nil
+	}
+
+	dir := cfg.GetTLSCacheDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		panic(err)
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.GetWhiteListDomains()...),
+		Cache:      autocert.DirCache(dir),
+	}
+}
+
+// UpTLSServer serves r over HTTPS as well, the listener is closed when r shuts down.
+func UpTLSServer(logger log.Logger, r *fiber.App, certs *autocert.Manager) {
 	logger.Info("Starting server in production mode")
 	go func() {
-		if httpsServerErr := r.Listener(autocert.NewListener(cfg.GetWhiteListDomains()...)); httpsServerErr != nil {
+		if httpsServerErr := r.Listener(certs.Listener()); httpsServerErr != nil {
 			logger.Error(httpsServerErr)
 		}
 
 	}()
 }
 
-// MustLogger returns a logger based on the given parameters.
+// MustLogger returns a logger based on the given parameters and the level it writes from,
+// the level is changed at runtime through the admin API. The closer flushes the log file.
 // see zapcore.level
-func MustLogger(debug bool, level string) log.Logger {
+func MustLogger(debug bool, level string, opts log.Options) (log.Logger, zap.AtomicLevel, func() error) {
 	if level == "disable" {
-		return log.NilLogger{}
+		return log.NilLogger{}, zap.NewAtomicLevel(), func() error { return nil }
 	}
 
 	if debug {
-		l := zap.Must(zap.NewDevelopment())
-		// set level to debug
-		l.Core().Enabled(zap.DebugLevel)
-		return log.NewWithZap(l)
+		level = "debug"
+		opts.Format = log.FormatConsole
+		opts.Development = true
 	}
 
-	// parse level
 	atomicLevel, err := zap.ParseAtomicLevel(level)
 	if err != nil {
 		panic(err)
 	}
 
-	// create logger
-	l, prodErr := zap.NewProduction()
-	if prodErr != nil {
-		panic(prodErr)
+	l, closer, err := log.Build(opts, atomicLevel)
+	if err != nil {
+		panic(err)
 	}
-	l.Core().Enabled(atomicLevel.Level())
 
-	return log.NewWithZap(l)
+	return log.NewWithZap(l), atomicLevel, closer.Close
 }
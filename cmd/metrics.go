@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sizer is implemented by metadata stores that report their size on disk.
+type sizer interface {
+	Size() (lsm, vlog int64)
+}
+
+// MustMetrics serves /metrics with the storage usage and the size of the metadata store added.
+func MustMetrics(r fiber.Router, m *metrics.Metrics, store storage.Store, service storage.Service) {
+	m.MustRegister(&usageCollector{service: service})
+
+	if s, ok := store.(sizer); ok {
+		m.GaugeFunc("badger_lsm_size_bytes", "Size of the badger LSM tree.", func() float64 {
+			lsm, _ := s.Size()
+			return float64(lsm)
+		})
+		m.GaugeFunc("badger_vlog_size_bytes", "Size of the badger value log.", func() float64 {
+			_, vlog := s.Size()
+			return float64(vlog)
+		})
+	}
+
+	r.Get("metrics", m.Handler())
+}
+
+var (
+	filesDesc = prometheus.NewDesc("server_storage_files", "Stored files.", nil, nil)
+	bytesDesc = prometheus.NewDesc("server_storage_bytes", "Size of the stored files, previous versions included.", nil, nil)
+)
+
+// usageCollector reads the storage usage on every scrape, it lists all the records.
+type usageCollector struct {
+	service storage.Service
+}
+
+func (c *usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filesDesc
+	ch <- bytesDesc
+}
+
+func (c *usageCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := c.service.Usage(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(filesDesc, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(usage.Files))
+	ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(usage.Bytes))
+}
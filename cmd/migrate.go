@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"strings"
+)
+
+// MigrateMetadata copies every record from one metadata backend to another, for example
+//
+//	server migrate-metadata -from badger:db -to sqlite:metadata.db
+//
+// Records are copied as they are encoded, so both stores must use the same codec (JSON by default).
+// The target must be empty, the source is left untouched.
+func MigrateMetadata(args []string) error {
+	fs := flag.NewFlagSet("migrate-metadata", flag.ContinueOnError)
+	from := fs.String("from", "badger:db", "source store as driver:path")
+	to := fs.String("to", "", "target store as driver:path")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+
+	src, err := openMetadataSpec(*from)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", *from, err)
+	}
+	defer src.Close()
+
+	dst, err := openMetadataSpec(*to)
+	if err != nil {
+		return fmt.Errorf("open %s: %w", *to, err)
+	}
+	defer dst.Close()
+
+	srcKeys, err := storeKeys(src)
+	if err != nil {
+		return err
+	}
+
+	if dstKeys, keysErr := storeKeys(dst); keysErr != nil || len(dstKeys) > 0 {
+		return fmt.Errorf("target %s is not empty", *to)
+	}
+
+	for _, k := range srcKeys {
+		var record json.RawMessage
+		found, getErr := src.Get(k, &record)
+		if getErr != nil {
+			return fmt.Errorf("read %s: %w", k, getErr)
+		}
+
+		if !found {
+			// removed while copying
+			continue
+		}
+
+		if setErr := dst.Set(k, record); setErr != nil {
+			return fmt.Errorf("write %s: %w", k, setErr)
+		}
+	}
+
+	fmt.Printf("copied %d records from %s to %s\n", len(srcKeys), *from, *to)
+
+	return nil
+}
+
+// openMetadataSpec opens a store described as driver:path, the path may be omitted.
+func openMetadataSpec(spec string) (storage.Store, error) {
+	driver, path, _ := strings.Cut(spec, ":")
+
+	return OpenMetadata(driver, path)
+}
+
+func storeKeys(s storage.Store) ([]string, error) {
+	lister, ok := s.(storage.Lister)
+	if !ok {
+		return nil, errors.New("store can't list its keys")
+	}
+
+	return lister.Keys("")
+}
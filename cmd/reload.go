@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/config"
+	"github.com/labi-le/server/pkg/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// WatchReload reloads the config on SIGHUP until ctx is done.
+func WatchReload(ctx context.Context, live *config.Live, logger log.Logger, level zap.AtomicLevel, auditLog *audit.Log) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hup)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				Reload(ctx, live, logger, level, auditLog)
+			}
+		}
+	}()
+}
+
+// Reload applies the reloadable fields of the config, the handlers read the others from live on every request.
+// An invalid config is logged and the one in effect is kept.
+func Reload(ctx context.Context, live *config.Live, logger log.Logger, level zap.AtomicLevel, auditLog *audit.Log) {
+	applied, restart, err := live.Reload(ctx)
+	if err != nil {
+		logger.Error("the config is not reloaded: ", err)
+		return
+	}
+
+	if slices.Contains(applied, "LOG_LEVEL") {
+		if l, parseErr := zapcore.ParseLevel(live.Config().GetLogLevel()); parseErr == nil {
+			level.SetLevel(l)
+		} else {
+			logger.Warn("LOG_LEVEL=disable takes a restart")
+		}
+	}
+
+	if len(restart) > 0 {
+		logger.Warn("the changes of ", strings.Join(restart, ", "), " take a restart")
+	}
+
+	logger.Info("the config is reloaded, changed: ", strings.Join(applied, ", "))
+
+	auditLog.Record(ctx, audit.Event{
+		Action: audit.ActionConfigReload,
+		Actor:  "sighup",
+		Detail: map[string]any{"applied": applied, "restart": restart},
+	})
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/labi-le/server/internal"
+)
+
+// Version prints the version, the commit and the build time of the binary,
+// a running server reports the same with GET /version.
+func Version(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Println(internal.BuildVersionString())
+
+	return nil
+}
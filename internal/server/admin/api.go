@@ -0,0 +1,244 @@
+package admin
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/keys"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/response"
+	"github.com/labi-le/server/pkg/scheduler"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+var (
+	ErrInvalidKey   = errors.New("invalid key")
+	ErrInvalidLevel = errors.New("invalid log level")
+	ErrInvalidLimit = errors.New("invalid limit")
+)
+
+// RegisterHandlers serves the state of the background jobs, the log level, the audit log and the API keys to the owner,
+// it must be registered before the storage handlers catching every path.
+func RegisterHandlers(r fiber.Router, jobs *scheduler.Scheduler, level zap.AtomicLevel, auditLog *audit.Log, keyStore *keys.Store, ownerKey string, reply *response.Reply) {
+	res := &resource{
+		jobs:     jobs,
+		level:    level,
+		audit:    auditLog,
+		keys:     keyStore,
+		ownerKey: ownerKey,
+		reply:    reply,
+	}
+
+	r.Get("api/jobs", res.Jobs)
+	r.Post("api/jobs/:name", res.RunJob)
+	r.Get("api/log/level", res.LogLevel)
+	r.Put("api/log/level", res.SetLogLevel)
+	r.Get("api/audit", res.Audit)
+	r.Get("api/audit/export", res.ExportAudit)
+	r.Get("api/keys", res.Keys)
+	r.Post("api/keys", res.AddKey)
+	r.Delete("api/keys/:name", res.RevokeKey)
+}
+
+type resource struct {
+	jobs     *scheduler.Scheduler
+	level    zap.AtomicLevel
+	audit    *audit.Log
+	keys     *keys.Store
+	ownerKey string
+	reply    *response.Reply
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// Jobs returns the schedule, the latest runs and the last error of every job.
+func (r *resource) Jobs(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	return r.reply.OK(ctx, r.jobs.Status())
+}
+
+// RunJob starts a job right away, its outcome shows up in Jobs.
+func (r *resource) RunJob(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	err := r.jobs.Trigger(ctx.Params("name"))
+	switch {
+	case errors.Is(err, scheduler.ErrUnknownJob):
+		return r.reply.NotFound(ctx, err)
+	case errors.Is(err, scheduler.ErrRunning):
+		return r.reply.Conflict(ctx, err)
+	case err != nil:
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	r.record(ctx, audit.ActionRunJob, ctx.Params("name"), nil)
+
+	return r.reply.Accepted(ctx, fiber.Map{"name": ctx.Params("name")})
+}
+
+// LogLevel returns the level the log is written from.
+func (r *resource) LogLevel(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	return r.reply.OK(ctx, logLevel{Level: r.level.String()})
+}
+
+// SetLogLevel changes the level the log is written from until the server restarts.
+func (r *resource) SetLogLevel(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	var req logLevel
+	if err := ctx.BodyParser(&req); err != nil {
+		return r.reply.BadRequest(ctx, err)
+	}
+
+	level, err := zapcore.ParseLevel(req.Level)
+	if err != nil {
+		return r.reply.BadRequest(ctx, fmt.Errorf("%w: %q", ErrInvalidLevel, req.Level))
+	}
+
+	previous := r.level.Level()
+	r.level.SetLevel(level)
+	r.record(ctx, audit.ActionLogLevel, "", map[string]any{"from": previous.String(), "to": level.String()})
+
+	return r.reply.OK(ctx, logLevel{Level: level.String()})
+}
+
+// Audit returns a page of the audit log, newest events first.
+// It is narrowed by ?action= and ?actor=, the next page is requested with ?before= set to its next field.
+func (r *resource) Audit(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	limit := ctx.QueryInt("limit", audit.DefaultLimit)
+	if limit <= 0 || limit > audit.MaxLimit {
+		return r.reply.BadRequest(ctx, ErrInvalidLimit)
+	}
+
+	page, err := r.audit.List(audit.Query{
+		Before: ctx.Query("before"),
+		Limit:  limit,
+		Action: ctx.Query("action"),
+		Actor:  ctx.Query("actor"),
+	})
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	return r.reply.OK(ctx, page)
+}
+
+// ExportAudit streams the whole audit log as JSON lines, oldest events first.
+func (r *resource) ExportAudit(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	ctx.Attachment(fmt.Sprintf("audit-%s.jsonl", time.Now().UTC().Format("20060102T150405Z")))
+	ctx.Set(fiber.HeaderContentType, "application/x-ndjson")
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// the status is already sent, a failure leaves the export cut short
+		_ = r.audit.Export(w)
+	})
+
+	return nil
+}
+
+// Keys lists the API keys added besides OWNER_KEY with their values masked.
+func (r *resource) Keys(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	list := r.keys.List()
+	for i := range list {
+		list[i].Key = keys.Mask(list[i].Key)
+	}
+
+	return r.reply.OK(ctx, list)
+}
+
+type newKey struct {
+	Name string `json:"name"`
+}
+
+// AddKey generates a key with the given name, it is shown in full only in this response.
+func (r *resource) AddKey(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	var req newKey
+	if err := ctx.BodyParser(&req); err != nil {
+		return r.reply.BadRequest(ctx, err)
+	}
+
+	key, err := r.keys.Add(req.Name)
+	switch {
+	case errors.Is(err, keys.ErrInvalidName):
+		return r.reply.BadRequest(ctx, err)
+	case errors.Is(err, keys.ErrNameTaken):
+		return r.reply.Conflict(ctx, err)
+	case err != nil:
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	r.record(ctx, audit.ActionKeyCreate, key.Name, nil)
+
+	return r.reply.Created(ctx, key)
+}
+
+// RevokeKey stops a key from granting access, its name stays taken.
+func (r *resource) RevokeKey(ctx *fiber.Ctx) error {
+	if !r.isOwner(ctx) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	key, err := r.keys.Revoke(ctx.Params("name"))
+	switch {
+	case errors.Is(err, keys.ErrNotFound):
+		return r.reply.NotFound(ctx, err)
+	case errors.Is(err, keys.ErrRevoked):
+		return r.reply.Conflict(ctx, err)
+	case err != nil:
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	r.record(ctx, audit.ActionKeyRevoke, key.Name, nil)
+	key.Key = keys.Mask(key.Key)
+
+	return r.reply.OK(ctx, key)
+}
+
+// record adds an action of the owner to the audit log.
+func (r *resource) record(ctx *fiber.Ctx, action, target string, detail map[string]any) {
+	r.audit.Record(ctx.UserContext(), audit.Request(ctx, action, target, detail))
+}
+
+func (r *resource) isOwner(ctx *fiber.Ctx) bool {
+	if ctx.Get("authorization") != r.ownerKey {
+		return false
+	}
+
+	log.SetKeyName(ctx, storage.OwnerName)
+
+	return true
+}
@@ -1,26 +1,47 @@
 package basic
 
 import (
+	_ "embed"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/labi-le/server/internal"
 	"github.com/labi-le/server/pkg/response"
 	"net/http"
 )
 
-func RegisterHandlers(r fiber.Router, reply *response.Reply, link string) {
+// homePage is the upload UI, it talks to the storage handlers from the browser
+//
+//go:embed web/index.html
+var homePage []byte
+
+var ErrNoLink = errors.New("discord link is not set")
+
+// RegisterHandlers serves the home page, the version and the redirect to the Discord server,
+// link is read on every request and the redirect is not found while it is empty.
+func RegisterHandlers(r fiber.Router, reply *response.Reply, link func() string) {
 	res := &resource{
 		reply: reply,
+		link:  link,
 	}
 
 	r.Get("/", res.HomePage)
 	r.Get("version", res.Version)
-	r.Get("discord", func(ctx *fiber.Ctx) error {
-		return ctx.Redirect(link, http.StatusMovedPermanently)
-	})
+	r.Get("discord", res.Discord)
 }
 
 type resource struct {
 	reply *response.Reply
+	link  func() string
+}
+
+func (r *resource) Discord(ctx *fiber.Ctx) error {
+	link := r.link()
+	if link == "" {
+		return r.reply.NotFound(ctx, ErrNoLink)
+	}
+
+	// temporary, the link may change on reload
+	return ctx.Redirect(link, http.StatusFound)
 }
 
 func (r *resource) Version(ctx *fiber.Ctx) error {
@@ -28,5 +49,7 @@ func (r *resource) Version(ctx *fiber.Ctx) error {
 }
 
 func (r *resource) HomePage(ctx *fiber.Ctx) error {
-	return r.reply.OK(ctx, "privet")
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+
+	return ctx.Status(http.StatusOK).Send(homePage)
 }
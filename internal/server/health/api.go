@@ -0,0 +1,45 @@
+package health
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/health"
+	"github.com/labi-le/server/pkg/response"
+)
+
+// RegisterHandlers serves the probes of the container orchestrator,
+// it must be registered before the storage handlers catching every path.
+func RegisterHandlers(r fiber.Router, checker *health.Checker, reply *response.Reply) {
+	res := &resource{
+		checker: checker,
+		reply:   reply,
+	}
+
+	r.Get("healthz", res.Liveness)
+	r.Get("readyz", res.Readiness)
+}
+
+type resource struct {
+	checker *health.Checker
+	reply   *response.Reply
+}
+
+// Liveness fails when the server is broken beyond what a restart fixes.
+func (r *resource) Liveness(ctx *fiber.Ctx) error {
+	return r.report(ctx, r.checker.Run(ctx.UserContext(), health.Liveness))
+}
+
+// Readiness fails while the server can't take uploads, such as when the disk is full.
+func (r *resource) Readiness(ctx *fiber.Ctx) error {
+	return r.report(ctx, r.checker.Run(ctx.UserContext(), health.Readiness))
+}
+
+func (r *resource) report(ctx *fiber.Ctx, report health.Report) error {
+	// probes are not cached on the way
+	ctx.Set(fiber.HeaderCacheControl, "no-store")
+
+	if !report.OK() {
+		return r.reply.ServiceUnavailable(ctx, report)
+	}
+
+	return r.reply.OK(ctx, report)
+}
@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/media"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// posterKey identifies the poster frame among the derived files of a video.
+const posterKey = "poster.jpeg"
+
+// analyzerQueueSize is the amount of uploads waiting for analysis before new ones are skipped.
+const analyzerQueueSize = 128
+
+// analyzeTimeout stops ffprobe and ffmpeg stuck on a malformed file, so the worker takes the next one.
+const analyzeTimeout = 5 * time.Minute
+
+// Analyzer extracts media metadata and poster frames of uploaded videos in the background,
+// so uploads return without waiting for ffmpeg.
+type Analyzer struct {
+	store  FileStore
+	prober media.Prober
+	log    log.Logger
+
+	jobs    chan string
+	workers sync.WaitGroup
+}
+
+func NewAnalyzer(store FileStore, prober media.Prober, l log.Logger) *Analyzer {
+	return &Analyzer{
+		store:  store,
+		prober: prober,
+		log:    l,
+		jobs:   make(chan string, analyzerQueueSize),
+	}
+}
+
+// Run starts the given number of workers, they stop when ctx is done.
+func (a *Analyzer) Run(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		a.workers.Add(1)
+		go func() {
+			defer a.workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case k := <-a.jobs:
+					if err := a.analyze(ctx, k); err != nil {
+						a.log.Warnf("media analysis of %s failed: %s", k, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Wait blocks until the workers stop, it returns right away for a nil analyzer.
+func (a *Analyzer) Wait() {
+	if a == nil {
+		return
+	}
+
+	a.workers.Wait()
+}
+
+// Enqueue schedules the analysis of f if it is a video or an audio file.
+func (a *Analyzer) Enqueue(f File) {
+	if a == nil || !(strings.HasPrefix(f.ContentType, "video/") || strings.HasPrefix(f.ContentType, "audio/")) {
+		return
+	}
+
+	select {
+	case a.jobs <- f.ShortID:
+	default:
+		a.log.Warnf("media analysis queue is full, %s skipped", f.ShortID)
+	}
+}
+
+func (a *Analyzer) analyze(ctx context.Context, k string) error {
+	ctx, cancel := context.WithTimeout(ctx, analyzeTimeout)
+	defer cancel()
+
+	var f File
+	if _, err := a.store.Get(k, &f); err != nil {
+		return err
+	}
+
+	// ffmpeg needs a seekable local file whatever the storage is
+	path, err := localCopy(f)
+	f.Close() //nolint:errcheck // read-only blob
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(path)
+
+	info, err := a.prober.Probe(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if info.VideoCodec != "" {
+		poster, derivedErr := a.store.Derived(f, posterKey, func(dst io.Writer, _ io.Reader) error {
+			return a.prober.Poster(ctx, path, media.PosterTime(info.Duration), dst)
+		})
+		if derivedErr != nil {
+			return derivedErr
+		}
+		poster.Close() //nolint:errcheck // read-only blob
+	}
+
+	// the metadata may have been changed meanwhile, an overwritten file has a job of its own
+	return a.store.SetMedia(k, f.CurrentVersion(), &info)
+}
+
+func localCopy(f File) (string, error) {
+	tmp, err := os.CreateTemp("", "media-*")
+	if err != nil {
+		return "", err
+	}
+
+	defer tmp.Close()
+
+	if _, copyErr := io.Copy(tmp, f); copyErr != nil {
+		os.Remove(tmp.Name())
+		return "", copyErr
+	}
+
+	return tmp.Name(), nil
+}
@@ -1,19 +1,44 @@
 package storage
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/keys"
 	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/ratelimit"
 	"github.com/labi-le/server/pkg/response"
+	"github.com/labi-le/server/pkg/thumbnail"
+	"github.com/labi-le/server/pkg/tracing"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/webdav"
+	"io"
+	"mime"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var (
-	ErrInvalidForm = errors.New("invalid form")
-	ErrEmptyFile   = errors.New("file is empty")
-	ErrInvalidKey  = errors.New("invalid key")
-	ErrInvalidURL  = errors.New("keyword is not available")
+	ErrInvalidForm   = errors.New("invalid form")
+	ErrEmptyFile     = errors.New("file is empty")
+	ErrInvalidKey    = errors.New("invalid key")
+	ErrInvalidURL    = errors.New("keyword is not available")
+	ErrPassword      = errors.New("password is required")
+	ErrTooManyTries  = errors.New("too many wrong passwords, try again later")
+	ErrQuotaExceeded = errors.New("upload quota exceeded")
+)
+
+// Wrong passwords are counted by the IP and the file, bcrypt makes every check expensive.
+const (
+	maxPasswordFailures   = 5
+	passwordFailureWindow = 15 * time.Minute
 )
 
 var invalidURLs = []string{
@@ -22,19 +47,94 @@ var invalidURLs = []string{
 	"version",
 	"index",
 	"discord",
+	"api",
+	"dav",
+	"metrics",
+	"healthz",
+	"readyz",
+	// directories of the storage that are not files
+	filesystem.PendingDir,
+	derivedDir,
+	quarantineDir,
 }
 
+// OwnerName is the key name of OWNER_KEY in the logs, the audit log and the owner of the files uploaded with it.
+const OwnerName = "owner"
+
+// fileView matches links to another representation of a file:
+//
+//	/latest-build@v3  a previous version
+//	/photo@original   the upload before metadata was stripped, visible to the owner only
+//	/video@info       metadata as JSON
+//	/video@poster     the poster frame of a video
+//	/video@preview    an HTML page with the file embedded, also served to browsers and link unfurlers
+//	/video@oembed     the oEmbed description of the preview
+var fileView = regexp.MustCompile(`^(.+)@(v\d+|original|info|poster|preview|oembed)$`)
+
 type RequestFile File
 
-func RegisterHandlers(r fiber.Router, s Service, ownerKey string, reply *response.Reply) {
-	res := &resource{
-		s:        s,
-		reply:    reply,
-		ownerKey: ownerKey,
-	}
+// Options configure the file handlers.
+type Options struct {
+	OwnerKey string
+	// Keys are the API keys added besides OwnerKey, nil leaves OwnerKey the only one
+	Keys *keys.Store
+	// StripMetadata returns the default for uploads that don't set ?strip_metadata
+	StripMetadata func() bool
+	// Quota returns the bytes the files of a key other than OwnerKey may take, zero for no limit
+	Quota func() int64
+	// Redirect reports whether downloads are sent to a temporary direct link when the storage can make one
+	Redirect func() bool
+	// Bucket is the name of the bucket served by the S3 API
+	Bucket string
+	// Rejected is called with the reason of every refused upload
+	Rejected func(reason string)
+	// Audit records the changes made by the callers, nil disables it
+	Audit *audit.Log
+}
+
+func RegisterHandlers(r fiber.Router, s Service, opts Options, reply *response.Reply) {
+	res := newResource(s, opts, reply)
+
+	r.Get("api/files", res.List)
+	r.Get("api/backup", res.Backup)
+	r.Get("api/fsck", res.Check)
+	r.Post("api/fsck", res.Check)
+	r.Get("api/uploader/sharex", res.ShareX)
+	r.Get("api/uploader/script", res.Script)
+	r.Get("api/uploader/flameshot", res.Flameshot)
+
+	r.All("dav", res.WebDAV)
+	r.All("dav/*", res.WebDAV)
 
 	r.Put("*", res.Upload)
 	r.Get("*", res.Get)
+	r.Patch("*", res.Update)
+	r.Delete("*", res.Delete)
+}
+
+// RegisterS3Handlers serves the S3 API for signed requests to any path,
+// it must be registered before the handlers it shares the paths with.
+func RegisterS3Handlers(r fiber.Router, s Service, opts Options, reply *response.Reply) {
+	r.Use(newResource(s, opts, reply).S3)
+}
+
+func newResource(s Service, opts Options, reply *response.Reply) *resource {
+	return &resource{
+		s:             s,
+		reply:         reply,
+		ownerKey:      opts.OwnerKey,
+		keys:          opts.Keys,
+		stripMetadata: opts.StripMetadata,
+		redirect:      opts.Redirect,
+		quota:         opts.Quota,
+		bucket:        opts.Bucket,
+		rejected:      opts.Rejected,
+		audit:         opts.Audit,
+		davDirs:       newDavDirs(),
+		davLocks:      webdav.NewMemLS(),
+
+		passwordFailures: ratelimit.New(passwordFailureWindow),
+	}
 }
 
 type resource struct {
@@ -43,36 +143,56 @@ type resource struct {
 	reply *response.Reply
 
 	ownerKey string
+	keys     *keys.Store
+	// stripMetadata and redirect are read on every request, they change on reload
+	stripMetadata func() bool
+	redirect      func() bool
+	quota         func() int64
+	bucket        string
+	rejected      func(reason string)
+	audit         *audit.Log
+
+	davDirs  *davDirs
+	davLocks webdav.LockSystem
+	// passwordFailures counts the wrong passwords of protected files
+	passwordFailures *ratelimit.Limiter
 }
 
 func (r *resource) Upload(ctx *fiber.Ctx) error {
+	spanCtx, span := tracing.Start(ctx.UserContext(), "resource.Upload")
+	defer span.End()
+	ctx.SetUserContext(spanCtx)
+
 	customURL := ctx.Params("*")
+	custom := customURL != ""
+	overwrite := ctx.QueryBool("overwrite") || ctx.Get(fiber.HeaderIfMatch) != ""
 	if customURL != "" {
 		if !checkKey(ctx, r.ownerKey) {
-			return r.reply.Unauthorized(ctx, ErrInvalidKey)
+			return r.reply.Unauthorized(ctx, r.reject(ErrInvalidKey))
 		}
 
 		if !checkAvailableURL(customURL) {
-			return r.reply.BadRequest(ctx, ErrInvalidURL)
+			return r.reply.BadRequest(ctx, r.reject(ErrInvalidURL))
 		}
 
 	} else {
 		customURL = Short(time.Now().Nanosecond())
+		overwrite = false
 	}
 
 	// multipart form
 	header, err := ctx.FormFile("file")
 	if err != nil {
-		return r.reply.BadRequest(ctx, ErrInvalidForm)
+		return r.reply.BadRequest(ctx, r.reject(ErrInvalidForm))
 	}
 
 	if header.Size == 0 {
-		return r.reply.BadRequest(ctx, ErrEmptyFile)
+		return r.reply.BadRequest(ctx, r.reject(ErrEmptyFile))
 	}
 
 	mpFile, opErr := header.Open()
 	if opErr != nil {
-		return r.reply.BadRequest(ctx, ErrInvalidFile)
+		return r.reply.BadRequest(ctx, r.reject(ErrInvalidFile))
 	}
 
 	defer mpFile.Close()
@@ -94,11 +214,53 @@ func (r *resource) Upload(ctx *fiber.Ctx) error {
 		Size:   header.Size,
 	}
 
-	add, sErr := r.s.Add(ctx.Context(), req)
+	if name, ok := r.keyName(ctx); ok {
+		req.Owner = name
+	}
+
+	if err = r.checkQuota(ctx.UserContext(), req.Owner, req.Size); errors.Is(err, ErrQuotaExceeded) {
+		return r.reply.Forbidden(ctx, r.reject(err))
+	} else if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	if expiresIn := ctx.FormValue("expires_in"); expiresIn != "" {
+		seconds, convErr := strconv.ParseInt(expiresIn, 10, 64)
+		if convErr != nil || seconds < 0 {
+			return r.reply.BadRequest(ctx, r.reject(ErrInvalidForm))
+		}
+		if seconds > 0 {
+			expires := time.Now().Add(time.Duration(seconds) * time.Second)
+			req.ExpiresAt = &expires
+		}
+	}
+
+	if req.Password, err = hashPassword(ctx.FormValue("password")); err != nil {
+		return r.reply.BadRequest(ctx, r.reject(err))
+	}
+
+	keepOriginal := ctx.QueryBool("keep_original")
+	if keepOriginal && !checkKey(ctx, r.ownerKey) {
+		return r.reply.Unauthorized(ctx, r.reject(ErrInvalidKey))
+	}
+
+	if ctx.QueryBool("strip_metadata", r.stripMetadata()) {
+		var cleanup func()
+		if req, cleanup, err = stripMetadata(req, keepOriginal); err != nil {
+			return r.reply.BadRequest(ctx, r.reject(err))
+		}
+		defer cleanup()
+	}
+
+	if overwrite {
+		return r.replace(ctx, req)
+	}
+
+	add, sErr := r.s.Add(ctx.UserContext(), req)
 	if errors.Is(sErr, ErrFileExists) {
 		return r.reply.Conflict(ctx, fiber.Map{
 			"short_id": add,
-			"error":    sErr.Error(),
+			"error":    r.reject(sErr).Error(),
 		})
 	}
 
@@ -106,37 +268,503 @@ func (r *resource) Upload(ctx *fiber.Ctx) error {
 		return r.reply.InternalServerError(ctx, sErr)
 	}
 
+	if custom {
+		r.record(ctx, audit.ActionUpload, add, map[string]any{"size": req.Size, "content_type": req.ContentType})
+	}
+
 	return r.reply.Created(ctx, fiber.Map{"short_id": add})
 }
 
+func (r *resource) replace(ctx *fiber.Ctx, req RequestFile) error {
+	expected, ok := parseETag(ctx.Get(fiber.HeaderIfMatch))
+	if !ok {
+		return r.reply.PreconditionFailed(ctx, r.reject(ErrVersionMismatch))
+	}
+
+	file, err := r.s.Replace(ctx.UserContext(), req, expected)
+	if errors.Is(err, ErrVersionMismatch) {
+		ctx.Set(fiber.HeaderETag, etag(file.CurrentVersion()))
+		return r.reply.PreconditionFailed(ctx, r.reject(err))
+	}
+
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	ctx.Set(fiber.HeaderETag, etag(file.Version))
+	r.record(ctx, audit.ActionReplace, file.ShortID, map[string]any{"version": file.Version, "size": req.Size})
+
+	return r.reply.Created(ctx, fiber.Map{
+		"short_id": file.ShortID,
+		"version":  file.Version,
+	})
+}
+
+// checkQuota refuses a file of size bytes that would take the files of owner past the quota,
+// OwnerKey and anonymous uploads are not limited.
+func (r *resource) checkQuota(ctx context.Context, owner string, size int64) error {
+	if r.quota == nil || owner == "" || owner == OwnerName {
+		return nil
+	}
+
+	quota := r.quota()
+	if quota <= 0 {
+		return nil
+	}
+
+	files, err := r.s.List(ctx, owner)
+	if err != nil {
+		return err
+	}
+
+	// a replaced file is kept as a revision, so an overwrite adds to the usage as well
+	used := size
+	for _, f := range files {
+		used += f.StoredSize()
+	}
+
+	if used > quota {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// reject counts a refused upload by the text of err, only sentinel errors are passed.
+func (r *resource) reject(err error) error {
+	if r.rejected != nil {
+		r.rejected(err.Error())
+	}
+
+	return err
+}
+
 func (r *resource) Get(ctx *fiber.Ctx) error {
+	spanCtx, span := tracing.Start(ctx.UserContext(), "resource.Get")
+	defer span.End()
+	ctx.SetUserContext(spanCtx)
+
 	short := ctx.Params("*")
 	if short == "" {
 		return r.reply.BadRequest(ctx, ErrInvalidForm)
 	}
 
-	file, err := r.s.Get(ctx.Context(), short)
+	k, view := short, ""
+	if m := fileView.FindStringSubmatch(short); m != nil {
+		k, view = m[1], m[2]
+	}
+
+	var (
+		file File
+		err  error
+	)
+	switch view {
+	case "":
+		opt, resize := thumbnailOptions(ctx)
+		if !resize {
+			file, err = r.s.Get(ctx.UserContext(), k)
+			if err == nil && wantsPreview(ctx) {
+				file.Close() //nolint:errcheck // only metadata is needed
+				view = "preview"
+			}
+			break
+		}
+
+		file, err = r.s.Thumbnail(ctx.UserContext(), k, opt)
+		if errors.Is(err, thumbnail.ErrInvalidOptions) || errors.Is(err, thumbnail.ErrUnsupportedFormat) ||
+			errors.Is(err, thumbnail.ErrTooLarge) {
+			return r.reply.BadRequest(ctx, err)
+		}
+	case "original":
+		if !checkKey(ctx, r.ownerKey) {
+			return r.reply.NotFound(ctx, ErrFileNotFound)
+		}
+		file, err = r.s.GetOriginal(ctx.UserContext(), k)
+	case "info", "preview", "oembed":
+		file, err = r.s.Get(ctx.UserContext(), k)
+		file.Close() //nolint:errcheck // only metadata is needed
+	case "poster":
+		file, err = r.s.Poster(ctx.UserContext(), k)
+	default:
+		version, _ := strconv.Atoi(view[1:])
+		file, err = r.s.GetRevision(ctx.UserContext(), k, version)
+	}
+
 	if err != nil {
 		return r.reply.NotFound(ctx, err)
 	}
 
+	isOwner := checkKey(ctx, r.ownerKey)
+
+	// private files pretend to be missing for everyone except the owner
+	if file.Private && !isOwner {
+		file.Close() //nolint:errcheck // read-only blob
+		return r.reply.NotFound(ctx, ErrFileNotFound)
+	}
+
+	if !isOwner && file.Password != "" {
+		failures := ctx.IP() + " " + k
+		if r.passwordFailures.Exceeded(failures, maxPasswordFailures) {
+			file.Close() //nolint:errcheck // read-only blob
+			return r.reply.TooManyRequests(ctx, ErrTooManyTries)
+		}
+
+		if !file.CheckPassword(password(ctx)) {
+			file.Close() //nolint:errcheck // read-only blob
+			if password(ctx) != "" {
+				r.passwordFailures.Add(failures)
+			}
+			if view == "preview" {
+				return renderLocked(ctx, file)
+			}
+			return r.reply.Unauthorized(ctx, ErrPassword)
+		}
+	}
+
+	switch view {
+	case "info":
+		return r.reply.OK(ctx, file.Public())
+	case "preview":
+		return renderPreview(ctx, file)
+	case "oembed":
+		return r.reply.OK(ctx, newOEmbed(ctx, file))
+	}
+
+	// the file is streamed by the server itself when the storage can't make a link
+	if r.redirect() {
+		if link, linkErr := r.s.Link(ctx.UserContext(), file); linkErr == nil {
+			file.Close() //nolint:errcheck // read-only blob
+			return ctx.Redirect(link, http.StatusFound)
+		}
+	}
+
+	return send(ctx, file)
+}
+
+// activeTypes are run by browsers as documents of the site, an upload of one could act on its behalf.
+var activeTypes = map[string]bool{
+	"text/html":             true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+	"text/xml":              true,
+	"application/xml":       true,
+}
+
+// isolate keeps uploaded content from running as a part of the site, such as reading the key
+// the upload page remembers. Browsers must not guess another type and active documents get a sandbox.
+func isolate(ctx *fiber.Ctx, contentType string) {
+	ctx.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || activeTypes[mediaType] {
+		ctx.Set(fiber.HeaderContentSecurityPolicy, "sandbox")
+	}
+}
+
+// send streams the content of file, a single byte range is served when the client asks for one.
+func send(ctx *fiber.Ctx, file File) error {
 	ctx.Set(fiber.HeaderContentType, file.ContentType)
+	isolate(ctx, file.ContentType)
+	ctx.Set(fiber.HeaderETag, etag(file.CurrentVersion()))
+
+	seeker, seekable := file.Reader.(io.Seeker)
+	if seekable {
+		ctx.Set(fiber.HeaderAcceptRanges, "bytes")
+	}
+
+	byteRange := ctx.Get(fiber.HeaderRange)
+	if byteRange == "" || !seekable {
+		return ctx.
+			Status(http.StatusOK).
+			SendStream(file, int(file.Size))
+	}
+
+	start, end, err := fasthttp.ParseByteRange([]byte(byteRange), int(file.Size))
+	if err != nil {
+		file.Close() //nolint:errcheck // read-only blob
+		ctx.Set(fiber.HeaderContentRange, "bytes */"+strconv.FormatInt(file.Size, 10))
+		return ctx.SendStatus(http.StatusRequestedRangeNotSatisfiable)
+	}
+
+	if _, err = seeker.Seek(int64(start), io.SeekStart); err != nil {
+		file.Close() //nolint:errcheck // read-only blob
+		return err
+	}
+
+	length := end - start + 1
+	ctx.Set(fiber.HeaderContentRange, "bytes "+strconv.Itoa(start)+"-"+strconv.Itoa(end)+"/"+strconv.FormatInt(file.Size, 10))
 
 	return ctx.
-		Status(http.StatusOK).
-		SendStream(file, int(file.Size))
+		Status(http.StatusPartialContent).
+		SendStream(rangeReader{Reader: io.LimitReader(file, int64(length)), Closer: file}, length)
+}
+
+// rangeReader reads a part of a blob and closes the whole blob.
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (r *resource) Update(ctx *fiber.Ctx) error {
+	if !checkKey(ctx, r.ownerKey) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	short := ctx.Params("*")
+	if short == "" {
+		return r.reply.BadRequest(ctx, ErrInvalidForm)
+	}
+
+	var req UpdateFile
+	if err := ctx.BodyParser(&req); err != nil {
+		return r.reply.BadRequest(ctx, ErrInvalidForm)
+	}
+
+	if req.ShortID != nil && (*req.ShortID == "" || !checkAvailableURL(*req.ShortID)) {
+		return r.reply.BadRequest(ctx, ErrInvalidURL)
+	}
+
+	file, err := r.s.Update(ctx.UserContext(), short, req)
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		return r.reply.NotFound(ctx, err)
+	case errors.Is(err, ErrFileExists):
+		return r.reply.Conflict(ctx, fiber.Map{
+			"short_id": *req.ShortID,
+			"error":    err.Error(),
+		})
+	case errors.Is(err, ErrInvalidArgument), errors.Is(err, ErrContentTypeAssertion):
+		return r.reply.BadRequest(ctx, err)
+	case err != nil:
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	action := audit.ActionUpdate
+	if file.ShortID != short {
+		action = audit.ActionRename
+	}
+	r.record(ctx, action, short, req.auditDetail())
+
+	return r.reply.OK(ctx, file.Public())
+}
+
+func (r *resource) Delete(ctx *fiber.Ctx) error {
+	if !checkKey(ctx, r.ownerKey) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	short := ctx.Params("*")
+	if short == "" {
+		return r.reply.BadRequest(ctx, ErrInvalidForm)
+	}
+
+	err := r.s.Delete(ctx.UserContext(), short)
+	if errors.Is(err, ErrFileNotFound) {
+		return r.reply.NotFound(ctx, err)
+	}
+
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	r.record(ctx, audit.ActionDelete, short, nil)
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// Backup streams an archive of the records changed since ?since together with their blobs.
+// The version to pass as since for the next incremental backup is sent in X-Backup-Version.
+func (r *resource) Backup(ctx *fiber.Ctx) error {
+	if !checkKey(ctx, r.ownerKey) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	since, err := strconv.ParseUint(ctx.Query("since", "0"), 10, 64)
+	if err != nil {
+		return r.reply.BadRequest(ctx, ErrInvalidForm)
+	}
+
+	backup, err := r.s.Backup(ctx.UserContext(), since)
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	r.record(ctx, audit.ActionBackup, "", map[string]any{"since": since, "version": backup.Manifest.Version})
+
+	ctx.Set("X-Backup-Version", strconv.FormatUint(backup.Manifest.Version, 10))
+	ctx.Set(fiber.HeaderContentType, "application/x-tar")
+	ctx.Attachment(fmt.Sprintf("backup-%d-%d.tar", since, backup.Manifest.Version))
+
+	ctx.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer backup.Close()
+
+		// the status is already sent, a failure leaves a truncated archive that restore rejects
+		_ = backup.WriteArchive(w)
+	})
+
+	return nil
+}
+
+// Check reports the records and the blobs that don't match,
+// a POST with ?repair=quarantine or ?repair=delete also repairs them.
+// Checksums are verified with ?checksums=true.
+func (r *resource) Check(ctx *fiber.Ctx) error {
+	if !checkKey(ctx, r.ownerKey) {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	opts := CheckOptions{Checksums: ctx.QueryBool("checksums")}
+	if ctx.Method() == fiber.MethodPost {
+		opts.Repair = Repair(ctx.Query("repair"))
+	}
+
+	if opts.Repair != RepairNone && opts.Repair != RepairQuarantine && opts.Repair != RepairDelete {
+		return r.reply.BadRequest(ctx, ErrInvalidForm)
+	}
+
+	report, err := r.s.Check(ctx.UserContext(), opts)
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	if opts.Repair != RepairNone {
+		r.record(ctx, audit.ActionRepair, "", map[string]any{"repair": opts.Repair})
+	}
+
+	return r.reply.OK(ctx, report)
+}
+
+// List returns the files uploaded with the key of the caller.
+func (r *resource) List(ctx *fiber.Ctx) error {
+	name, ok := r.keyName(ctx)
+	if !ok {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	files, err := r.s.List(ctx.UserContext(), name)
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	for i := range files {
+		files[i] = files[i].Public()
+	}
+
+	return r.reply.OK(ctx, files)
+}
+
+// record adds an action of the caller on target to the audit log.
+func (r *resource) record(ctx *fiber.Ctx, action, target string, detail map[string]any) {
+	r.audit.Record(ctx.UserContext(), audit.Request(ctx, action, target, detail))
+}
+
+// keyName returns the name of the key the request was made with.
+func (r *resource) keyName(ctx *fiber.Ctx) (string, bool) {
+	name, ok := r.nameOf(ctx.Get("authorization"))
+	if ok {
+		log.SetKeyName(ctx, name)
+	}
+
+	return name, ok
+}
+
+// nameOf returns the name of the given key.
+func (r *resource) nameOf(key string) (string, bool) {
+	if key != "" && key == r.ownerKey {
+		return OwnerName, true
+	}
+
+	if r.keys != nil {
+		return r.keys.Name(key)
+	}
+
+	return "", false
+}
+
+// keyOf returns the key with the given name.
+func (r *resource) keyOf(name string) (string, bool) {
+	if name == OwnerName && r.ownerKey != "" {
+		return r.ownerKey, true
+	}
+
+	if r.keys != nil && name != OwnerName {
+		return r.keys.Key(name)
+	}
+
+	return "", false
+}
+
+// password returns the password sent to unlock a protected file.
+func password(ctx *fiber.Ctx) string {
+	if p := ctx.Get("X-Password"); p != "" {
+		return p
+	}
+
+	return ctx.Query("password")
 }
 
 func checkKey(ctx *fiber.Ctx, key string) bool {
-	return ctx.Get("authorization") == key
+	if ctx.Get("authorization") != key {
+		return false
+	}
+
+	if key != "" {
+		log.SetKeyName(ctx, OwnerName)
+	}
+
+	return true
 }
 
 func checkAvailableURL(url string) bool {
+	// "@" is reserved for addressing revisions
+	if strings.Contains(url, "@") {
+		return false
+	}
+
+	// segments become the directories of the blob, they must not leave or skip one
+	for _, segment := range strings.Split(url, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+
 	for _, v := range invalidURLs {
-		if v == url {
+		if v == url || strings.HasPrefix(url, v+"/") {
 			return false
 		}
 	}
 
 	return true
 }
+
+// thumbnailOptions reads resize parameters such as ?w=320&h=240&fit=cover&format=jpeg.
+// It reports false when the original file was requested.
+func thumbnailOptions(ctx *fiber.Ctx) (thumbnail.Options, bool) {
+	opt := thumbnail.Options{
+		Width:  ctx.QueryInt("w"),
+		Height: ctx.QueryInt("h"),
+		Fit:    thumbnail.Fit(ctx.Query("fit")),
+		Format: ctx.Query("format"),
+	}
+
+	return opt, opt != thumbnail.Options{}
+}
+
+func etag(version int) string {
+	return `"v` + strconv.Itoa(version) + `"`
+}
+
+// parseETag returns the version referenced by an If-Match header, zero matches any version.
+func parseETag(header string) (int, bool) {
+	header = strings.TrimPrefix(header, "W/")
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(strings.Trim(header, `"`), "v"))
+	if err != nil || version <= 0 {
+		return 0, false
+	}
+
+	return version, true
+}
@@ -0,0 +1,250 @@
+package storage_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/keys"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/response"
+	"github.com/minio/minio-go/v7/pkg/signer"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const ownerKey = "owner-key"
+
+// newAPI serves the file handlers and the S3 API of a fresh store, keys may be added besides ownerKey.
+func newAPI(t *testing.T) (*fiber.App, *keys.Store) {
+	t.Helper()
+
+	s, _ := newStore(t)
+	keyStore, err := keys.Open(filepath.Join(t.TempDir(), "keys.json"), storage.OwnerName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := storage.NewService(s, nil)
+	opts := storage.Options{
+		OwnerKey:      ownerKey,
+		Keys:          keyStore,
+		StripMetadata: func() bool { return false },
+		Redirect:      func() bool { return false },
+		Bucket:        "files",
+	}
+	reply := response.New(log.NilLogger{})
+
+	app := fiber.New()
+	storage.RegisterS3Handlers(app, service, opts, reply)
+	storage.RegisterHandlers(app, service, opts, reply)
+
+	return app, keyStore
+}
+
+// uploadForm sends content as the file field of a form to path with the owner key.
+// Other fields of the form are given as name and value pairs.
+func uploadForm(t *testing.T, app *fiber.App, path string, content []byte, fields ...string) *http.Response {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if err := form.WriteField(fields[i], fields[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	part, err := form.CreateFormFile("file", "upload")
+	if err == nil {
+		_, err = part.Write(content)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(fiber.MethodPut, path, &body)
+	req.Header.Set(fiber.HeaderContentType, form.FormDataContentType())
+	req.Header.Set(fiber.HeaderAuthorization, ownerKey)
+
+	return do(t, app, req)
+}
+
+// uploadS3 sends content as the object key of the bucket signed with the owner key.
+func uploadS3(t *testing.T, app *fiber.App, key string, content []byte) *http.Response {
+	t.Helper()
+
+	return uploadS3As(t, app, storage.OwnerName, ownerKey, key, content)
+}
+
+// uploadS3As sends content as the object key of the bucket signed with the given key.
+func uploadS3As(t *testing.T, app *fiber.App, name, secret, key string, content []byte) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(fiber.MethodPut, "http://localhost/files/"+key, bytes.NewReader(content))
+	sum := sha256.Sum256(content)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+
+	return do(t, app, signer.SignV4(*req, name, secret, "", "us-east-1"))
+}
+
+// uploadDAV writes content to the file at path over WebDAV with the given key.
+func uploadDAV(t *testing.T, app *fiber.App, name, secret, path string, content []byte) *http.Response {
+	t.Helper()
+
+	req := httptest.NewRequest(fiber.MethodPut, "/dav/"+path, bytes.NewReader(content))
+	req.SetBasicAuth(name, secret)
+
+	return do(t, app, req)
+}
+
+func do(t *testing.T, app *fiber.App, req *http.Request) *http.Response {
+	t.Helper()
+
+	res, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = res.Body.Close() })
+
+	return res
+}
+
+func TestActiveContentIsSandboxed(t *testing.T) {
+	app, _ := newAPI(t)
+
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg"><script>alert(localStorage.key)</script></svg>`)
+	tests := []struct {
+		path    string
+		content []byte
+		sandbox bool
+	}{
+		{"/page", []byte("<!DOCTYPE html><html><script>alert(1)</script></html>"), true},
+		{"/drawing", svg, true},
+		{"/notes", []byte("just text"), false},
+	}
+
+	for _, tt := range tests {
+		if res := uploadForm(t, app, tt.path, tt.content); res.StatusCode != fiber.StatusCreated {
+			t.Fatalf("upload %s: status %d", tt.path, res.StatusCode)
+		}
+
+		res := do(t, app, httptest.NewRequest(fiber.MethodGet, tt.path, nil))
+		if res.StatusCode != fiber.StatusOK {
+			t.Fatalf("get %s: status %d", tt.path, res.StatusCode)
+		}
+
+		if got := res.Header.Get(fiber.HeaderXContentTypeOptions); got != "nosniff" {
+			t.Errorf("%s: %s = %q, want nosniff", tt.path, fiber.HeaderXContentTypeOptions, got)
+		}
+		if got := res.Header.Get(fiber.HeaderContentSecurityPolicy); (got == "sandbox") != tt.sandbox {
+			t.Errorf("%s served as %s: %s = %q, sandboxed %v", tt.path,
+				res.Header.Get(fiber.HeaderContentType), fiber.HeaderContentSecurityPolicy, got, tt.sandbox)
+		}
+	}
+}
+
+func TestUploadOutsideTheShortIDIsRejected(t *testing.T) {
+	app, _ := newAPI(t)
+
+	if res := uploadForm(t, app, "/a/victim", []byte("victim")); res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("upload a/victim: status %d", res.StatusCode)
+	}
+
+	for _, short := range []string{"a/../b", "a/./b", "a//b", "a/", "a/../a/victim"} {
+		if res := uploadForm(t, app, "/"+short, []byte("x")); res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("form upload of %q: status %d, want %d", short, res.StatusCode, fiber.StatusBadRequest)
+		}
+
+		if res := uploadS3(t, app, short, []byte("x")); res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("S3 upload of %q: status %d, want %d", short, res.StatusCode, fiber.StatusBadRequest)
+		}
+
+		req := httptest.NewRequest(fiber.MethodPatch, "/a/victim", strings.NewReader(`{"short_id":"`+short+`"}`))
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+		req.Header.Set(fiber.HeaderAuthorization, ownerKey)
+		if res := do(t, app, req); res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("rename to %q: status %d, want %d", short, res.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+
+	if res := do(t, app, httptest.NewRequest(fiber.MethodGet, "/b", nil)); res.StatusCode != fiber.StatusNotFound {
+		t.Errorf("get b: status %d, want %d", res.StatusCode, fiber.StatusNotFound)
+	}
+	if res := uploadS3(t, app, "a/b", []byte("b")); res.StatusCode != fiber.StatusOK {
+		t.Errorf("S3 upload of a/b: status %d, want %d", res.StatusCode, fiber.StatusOK)
+	}
+}
+
+func TestInternalDirectoriesAreReserved(t *testing.T) {
+	app, _ := newAPI(t)
+
+	for _, short := range []string{".pending", ".pending/x", ".derived/a@v1_64x64_cover.png", ".quarantine/a"} {
+		if res := uploadForm(t, app, "/"+short, []byte("x")); res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("form upload of %q: status %d, want %d", short, res.StatusCode, fiber.StatusBadRequest)
+		}
+		if res := uploadS3(t, app, short, []byte("x")); res.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("S3 upload of %q: status %d, want %d", short, res.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+}
+
+func TestOverwriteNeedsTheKeyOfTheOwner(t *testing.T) {
+	app, keyStore := newAPI(t)
+	alice, err := keyStore.Add("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res := uploadForm(t, app, "/ours", []byte("ours")); res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("upload ours: status %d", res.StatusCode)
+	}
+	if res := uploadForm(t, app, "/expiring", []byte("expiring"), "expires_in", "1"); res.StatusCode != fiber.StatusCreated {
+		t.Fatalf("upload expiring: status %d", res.StatusCode)
+	}
+	if res := uploadS3As(t, app, alice.Name, alice.Key, "hers", []byte("hers")); res.StatusCode != fiber.StatusOK {
+		t.Fatalf("upload hers: status %d", res.StatusCode)
+	}
+
+	if res := uploadS3As(t, app, alice.Name, alice.Key, "ours", []byte("x")); res.StatusCode != fiber.StatusForbidden {
+		t.Errorf("S3 overwrite of a file of another key: status %d, want %d", res.StatusCode, fiber.StatusForbidden)
+	}
+	if res := uploadDAV(t, app, alice.Name, alice.Key, "ours", []byte("x")); res.StatusCode < 400 {
+		t.Errorf("WebDAV overwrite of a file of another key: status %d", res.StatusCode)
+	}
+
+	// an expired file is not served, it still belongs to its key until it is removed
+	time.Sleep(1100 * time.Millisecond)
+	if res := uploadS3As(t, app, alice.Name, alice.Key, "expiring", []byte("x")); res.StatusCode != fiber.StatusForbidden {
+		t.Errorf("S3 overwrite of an expired file of another key: status %d, want %d", res.StatusCode, fiber.StatusForbidden)
+	}
+	if res := uploadDAV(t, app, alice.Name, alice.Key, "expiring", []byte("x")); res.StatusCode < 400 {
+		t.Errorf("WebDAV overwrite of an expired file of another key: status %d", res.StatusCode)
+	}
+
+	if res := uploadS3As(t, app, alice.Name, alice.Key, "hers", []byte("again")); res.StatusCode != fiber.StatusOK {
+		t.Errorf("S3 overwrite of an own file: status %d, want %d", res.StatusCode, fiber.StatusOK)
+	}
+	if res := uploadDAV(t, app, alice.Name, alice.Key, "hers", []byte("once more")); res.StatusCode >= 400 {
+		t.Errorf("WebDAV overwrite of an own file: status %d", res.StatusCode)
+	}
+
+	// the owner key may change every file
+	if res := uploadS3(t, app, "hers", []byte("owner")); res.StatusCode != fiber.StatusOK {
+		t.Errorf("S3 overwrite with the owner key: status %d, want %d", res.StatusCode, fiber.StatusOK)
+	}
+
+	res := do(t, app, httptest.NewRequest(fiber.MethodGet, "/ours", nil))
+	if body, _ := io.ReadAll(res.Body); string(body) != "ours" {
+		t.Errorf("ours holds %q after the refused overwrites", body)
+	}
+}
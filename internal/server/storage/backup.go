@@ -0,0 +1,380 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labi-le/server/pkg/filesystem"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBackupNotSupported = fmt.Errorf("metadata store does not support backups")
+	ErrInvalidBackup      = fmt.Errorf("invalid backup")
+)
+
+// backupFormat is the version of the archive layout, it changes when older archives can't be restored.
+const backupFormat = 1
+
+// A backup archive is a tar file with the manifest first, then the metadata and the blobs.
+const (
+	manifestEntry = "manifest.json"
+	metadataEntry = "metadata"
+	blobsDir      = "blobs/"
+)
+
+// Backuper is implemented by key-value stores able to dump their content while serving.
+type Backuper interface {
+	// Backup writes the entries changed since the given version to w,
+	// it returns the version to pass as since to make the next incremental backup.
+	Backup(w io.Writer, since uint64) (uint64, error)
+	// Load applies a backup written by Backup.
+	Load(r io.Reader) error
+	// ReadBackup calls fn for every key of a backup, the value is nil for removed keys.
+	ReadBackup(r io.Reader, fn func(k string, v []byte) error) error
+}
+
+// Manifest describes the content of a backup archive.
+type Manifest struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"created_at"`
+	// Since is zero for a full backup, an incremental one holds the changes made from this version on
+	Since uint64 `json:"since"`
+	// Version is the since of the next incremental backup
+	Version uint64 `json:"version"`
+	Records int    `json:"records"`
+	Removed int    `json:"removed"`
+	// Blobs maps the names of the archived blobs to their size
+	Blobs map[string]int64 `json:"blobs"`
+}
+
+// Full reports whether the backup holds every record rather than the changes since a previous backup.
+func (m Manifest) Full() bool {
+	return m.Since == 0
+}
+
+// Backup is a snapshot of the metadata waiting to be written out with its blobs.
+// The blobs are opened with the snapshot, so their content matches the records even if they
+// are replaced or removed before the archive is written. A handle is held per blob until Close.
+type Backup struct {
+	Manifest Manifest
+
+	metadata *os.File
+	blobs    map[string]filesystem.File
+}
+
+func (s *store) Backup(since uint64) (*Backup, error) {
+	b, ok := s.kvStore.(Backuper)
+	if !ok {
+		return nil, ErrBackupNotSupported
+	}
+
+	// the snapshot is kept aside to list the blobs it refers to before anything is sent
+	tmp, err := os.CreateTemp("", "backup-*")
+	if err != nil {
+		return nil, err
+	}
+
+	backup := &Backup{
+		Manifest: Manifest{
+			Format:    backupFormat,
+			CreatedAt: time.Now().UTC(),
+			Since:     since,
+			Blobs:     make(map[string]int64),
+		},
+		metadata: tmp,
+		blobs:    make(map[string]filesystem.File),
+	}
+
+	if backup.Manifest.Version, err = b.Backup(tmp, since); err != nil {
+		backup.Close()
+		return nil, err
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		backup.Close()
+		return nil, err
+	}
+
+	err = b.ReadBackup(tmp, func(_ string, v []byte) error {
+		if v == nil {
+			backup.Manifest.Removed++
+			return nil
+		}
+
+		var f File
+		if jsonErr := json.Unmarshal(v, &f); jsonErr != nil {
+			return jsonErr
+		}
+		backup.Manifest.Records++
+
+		for _, name := range contentBlobs(f) {
+			if _, ok := backup.blobs[name]; ok {
+				continue
+			}
+
+			// a blob may go away together with its record after the snapshot
+			blob, openErr := s.fs.Open(name)
+			if openErr != nil {
+				continue
+			}
+
+			info, statErr := blob.Stat()
+			if statErr != nil {
+				blob.Close() //nolint:errcheck // read-only blob
+				return statErr
+			}
+
+			backup.blobs[name] = blob
+			backup.Manifest.Blobs[name] = info.Size()
+		}
+
+		return nil
+	})
+	if err != nil {
+		backup.Close()
+		return nil, err
+	}
+
+	return backup, nil
+}
+
+// WriteArchive writes the manifest, the metadata and the blobs to w as a tar archive.
+func (b *Backup) WriteArchive(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	manifest, err := json.MarshalIndent(b.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = writeEntry(tw, manifestEntry, int64(len(manifest)), bytes.NewReader(manifest)); err != nil {
+		return err
+	}
+
+	info, err := b.metadata.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err = b.metadata.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err = writeEntry(tw, metadataEntry, info.Size(), b.metadata); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(b.Manifest.Blobs))
+	for name := range b.Manifest.Blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err = b.writeBlob(tw, name); err != nil {
+			return fmt.Errorf("blob %s: %w", name, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+func (b *Backup) writeBlob(tw *tar.Writer, name string) error {
+	blob := b.blobs[name]
+	if _, err := blob.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return writeEntry(tw, blobsDir+name, b.Manifest.Blobs[name], blob)
+}
+
+func writeEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(tw, r, size)
+
+	return err
+}
+
+// Close releases the blobs and removes the snapshot of the metadata.
+func (b *Backup) Close() error {
+	for _, blob := range b.blobs {
+		_ = blob.Close()
+	}
+
+	closeErr := b.metadata.Close()
+	if err := os.Remove(b.metadata.Name()); err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// Restore checks the whole archive, then loads its blobs and metadata.
+// A full backup is restored into an empty store only, incremental ones are applied in the order they were made.
+func (s *store) Restore(archive io.ReadSeeker) (Manifest, error) {
+	b, ok := s.kvStore.(Backuper)
+	if !ok {
+		return Manifest{}, ErrBackupNotSupported
+	}
+
+	m, err := verifyArchive(archive, b)
+	if err != nil {
+		return m, err
+	}
+
+	if m.Full() {
+		if files, listErr := s.List(); listErr != nil || len(files) > 0 {
+			return m, errors.New("a full backup is restored into an empty store only")
+		}
+	}
+
+	if _, err = archive.Seek(0, io.SeekStart); err != nil {
+		return m, err
+	}
+
+	// the records go last so they never point to blobs that are not there yet
+	tmp, err := os.CreateTemp("", "restore-*")
+	if err != nil {
+		return m, err
+	}
+
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	tr := tar.NewReader(archive)
+	for {
+		hdr, nextErr := tr.Next()
+		if errors.Is(nextErr, io.EOF) {
+			break
+		}
+		if nextErr != nil {
+			return m, nextErr
+		}
+
+		switch {
+		case hdr.Name == metadataEntry:
+			_, err = io.Copy(tmp, tr)
+		case strings.HasPrefix(hdr.Name, blobsDir):
+			err = s.write(strings.TrimPrefix(hdr.Name, blobsDir), tr, hdr.Size)
+		}
+
+		if err != nil {
+			return m, err
+		}
+	}
+
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return m, err
+	}
+
+	return m, b.Load(tmp)
+}
+
+// verifyArchive reads the archive through and returns its manifest if everything it lists is in place.
+func verifyArchive(archive io.Reader, b Backuper) (Manifest, error) {
+	var (
+		m        Manifest
+		metadata bool
+		blobs    = make(map[string]bool)
+		tr       = tar.NewReader(archive)
+	)
+
+	for i := 0; ; i++ {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return m, fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+		}
+
+		switch name := hdr.Name; {
+		case i == 0:
+			if name != manifestEntry {
+				return m, fmt.Errorf("%w: the manifest is missing", ErrInvalidBackup)
+			}
+			if err = json.NewDecoder(tr).Decode(&m); err != nil {
+				return m, fmt.Errorf("%w: manifest: %w", ErrInvalidBackup, err)
+			}
+			if m.Format != backupFormat {
+				return m, fmt.Errorf("%w: unknown format %d", ErrInvalidBackup, m.Format)
+			}
+		case name == metadataEntry:
+			metadata = true
+			if err = verifyMetadata(tr, b, m); err != nil {
+				return m, fmt.Errorf("%w: metadata: %w", ErrInvalidBackup, err)
+			}
+		case strings.HasPrefix(name, blobsDir):
+			blob := strings.TrimPrefix(name, blobsDir)
+			size, listed := m.Blobs[blob]
+			if !listed || blob != path.Clean(blob) || strings.HasPrefix(blob, "../") || path.IsAbs(blob) {
+				return m, fmt.Errorf("%w: unexpected blob %s", ErrInvalidBackup, blob)
+			}
+			// a truncated archive fails here
+			if n, copyErr := io.Copy(io.Discard, tr); copyErr != nil || n != size {
+				return m, fmt.Errorf("%w: blob %s is damaged", ErrInvalidBackup, blob)
+			}
+			blobs[blob] = true
+		default:
+			return m, fmt.Errorf("%w: unexpected entry %s", ErrInvalidBackup, name)
+		}
+	}
+
+	if !metadata {
+		return m, fmt.Errorf("%w: the metadata is missing", ErrInvalidBackup)
+	}
+
+	if len(blobs) != len(m.Blobs) {
+		return m, fmt.Errorf("%w: %d of %d blobs are missing", ErrInvalidBackup, len(m.Blobs)-len(blobs), len(m.Blobs))
+	}
+
+	return m, nil
+}
+
+// verifyMetadata checks that every record of the snapshot can be decoded and the counts match the manifest.
+func verifyMetadata(r io.Reader, b Backuper, m Manifest) error {
+	var records, removed int
+	err := b.ReadBackup(r, func(k string, v []byte) error {
+		if v == nil {
+			removed++
+			return nil
+		}
+
+		var f File
+		if err := json.Unmarshal(v, &f); err != nil {
+			return fmt.Errorf("record %s: %w", k, err)
+		}
+		if f.Name == "" {
+			return fmt.Errorf("record %s has no blob", k)
+		}
+		records++
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if records != m.Records || removed != m.Removed {
+		return fmt.Errorf("%d records and %d removals instead of %d and %d", records, removed, m.Records, m.Removed)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/badgerdb"
+	"github.com/labi-le/server/pkg/filesystem"
+	"io"
+	"testing"
+)
+
+func TestBackupKeepsTheBlobsOfTheSnapshot(t *testing.T) {
+	kv, err := badgerdb.NewStore(badgerdb.Options{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = kv.Close() })
+
+	s := storage.NewStore(kv, filesystem.NewMemFS("/files"))
+	if err = s.Set("a.txt", upload("a.txt", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := s.Backup(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+
+	// changes made while the archive waits to be written are not part of it
+	if _, err = s.Replace("a.txt", upload("a.txt", "second and longer"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err = backup.WriteArchive(&archive); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(&archive)
+	for {
+		header, nextErr := tr.Next()
+		if errors.Is(nextErr, io.EOF) {
+			t.Fatal("the archive holds no blob of a.txt")
+		}
+		if nextErr != nil {
+			t.Fatal(nextErr)
+		}
+
+		if header.Name != "blobs/a.txt" {
+			continue
+		}
+
+		content, readErr := io.ReadAll(tr)
+		if readErr != nil {
+			t.Fatal(readErr)
+		}
+		if string(content) != "first" {
+			t.Fatalf("archived a.txt = %q, want the content of the snapshot", content)
+		}
+		return
+	}
+}
@@ -0,0 +1,401 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labi-le/server/pkg/filesystem"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// quarantineDir keeps the blobs and records set aside by Check, nothing in it is served.
+const quarantineDir = ".quarantine"
+
+// checkGrace protects uploads in progress. Their blobs are staged before the record is stored
+// and renamed into place after it, so young records and blobs are not checked.
+const checkGrace = 10 * time.Minute
+
+// Repair is what Check does about the problems it finds.
+type Repair string
+
+const (
+	// RepairNone only reports the problems.
+	RepairNone Repair = ""
+	// RepairQuarantine moves broken blobs and records to the quarantine directory.
+	RepairQuarantine Repair = "quarantine"
+	// RepairDelete removes broken blobs and records.
+	RepairDelete Repair = "delete"
+)
+
+// ProblemKind tells what is wrong with a blob.
+type ProblemKind string
+
+const (
+	// ProblemOrphan is a blob no record refers to.
+	ProblemOrphan ProblemKind = "orphan"
+	// ProblemMissing is a blob a record refers to that is not in the storage.
+	ProblemMissing ProblemKind = "missing"
+	// ProblemSize is a blob whose size differs from the recorded one.
+	ProblemSize ProblemKind = "size"
+	// ProblemChecksum is a blob whose content differs from the recorded one.
+	ProblemChecksum ProblemKind = "checksum"
+)
+
+// CheckOptions configure Check.
+type CheckOptions struct {
+	Repair Repair
+	// Checksums reads every blob with a recorded checksum, it takes as long as reading the whole storage
+	Checksums bool
+}
+
+// Problem is an inconsistency between the records and the blobs.
+type Problem struct {
+	Kind ProblemKind `json:"kind"`
+	// Key is the record the blob belongs to, empty for orphans
+	Key    string `json:"key,omitempty"`
+	Blob   string `json:"blob"`
+	Detail string `json:"detail,omitempty"`
+	// Action is what the repair did, empty when nothing was done
+	Action string `json:"action,omitempty"`
+}
+
+// Report is the result of Check.
+type Report struct {
+	Records  int       `json:"records"`
+	Blobs    int       `json:"blobs"`
+	Problems []Problem `json:"problems"`
+}
+
+// expectedBlob is a blob referred to by a record.
+type expectedBlob struct {
+	name   string
+	size   int64
+	sha256 string
+	// current is set for the blob served under the key, without it the record is broken
+	current bool
+}
+
+// Check compares the records with the blobs in the storage and optionally repairs what doesn't match.
+//
+// A record is broken when its current blob is missing or damaged, it is set aside or removed as a whole.
+// A missing or damaged previous version or original upload is dropped from its record.
+// Derived blobs are a cache, they are reported only when their record is gone.
+func (s *store) Check(opts CheckOptions) (Report, error) {
+	report := Report{Problems: []Problem{}}
+
+	files, err := s.List()
+	if err != nil {
+		return report, err
+	}
+	report.Records = len(files)
+
+	blobs := make(map[string]os.FileInfo)
+	if err = s.walk(".", blobs); err != nil {
+		return report, err
+	}
+	report.Blobs = len(blobs)
+
+	referenced := make(map[string]bool)
+	shortIDs := make(map[string]bool, len(files))
+	for _, f := range files {
+		shortIDs[f.ShortID] = true
+		for _, blob := range expectedBlobs(f) {
+			referenced[blob.name] = true
+		}
+
+		problems, checkErr := s.checkRecord(f, blobs, opts)
+		if checkErr != nil {
+			return report, checkErr
+		}
+		report.Problems = append(report.Problems, problems...)
+	}
+
+	names := make([]string, 0, len(blobs))
+	for name := range blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if referenced[name] || time.Since(blobs[name].ModTime()) < checkGrace {
+			continue
+		}
+
+		if short, derived := derivedOf(name); derived && shortIDs[short] {
+			continue
+		}
+
+		problem := Problem{Kind: ProblemOrphan, Blob: name}
+		if problem.Action, err = s.repairBlob(name, opts.Repair); err != nil {
+			return report, err
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	return report, nil
+}
+
+// checkRecord reports the problems of the blobs of f and repairs them on request.
+// A repair locks the key and looks at the record and the blobs as they are by then.
+func (s *store) checkRecord(f File, blobs map[string]os.FileInfo, opts CheckOptions) ([]Problem, error) {
+	stat := func(name string) os.FileInfo {
+		return blobs[name]
+	}
+
+	if opts.Repair != RepairNone {
+		unlock := s.locks.lock(f.ShortID)
+		defer unlock()
+
+		var err error
+		if f, err = s.Lookup(f.ShortID); errors.Is(err, ErrFileNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		stat = func(name string) os.FileInfo {
+			info, statErr := s.fs.Stat(name)
+			if statErr != nil {
+				return nil
+			}
+			return info
+		}
+	}
+
+	if time.Since(f.UploadedAt) < checkGrace {
+		return nil, nil
+	}
+
+	var broken, dropped []Problem
+	for _, blob := range expectedBlobs(f) {
+		problem, ok := s.checkBlob(stat(blob.name), blob, opts.Checksums)
+		if ok {
+			continue
+		}
+
+		problem.Key = f.ShortID
+		if blob.current {
+			broken = append(broken, problem)
+		} else {
+			dropped = append(dropped, problem)
+		}
+	}
+
+	switch {
+	case len(broken) > 0:
+		action, err := s.repairRecord(f, opts.Repair)
+		if err != nil {
+			return nil, err
+		}
+		for i := range broken {
+			broken[i].Action = action
+		}
+		return broken, nil
+	case len(dropped) > 0:
+		return s.repairVersions(f, dropped, opts.Repair)
+	}
+
+	return nil, nil
+}
+
+// expectedBlobs returns the blobs f refers to with what is known about them.
+func expectedBlobs(f File) []expectedBlob {
+	blobs := []expectedBlob{{name: f.Name, size: f.Size, sha256: f.SHA256, current: true}}
+	if f.Original != "" {
+		// the size of the untouched upload is not recorded
+		blobs = append(blobs, expectedBlob{name: f.Original, size: -1})
+	}
+
+	for _, rev := range f.Revisions {
+		blobs = append(blobs, expectedBlob{name: rev.Name, size: rev.Size, sha256: rev.SHA256})
+	}
+
+	return blobs
+}
+
+// checkBlob compares a blob found in the storage with the expected one, info is nil for a missing blob.
+func (s *store) checkBlob(info os.FileInfo, blob expectedBlob, checksums bool) (Problem, bool) {
+	problem := Problem{Blob: blob.name}
+
+	switch {
+	case info == nil:
+		problem.Kind = ProblemMissing
+		return problem, false
+	case blob.size >= 0 && info.Size() != blob.size:
+		problem.Kind = ProblemSize
+		problem.Detail = fmt.Sprintf("%d bytes instead of %d", info.Size(), blob.size)
+		return problem, false
+	case !checksums || blob.sha256 == "":
+		return problem, true
+	}
+
+	sum, err := s.checksum(blob.name)
+	if err != nil {
+		problem.Kind = ProblemMissing
+		problem.Detail = err.Error()
+		return problem, false
+	}
+
+	if sum != blob.sha256 {
+		problem.Kind = ProblemChecksum
+		problem.Detail = fmt.Sprintf("sha256 %s instead of %s", sum, blob.sha256)
+		return problem, false
+	}
+
+	return problem, true
+}
+
+func (s *store) checksum(name string) (string, error) {
+	blob, err := s.fs.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer blob.Close()
+
+	sum := sha256.New()
+	if _, err = io.Copy(sum, blob); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// walk collects the files under dir except the quarantined ones and those being written.
+func (s *store) walk(dir string, blobs map[string]os.FileInfo) error {
+	d, err := s.fs.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	infos, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		name := path.Join(dir, info.Name())
+		switch {
+		case name == quarantineDir || name == filesystem.PendingDir:
+		case info.IsDir():
+			if err = s.walk(name, blobs); err != nil {
+				return err
+			}
+		default:
+			blobs[name] = info
+		}
+	}
+
+	return nil
+}
+
+// derivedOf returns the short ID a derived blob was made from.
+func derivedOf(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, derivedDir+"/")
+	if !ok {
+		return "", false
+	}
+
+	// derivatives are named <short>@v<N>_<key>
+	i := strings.LastIndex(rest, "@v")
+	if i < 0 {
+		return rest, true
+	}
+
+	return rest[:i], true
+}
+
+// repairRecord sets aside or removes a record with all of its blobs, the key must be locked.
+func (s *store) repairRecord(f File, repair Repair) (string, error) {
+	switch repair {
+	case RepairQuarantine:
+		record, err := json.Marshal(f)
+		if err != nil {
+			return "", err
+		}
+
+		// the record is kept next to its blobs to be put back by hand
+		if err = s.write(path.Join(quarantineDir, f.ShortID+".json"), bytes.NewReader(record), int64(len(record))); err != nil {
+			return "", err
+		}
+
+		for _, name := range s.blobs(f) {
+			if _, statErr := s.fs.Stat(name); statErr == nil {
+				if _, err = s.repairBlob(name, repair); err != nil {
+					return "", err
+				}
+			}
+		}
+
+		return "quarantined", s.kvStore.Delete(f.ShortID)
+	case RepairDelete:
+		return "deleted", s.remove(f)
+	default:
+		return "", nil
+	}
+}
+
+// repairVersions drops the previous versions and the original upload with a problem from the record of f,
+// the key must be locked.
+func (s *store) repairVersions(f File, problems []Problem, repair Repair) ([]Problem, error) {
+	if repair == RepairNone {
+		return problems, nil
+	}
+
+	bad := make(map[string]bool, len(problems))
+	for i, problem := range problems {
+		bad[problem.Blob] = true
+
+		if problem.Kind != ProblemMissing {
+			action, err := s.repairBlob(problem.Blob, repair)
+			if err != nil {
+				return problems, err
+			}
+			problems[i].Action = action
+		} else {
+			problems[i].Action = "dropped"
+		}
+	}
+
+	// the lock covers this process only, the record is changed in a single transaction
+	var cur File
+	_, err := s.modify(f.ShortID, &cur, func() error {
+		if bad[cur.Original] {
+			cur.Original = ""
+		}
+
+		cur.Revisions = slices.DeleteFunc(cur.Revisions, func(rev Revision) bool {
+			return bad[rev.Name]
+		})
+
+		return nil
+	})
+
+	return problems, err
+}
+
+// repairBlob sets aside or removes a single blob.
+func (s *store) repairBlob(name string, repair Repair) (string, error) {
+	switch repair {
+	case RepairQuarantine:
+		target := path.Join(quarantineDir, name)
+		if err := s.fs.MkdirAll(path.Dir(target), 0755); err != nil {
+			return "", err
+		}
+		return "quarantined", s.fs.Rename(name, target)
+	case RepairDelete:
+		return "deleted", s.fs.Remove(name)
+	default:
+		return "", nil
+	}
+}
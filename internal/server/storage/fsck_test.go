@@ -0,0 +1,90 @@
+package storage_test
+
+import (
+	"github.com/labi-le/server/internal/server/storage"
+	"testing"
+	"time"
+)
+
+// age moves the upload of the record of k back by d.
+func age(t *testing.T, kv storage.Store, k string, d time.Duration) {
+	t.Helper()
+
+	var f storage.File
+	if found, err := kv.Get(k, &f); err != nil || !found {
+		t.Fatalf("get %s: found %v, %v", k, found, err)
+	}
+
+	f.UploadedAt = f.UploadedAt.Add(-d)
+	if err := kv.Set(k, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckSkipsRecentRecords(t *testing.T) {
+	s, fs, kv := openStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// like an upload whose blob is not renamed into place yet
+	if err := fs.Remove("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Check(storage.CheckOptions{Repair: storage.RepairDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("problems of a recent record = %+v", report.Problems)
+	}
+	if _, err = s.Lookup("a.txt"); err != nil {
+		t.Fatalf("recent record was repaired: %v", err)
+	}
+
+	age(t, kv, "a.txt", time.Hour)
+
+	report, err = s.Check(storage.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != storage.ProblemMissing {
+		t.Fatalf("problems = %+v, want the missing blob", report.Problems)
+	}
+}
+
+func TestCheckDropsBrokenVersionsFromTheCurrentRecord(t *testing.T) {
+	s, fs, kv := openStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "first")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Replace("a.txt", upload("a.txt", "second"), 0); err != nil {
+		t.Fatal(err)
+	}
+	age(t, kv, "a.txt", time.Hour)
+
+	f, err := s.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Remove(f.Revisions[0].Name); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Check(storage.CheckOptions{Repair: storage.RepairDelete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Action != "dropped" {
+		t.Fatalf("problems = %+v, want the dropped revision", report.Problems)
+	}
+
+	repaired, err := s.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired.Revisions) != 0 || repaired.Version != 2 || repaired.SHA256 != f.SHA256 {
+		t.Fatalf("repaired record = %+v", repaired)
+	}
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// keyLocks serializes the changes of a record together with its blobs per key.
+// It covers the writers of this process only, records are still changed with modify and insert.
+type keyLocks struct {
+	mu   sync.Mutex
+	held map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	// refs counts the holders and the waiters, the lock is dropped from the map at zero
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{held: make(map[string]*keyLock)}
+}
+
+// lock locks the given keys and returns the function unlocking them.
+// Keys are locked in order so callers locking the same keys can't deadlock.
+func (l *keyLocks) lock(keys ...string) (unlock func()) {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+
+	locked := make([]string, 0, len(sorted))
+	for i, k := range sorted {
+		if i > 0 && k == sorted[i-1] {
+			continue
+		}
+
+		l.mu.Lock()
+		kl, ok := l.held[k]
+		if !ok {
+			kl = &keyLock{}
+			l.held[k] = kl
+		}
+		kl.refs++
+		l.mu.Unlock()
+
+		kl.Lock()
+		locked = append(locked, k)
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for _, k := range locked {
+			kl := l.held[k]
+			kl.Unlock()
+			if kl.refs--; kl.refs == 0 {
+				delete(l.held, k)
+			}
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/thumbnail"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// largeImage is the size above which embeds show a thumbnail instead of the image itself.
+const largeImage = 1 << 20
+
+// embedWidth is the width of thumbnails used by embeds.
+const embedWidth = 1200
+
+// crawlers are user agents of link unfurlers that get the preview page instead of the file.
+var crawlers = []string{
+	"discordbot",
+	"twitterbot",
+	"facebookexternalhit",
+	"slackbot",
+	"telegrambot",
+	"whatsapp",
+	"linkedinbot",
+	"mastodon",
+	"redditbot",
+	"embedly",
+	"vkshare",
+	"skypeuripreview",
+}
+
+type preview struct {
+	File
+	Site string
+	// URL is the absolute link to the file without a view
+	URL string
+	// Raw is the absolute link that always returns the file content
+	Raw string
+	// Image is the absolute link to a picture representing the file, empty if there is none
+	Image string
+}
+
+func newPreview(ctx *fiber.Ctx, f File) preview {
+	p := preview{
+		File: f,
+		Site: ctx.Hostname(),
+		URL:  ctx.BaseURL() + "/" + f.ShortID,
+	}
+
+	// links of a protected file carry the password the page was unlocked with
+	var unlock string
+	if f.Password != "" {
+		unlock = "&password=" + url.QueryEscape(password(ctx))
+	}
+
+	p.Raw = p.URL + "?raw=1" + unlock
+
+	switch {
+	case strings.HasPrefix(f.ContentType, "video/") && f.Media != nil && f.Media.VideoCodec != "":
+		p.Image = p.URL + "@poster?raw=1" + unlock
+	case strings.HasPrefix(f.ContentType, "image/") && f.Size > largeImage && thumbnail.Supported(f.ContentType):
+		p.Image = p.URL + "?w=" + strconv.Itoa(embedWidth) + unlock
+	case strings.HasPrefix(f.ContentType, "image/"):
+		p.Image = p.Raw
+	}
+
+	return p
+}
+
+func (p preview) Kind() string {
+	kind, _, _ := strings.Cut(p.ContentType, "/")
+	return kind
+}
+
+var previewPage = template.Must(template.New("preview").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.ShortID}}</title>
+<meta property="og:site_name" content="{{.Site}}">
+<meta property="og:title" content="{{.ShortID}}">
+<meta property="og:url" content="{{.URL}}">
+{{- with .Image}}
+<meta property="og:image" content="{{.}}">
+<meta name="twitter:image" content="{{.}}">
+{{- end}}
+{{- if eq .Kind "video"}}
+<meta property="og:type" content="video.other">
+<meta property="og:video" content="{{.Raw}}">
+<meta property="og:video:secure_url" content="{{.Raw}}">
+<meta property="og:video:type" content="{{.ContentType}}">
+{{- with .Media}}{{if .Width}}
+<meta property="og:video:width" content="{{.Width}}">
+<meta property="og:video:height" content="{{.Height}}">
+{{- end}}{{end}}
+<meta name="twitter:card" content="player">
+<meta name="twitter:player" content="{{.URL}}@preview">
+<meta name="twitter:player:stream" content="{{.Raw}}">
+<meta name="twitter:player:stream:content_type" content="{{.ContentType}}">
+{{- else if eq .Kind "image"}}
+<meta property="og:type" content="website">
+<meta property="og:image:type" content="{{.ContentType}}">
+<meta name="twitter:card" content="summary_large_image">
+{{- else}}
+<meta property="og:type" content="website">
+<meta name="twitter:card" content="summary">
+{{- end}}
+<link rel="alternate" type="application/json+oembed" href="{{.URL}}@oembed" title="{{.ShortID}}">
+<style>
+body{margin:0;background:#111;color:#ddd;font:14px sans-serif;display:flex;flex-direction:column;align-items:center}
+video,img,audio{max-width:100vw;max-height:85vh;margin-top:1em}
+dl{display:grid;grid-template-columns:auto auto;gap:.2em 1em}
+a{color:#8cf}
+</style>
+</head>
+<body>
+{{- if eq .Kind "video"}}
+<video controls playsinline preload="metadata"{{with .Image}} poster="{{.}}"{{end}} src="{{.Raw}}"></video>
+{{- else if eq .Kind "image"}}
+<img src="{{.Raw}}" alt="{{.ShortID}}">
+{{- else if eq .Kind "audio"}}
+<audio controls preload="metadata" src="{{.Raw}}"></audio>
+{{- end}}
+<dl>
+<dt>type</dt><dd>{{.ContentType}}</dd>
+<dt>size</dt><dd>{{.Size}} bytes</dd>
+{{- with .Media}}
+<dt>duration</dt><dd>{{printf "%.1f" .Duration}} s</dd>
+{{- if .Width}}<dt>resolution</dt><dd>{{.Width}}×{{.Height}}</dd>{{end}}
+{{- if .VideoCodec}}<dt>video</dt><dd>{{.VideoCodec}}</dd>{{end}}
+{{- if .AudioCodec}}<dt>audio</dt><dd>{{.AudioCodec}}</dd>{{end}}
+{{- end}}
+</dl>
+<a href="{{.Raw}}" download>download</a>
+</body>
+</html>
+`))
+
+func renderPreview(ctx *fiber.Ctx, f File) error {
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+
+	return previewPage.Execute(ctx.Status(http.StatusOK), newPreview(ctx, f))
+}
+
+var lockedPage = template.Must(template.New("locked").Parse(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.}}</title>
+<style>
+body{margin:0;background:#111;color:#ddd;font:14px sans-serif;display:flex;justify-content:center;align-items:center;height:100vh}
+input,button{font:inherit;padding:.4em;margin:.2em}
+</style>
+</head>
+<body>
+<form method="get">
+<p>{{.}} is protected with a password</p>
+<input type="password" name="password" autofocus required>
+<button>open</button>
+</form>
+</body>
+</html>
+`))
+
+// renderLocked asks for the password of a protected file.
+func renderLocked(ctx *fiber.Ctx, f File) error {
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+
+	return lockedPage.Execute(ctx.Status(http.StatusUnauthorized), f.ShortID)
+}
+
+// oEmbed is the response of https://oembed.com
+type oEmbed struct {
+	Version      string `json:"version"`
+	Type         string `json:"type"`
+	Title        string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ProviderURL  string `json:"provider_url"`
+	URL          string `json:"url,omitempty"`
+	HTML         string `json:"html,omitempty"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+}
+
+func newOEmbed(ctx *fiber.Ctx, f File) oEmbed {
+	p := newPreview(ctx, f)
+	e := oEmbed{
+		Version:      "1.0",
+		Type:         "link",
+		Title:        f.ShortID,
+		ProviderName: p.Site,
+		ProviderURL:  ctx.BaseURL(),
+		ThumbnailURL: p.Image,
+	}
+
+	if f.Media != nil {
+		e.Width, e.Height = f.Media.Width, f.Media.Height
+	}
+
+	switch p.Kind() {
+	case "image":
+		e.Type = "photo"
+		e.URL = p.Raw
+	case "video":
+		if e.Width == 0 {
+			e.Width, e.Height = 640, 360
+		}
+		e.Type = "video"
+		e.HTML = `<iframe src="` + template.HTMLEscapeString(p.URL+"@preview") + `" width="` + strconv.Itoa(e.Width) +
+			`" height="` + strconv.Itoa(e.Height) + `" frameborder="0" allowfullscreen></iframe>`
+	}
+
+	return e
+}
+
+// wantsPreview reports whether the request came from a link unfurler or a browser
+// navigating to the link, both get an HTML page instead of the file itself.
+func wantsPreview(ctx *fiber.Ctx) bool {
+	if ctx.QueryBool("raw") {
+		return false
+	}
+
+	agent := strings.ToLower(ctx.Get(fiber.HeaderUserAgent))
+	for _, c := range crawlers {
+		if strings.Contains(agent, c) {
+			return true
+		}
+	}
+
+	return strings.Contains(ctx.Get(fiber.HeaderAccept), fiber.MIMETextHTML)
+}
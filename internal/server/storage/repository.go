@@ -1,23 +1,147 @@
 package storage
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/media"
+	"github.com/labi-le/server/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
 	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrInvalidArgument = fmt.Errorf("invalid argument")
 	ErrFileExists      = fmt.Errorf("file already exists")
 	ErrFileNotFound    = fmt.Errorf("file not found")
+	ErrVersionMismatch = fmt.Errorf("version does not match")
+	ErrIncomplete      = fmt.Errorf("content is shorter or longer than announced")
 )
 
+// derivedDir keeps generated files such as thumbnails, they can be removed at any time.
+const derivedDir = ".derived"
+
 type File struct {
 	Name        string `json:"name"`
 	ShortID     string `json:"short_id"`
 	ContentType string `json:"content_type"`
 	Size        int64  `json:"size"`
-	io.Reader   `json:"-"`
+	// SHA256 is the checksum of the current content, empty for records written before checksums were kept
+	SHA256  string `json:"sha256,omitempty"`
+	Private bool   `json:"private"`
+	// ExpiresAt is nil for files that never expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// UploadedAt is the time the current content was stored
+	UploadedAt time.Time `json:"uploaded_at"`
+	// Version of the current content, starts at 1 and grows on every overwrite
+	Version   int        `json:"version"`
+	Revisions []Revision `json:"revisions,omitempty"`
+	// Original is the blob with the untouched upload, kept only on request when the content was processed
+	Original string `json:"original,omitempty"`
+	// Media is filled in the background for audio and video files
+	Media *media.Info `json:"media,omitempty"`
+	// Owner is the name of the key used to upload the file, empty for anonymous uploads
+	Owner string `json:"owner,omitempty"`
+	// Password is a bcrypt hash, files with a password are served only to those who know it
+	Password  string `json:"password,omitempty"`
+	io.Reader `json:"-"`
+
+	// original provides the content of Original while uploading
+	original io.Reader
+}
+
+// Revision is a previous content of a file kept after it was overwritten.
+type Revision struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`
+	ReplacedAt  time.Time `json:"replaced_at"`
+}
+
+// CurrentVersion returns the version of the current content.
+// Records written before versioning was introduced count as the first version.
+func (f File) CurrentVersion() int {
+	if f.Version == 0 {
+		return 1
+	}
+
+	return f.Version
+}
+
+// Revision returns the previous content with the given version.
+func (f File) Revision(version int) (Revision, bool) {
+	for _, rev := range f.Revisions {
+		if rev.Version == version {
+			return rev, true
+		}
+	}
+
+	return Revision{}, false
+}
+
+// StoredSize returns the size of the current content and the previous ones,
+// the untouched upload and the derivatives are not counted as their size is not recorded.
+func (f File) StoredSize() int64 {
+	size := f.Size
+	for _, rev := range f.Revisions {
+		size += rev.Size
+	}
+
+	return size
+}
+
+// Expired reports whether the file is past its expiry date at the given moment.
+func (f File) Expired(now time.Time) bool {
+	return f.ExpiresAt != nil && !now.Before(*f.ExpiresAt)
+}
+
+// CheckPassword reports whether the password unlocks the file, files without a password are always unlocked.
+func (f File) CheckPassword(password string) bool {
+	if f.Password == "" {
+		return true
+	}
+
+	// no need to hash what can't match
+	if password == "" {
+		return false
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(f.Password), []byte(password)) == nil
+}
+
+// Public returns the metadata that can be shown to clients.
+func (f File) Public() File {
+	f.Password = ""
+	f.Reader = nil
+	f.original = nil
+
+	return f
+}
+
+// Close closes the underlying blob if it was opened by the store.
+func (f File) Close() error {
+	if c, ok := f.Reader.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
 }
 
 // Store is an abstraction for different key-value store implementations.
@@ -59,48 +183,374 @@ type Store interface {
 	Close() error
 }
 
+// FileStore is a Store that also allows changing the metadata of already uploaded files.
+type FileStore interface {
+	Store
+	// Lookup returns the metadata stored for the given key without opening the blob.
+	Lookup(k string) (File, error)
+	// List returns the metadata of all stored files ordered by key.
+	List() ([]File, error)
+	// Update calls change with the record of k and stores the result under its short ID.
+	// If change sets another short ID the blobs are renamed and the record stored under k is removed.
+	// change may be called more than once and must only set fields.
+	Update(k string, change func(f *File) error) (File, error)
+	// SetMedia stores the media info of the given version of k leaving the other fields as they are.
+	// Nothing changes if k was overwritten since.
+	SetMedia(k string, version int, info *media.Info) error
+	// Replace overwrites the content stored for k keeping the previous one as a revision.
+	// If expected is not zero it must match the current version.
+	Replace(k string, rf RequestFile, expected int) (File, error)
+	// Revision returns the given previous version of k with its blob opened.
+	Revision(k string, version int) (File, error)
+	// Original returns the untouched upload of k with its blob opened.
+	Original(k string) (File, error)
+	// Derived returns a cached derivative of the current content of f identified by key.
+	// On a cache miss render is called to produce it from the original blob,
+	// without render a missing derivative is reported as ErrFileNotFound.
+	Derived(f File, key string, render func(dst io.Writer, src io.Reader) error) (File, error)
+	// Link returns a temporary direct link to the blob of f.
+	// It fails with filesystem.ErrNotSupported if the filesystem can't hand out links.
+	Link(f File) (string, error)
+	// Backup takes a snapshot of the records changed since the given version, zero means all of them.
+	// It fails with ErrBackupNotSupported if the key-value store is not a Backuper.
+	Backup(since uint64) (*Backup, error)
+	// Restore loads an archive written by Backup.WriteArchive.
+	Restore(archive io.ReadSeeker) (Manifest, error)
+	// Check reports the records and the blobs that don't match and repairs them on request.
+	Check(opts CheckOptions) (Report, error)
+	// RemoveStaged removes the blobs staged before the given time by uploads that were interrupted
+	// and returns their names.
+	RemoveStaged(before time.Time) ([]string, error)
+	// WithContext returns the store recording its work as spans under the one in ctx.
+	WithContext(ctx context.Context) FileStore
+}
+
+// Lister is implemented by key-value stores able to enumerate their keys.
+type Lister interface {
+	Keys(prefix string) ([]string, error)
+}
+
+// Mover is implemented by key-value stores able to replace a key with another one in a single transaction.
+type Mover interface {
+	Move(oldK, newK string, v interface{}) error
+}
+
+// Modifier is implemented by key-value stores able to change a value in a single transaction.
+type Modifier interface {
+	// Modify loads the value of k into v, calls fn and stores v unless fn fails.
+	// If no value is found it returns (false, nil) without calling fn.
+	Modify(k string, v interface{}, fn func() error) (bool, error)
+}
+
+// Inserter is implemented by key-value stores able to store a value only for a free key in a single transaction.
+type Inserter interface {
+	// Insert stores v for k and returns false without storing it when k already has a value.
+	Insert(k string, v interface{}) (bool, error)
+}
+
+// ContextStore is implemented by key-value stores that trace their transactions under the span in ctx.
+type ContextStore interface {
+	SetContext(ctx context.Context, k string, v interface{}) error
+	GetContext(ctx context.Context, k string, v interface{}) (bool, error)
+	DeleteContext(ctx context.Context, k string) error
+}
+
 type store struct {
 	kvStore Store
 	fs      filesystem.Storage
+	// ctx holds the span the work of the store is traced under
+	ctx context.Context
+	// renders collapses concurrent requests for the same derivative
+	renders *singleflight.Group
+	// mu serializes the changes of records in key-value stores that are not Modifiers
+	mu *sync.Mutex
+	// locks keeps the record and the blobs of a key consistent while both change
+	locks *keyLocks
 }
 
-func NewStore(kvStore Store, fs filesystem.Storage) Store {
-	return &store{kvStore: kvStore, fs: fs}
+func NewStore(kvStore Store, fs filesystem.Storage) FileStore {
+	return &store{
+		kvStore: kvStore,
+		fs:      fs,
+		ctx:     context.Background(),
+		renders: &singleflight.Group{},
+		mu:      &sync.Mutex{},
+		locks:   newKeyLocks(),
+	}
+}
+
+func (s *store) WithContext(ctx context.Context) FileStore {
+	return s.with(ctx)
+}
+
+func (s *store) with(ctx context.Context) *store {
+	bound := *s
+	bound.ctx = ctx
+
+	return &bound
+}
+
+func (s *store) kvSet(k string, v interface{}) error {
+	if c, ok := s.kvStore.(ContextStore); ok {
+		return c.SetContext(s.ctx, k, v)
+	}
+
+	return s.kvStore.Set(k, v)
+}
+
+func (s *store) kvGet(k string, v interface{}) (bool, error) {
+	if c, ok := s.kvStore.(ContextStore); ok {
+		return c.GetContext(s.ctx, k, v)
+	}
+
+	return s.kvStore.Get(k, v)
 }
 
-func (s *store) Set(k string, v interface{}) error {
+func (s *store) kvDelete(k string) error {
+	if c, ok := s.kvStore.(ContextStore); ok {
+		return c.DeleteContext(s.ctx, k)
+	}
+
+	return s.kvStore.Delete(k)
+}
+
+// modify loads the record of k into f, calls fn and stores f unless fn fails.
+func (s *store) modify(k string, f *File, fn func() error) (bool, error) {
+	if m, ok := s.kvStore.(Modifier); ok {
+		return m.Modify(k, f, fn)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, err := s.kvGet(k, f)
+	if err != nil || !found {
+		return found, err
+	}
+
+	if err = fn(); err != nil {
+		return true, err
+	}
+
+	return true, s.kvSet(k, *f)
+}
+
+// insert stores f for k unless k already has a record.
+func (s *store) insert(k string, f File) (bool, error) {
+	if i, ok := s.kvStore.(Inserter); ok {
+		return i.Insert(k, f)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found, err := s.kvGet(k, &File{})
+	if err != nil || found {
+		return false, err
+	}
+
+	return true, s.kvSet(k, f)
+}
+
+func (s *store) Set(k string, v interface{}) (err error) {
 	casted, ok := v.(RequestFile)
 	if !ok {
 		return ErrInvalidArgument
 	}
 
-	// check exist in kv store
-	found, _ := s.kvStore.Get(k, &File{})
-	if found {
+	ctx, span := tracing.Start(s.ctx, "store.Set", attribute.String("key", k), attribute.Int64("size", casted.Size))
+	defer func() { tracing.End(span, err) }()
+	s = s.with(ctx)
+
+	// spares the upload for a key that is already taken, the insert below decides
+	if found, _ := s.kvGet(k, &File{}); found {
 		return ErrFileExists
 	}
 
-	file, err := s.fs.Create(casted.Name)
+	// concurrent uploads for k write their own blobs, only the one whose record is inserted keeps them
+	staged := make(map[string]string, 2)
+	unstage := func() {
+		for tmp := range staged {
+			_ = s.fs.Remove(tmp)
+		}
+	}
+
+	sum := sha256.New()
+	tmp, err := stagedName(casted.Name)
 	if err != nil {
 		return err
 	}
+	if err := s.write(tmp, io.TeeReader(casted, sum), casted.Size); err != nil {
+		return err
+	}
+	staged[tmp] = casted.Name
+
+	if casted.original != nil {
+		if tmp, err = stagedName(casted.Original); err != nil {
+			unstage()
+			return err
+		}
+		if err := s.write(tmp, casted.original, -1); err != nil {
+			unstage()
+			return err
+		}
+		staged[tmp] = casted.Original
+	}
+
+	casted.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	casted.Version = 1
+	casted.UploadedAt = time.Now()
 
-	defer file.Close()
+	unlock := s.locks.lock(k)
+	defer unlock()
 
-	if _, copyErr := io.Copy(file, casted); copyErr != nil {
-		return copyErr
+	inserted, err := s.insert(k, File(casted))
+	if err == nil && !inserted {
+		err = ErrFileExists
 	}
+	if err != nil {
+		unstage()
+		return err
+	}
+
+	for tmp, name := range staged {
+		if err := s.fs.Rename(tmp, name); err != nil {
+			// the record must not outlive its blobs
+			_ = s.kvDelete(k)
+			for _, name := range contentBlobs(File(casted)) {
+				_ = s.fs.Remove(name)
+			}
+			unstage()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stagedName returns a unique name next to name for a blob that is not published yet.
+// Blobs left behind by a crash are orphans for Check.
+func stagedName(name string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return name + "." + hex.EncodeToString(suffix) + ".upload", nil
+}
 
-	return s.kvStore.Set(k, casted)
+// stagedBlob matches the names returned by stagedName.
+var stagedBlob = regexp.MustCompile(`\.[0-9a-f]{16}\.upload$`)
+
+func (s *store) RemoveStaged(before time.Time) ([]string, error) {
+	blobs := make(map[string]os.FileInfo)
+	if err := s.walk(".", blobs); err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for name, info := range blobs {
+		if !stagedBlob.MatchString(name) || !info.ModTime().Before(before) {
+			continue
+		}
+
+		if err := s.fs.Remove(name); err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+
+	sort.Strings(removed)
+
+	return removed, nil
 }
 
-func (s *store) Get(k string, v interface{}) (bool, error) {
+// write stores the content of r under name, on failure nothing is left under name if the storage allows.
+// A non-negative size must match the length of the content.
+func (s *store) write(name string, r io.Reader, size int64) (err error) {
+	_, span := tracing.Start(s.ctx, "filesystem.Write", attribute.String("blob", name), attribute.Int64("size", size))
+	defer func() { tracing.End(span, err) }()
+
+	// short IDs may contain slashes
+	if err := s.fs.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	file, err := s.create(name)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(file, r)
+	if err == nil && size >= 0 && n != size {
+		err = ErrIncomplete
+	}
+
+	if err != nil {
+		_ = file.Abort()
+		return err
+	}
+
+	// some storages report a failed write only on close
+	return file.Close()
+}
+
+// create opens a file that shows up under name when it is closed,
+// on storages unable to do so a partial file is removed on abort.
+func (s *store) create(name string) (filesystem.PendingFile, error) {
+	if a, ok := s.fs.(filesystem.AtomicCreator); ok {
+		return a.CreateAtomic(name)
+	}
+
+	file, err := s.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return removeOnAbort{File: file, fs: s.fs}, nil
+}
+
+// open opens a blob for reading, the span covers opening only as the blob is read after the request is handled.
+func (s *store) open(name string) (filesystem.File, error) {
+	_, span := tracing.Start(s.ctx, "filesystem.Open", attribute.String("blob", name))
+	file, err := s.fs.Open(name)
+	tracing.End(span, err)
+
+	return file, err
+}
+
+// ignoreNotFound keeps lookups of missing files from marking their spans as failed.
+func ignoreNotFound(err error) error {
+	if errors.Is(err, ErrFileNotFound) {
+		return nil
+	}
+
+	return err
+}
+
+// removeOnAbort is a file created in place.
+type removeOnAbort struct {
+	filesystem.File
+	fs filesystem.Storage
+}
+
+func (f removeOnAbort) Abort() error {
+	_ = f.File.Close()
+
+	return f.fs.Remove(f.File.Name())
+}
+
+func (s *store) Get(k string, v interface{}) (found bool, err error) {
 	casted, ok := v.(*File)
 	if !ok {
 		return false, ErrInvalidArgument
 	}
 
-	found, getErr := s.kvStore.Get(k, casted)
+	ctx, span := tracing.Start(s.ctx, "store.Get", attribute.String("key", k))
+	defer func() { tracing.End(span, ignoreNotFound(err)) }()
+	s = s.with(ctx)
+
+	found, getErr := s.kvGet(k, casted)
 	if getErr != nil {
 		return false, getErr
 	}
@@ -113,7 +563,7 @@ func (s *store) Get(k string, v interface{}) (bool, error) {
 		return false, ErrFileNotFound
 	}
 
-	ff, openErr := s.fs.Open(casted.Name)
+	ff, openErr := s.open(casted.Name)
 	if openErr != nil {
 		return false, openErr
 	}
@@ -123,12 +573,557 @@ func (s *store) Get(k string, v interface{}) (bool, error) {
 	return true, nil
 }
 
+// Delete removes the record of k together with all of its blobs.
 func (s *store) Delete(k string) error {
-	if err := s.fs.Remove(k); err != nil {
+	unlock := s.locks.lock(k)
+	defer unlock()
+
+	f, err := s.Lookup(k)
+	if err != nil {
 		return err
 	}
 
-	return s.kvStore.Delete(k)
+	return s.remove(f)
+}
+
+// remove deletes the record of f together with all of its blobs, the key must be locked.
+func (s *store) remove(f File) error {
+	// the record goes first, leftover blobs are harmless while a record without a blob is a broken link
+	if err := s.kvDelete(f.ShortID); err != nil {
+		return err
+	}
+
+	for _, name := range s.blobs(f) {
+		_ = s.fs.Remove(name)
+	}
+
+	return nil
+}
+
+// contentBlobs returns the names of the current, previous and original blobs of f.
+func contentBlobs(f File) []string {
+	names := []string{f.Name}
+	if f.Original != "" {
+		names = append(names, f.Original)
+	}
+
+	for _, rev := range f.Revisions {
+		names = append(names, rev.Name)
+	}
+
+	return names
+}
+
+// blobs returns the names of the content and derived blobs of f.
+func (s *store) blobs(f File) []string {
+	return append(contentBlobs(f), s.derivedBlobs(f.ShortID)...)
+}
+
+// derivedBlobs returns the names of the derivatives of every version stored under the short ID k.
+func (s *store) derivedBlobs(k string) []string {
+	// derivatives are named <short>@v<N>_<key>, the short ID may contain slashes
+	prefix := path.Join(derivedDir, k+"@v")
+	dir, err := s.fs.Open(path.Dir(prefix))
+	if err != nil {
+		return nil
+	}
+
+	defer dir.Close()
+
+	var names []string
+	derived, _ := dir.Readdirnames(-1)
+	for _, name := range derived {
+		if strings.HasPrefix(name, path.Base(prefix)) {
+			names = append(names, path.Join(path.Dir(prefix), name))
+		}
+	}
+
+	return names
+}
+
+func (s *store) Lookup(k string) (File, error) {
+	var f File
+	found, err := s.kvGet(k, &f)
+	if err != nil {
+		return f, err
+	}
+
+	if !found {
+		return f, ErrFileNotFound
+	}
+
+	return f, nil
+}
+
+func (s *store) List() ([]File, error) {
+	lister, ok := s.kvStore.(Lister)
+	if !ok {
+		return nil, ErrInvalidArgument
+	}
+
+	keys, err := lister.Keys("")
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]File, 0, len(keys))
+	for _, k := range keys {
+		f, lookupErr := s.Lookup(k)
+		if lookupErr != nil {
+			// removed while listing
+			continue
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+func (s *store) Update(k string, change func(f *File) error) (File, error) {
+	// a rename locks the new short ID as well, it is known once change ran
+	locked := []string{k}
+	for {
+		unlock := s.locks.lock(locked...)
+		f, next, err := s.update(k, locked, change)
+		unlock()
+
+		if next == "" {
+			return f, err
+		}
+		locked = []string{k, next}
+	}
+}
+
+// update runs Update with the given keys locked.
+// It returns the new short ID instead of renaming if that one is not locked.
+func (s *store) update(k string, locked []string, change func(f *File) error) (File, string, error) {
+	old, err := s.Lookup(k)
+	if err != nil {
+		return old, "", err
+	}
+
+	f := old
+	f.Revisions = append([]Revision(nil), old.Revisions...)
+	if err = change(&f); err != nil {
+		return old, "", err
+	}
+
+	if f.ShortID == k {
+		var cur File
+		found, modifyErr := s.modify(k, &cur, func() error {
+			return change(&cur)
+		})
+		if modifyErr == nil && !found {
+			modifyErr = ErrFileNotFound
+		}
+
+		return cur, "", modifyErr
+	}
+
+	if !slices.Contains(locked, f.ShortID) {
+		return old, f.ShortID, nil
+	}
+
+	if found, _ := s.kvGet(f.ShortID, &File{}); found {
+		return old, "", ErrFileExists
+	}
+
+	f.Name = blobName(f.ShortID, filepath.Ext(old.Name))
+	if f.Original != "" {
+		f.Original = originalName(f.ShortID, old.Original)
+	}
+	for i, rev := range f.Revisions {
+		f.Revisions[i].Name = revisionName(f.ShortID, rev.Version, rev.Name)
+	}
+
+	renamed, renameErr := s.renameBlobs(old, f)
+	if renameErr == nil {
+		renameErr = s.move(k, f)
+	}
+
+	if renameErr != nil {
+		// put the blobs back so the old record stays valid
+		for newName, oldName := range renamed {
+			_ = s.fs.Rename(newName, oldName)
+		}
+		return old, "", renameErr
+	}
+
+	// versions start over for a later upload under k, it must not be served these derivatives
+	for _, name := range s.derivedBlobs(k) {
+		_ = s.fs.Remove(name)
+	}
+
+	return f, "", nil
+}
+
+// errStale stops a change made for a version that was replaced meanwhile.
+var errStale = errors.New("version was replaced")
+
+func (s *store) SetMedia(k string, version int, info *media.Info) error {
+	// a rename running meanwhile would store the record without the info
+	unlock := s.locks.lock(k)
+	defer unlock()
+
+	var f File
+	found, err := s.modify(k, &f, func() error {
+		if f.CurrentVersion() != version {
+			return errStale
+		}
+		f.Media = info
+		return nil
+	})
+
+	switch {
+	case errors.Is(err, errStale):
+		return nil
+	case err != nil:
+		return err
+	case !found:
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+// renameBlobs moves the current and previous blobs of old to the names used by f.
+// It returns the blobs renamed so far keyed by their new name.
+func (s *store) renameBlobs(old, f File) (map[string]string, error) {
+	renamed := make(map[string]string, len(f.Revisions)+1)
+	if err := s.fs.MkdirAll(path.Dir(f.Name), 0755); err != nil {
+		return renamed, err
+	}
+
+	if err := s.fs.Rename(old.Name, f.Name); err != nil {
+		return renamed, err
+	}
+	renamed[f.Name] = old.Name
+
+	if old.Original != "" {
+		if err := s.fs.Rename(old.Original, f.Original); err != nil {
+			return renamed, err
+		}
+		renamed[f.Original] = old.Original
+	}
+
+	for i, rev := range old.Revisions {
+		if err := s.fs.Rename(rev.Name, f.Revisions[i].Name); err != nil {
+			return renamed, err
+		}
+		renamed[f.Revisions[i].Name] = rev.Name
+	}
+
+	return renamed, nil
+}
+
+func (s *store) Replace(k string, rf RequestFile, expected int) (File, error) {
+	old, err := s.Lookup(k)
+	if errors.Is(err, ErrFileNotFound) {
+		if expected != 0 {
+			return File{}, ErrVersionMismatch
+		}
+
+		rf.Version = 1
+		return File(rf), s.Set(k, rf)
+	}
+
+	if err != nil {
+		return File{}, err
+	}
+
+	// spares the upload for a version that is already stale, the check below decides
+	if expected != 0 && expected != old.CurrentVersion() {
+		return old, ErrVersionMismatch
+	}
+
+	f := File(rf)
+	staged := make(map[string]string, 2)
+	unstage := func() {
+		for tmp := range staged {
+			_ = s.fs.Remove(tmp)
+		}
+	}
+
+	sum := sha256.New()
+	tmp, err := stagedName(f.Name)
+	if err != nil {
+		return old, err
+	}
+	if err = s.write(tmp, io.TeeReader(rf, sum), rf.Size); err != nil {
+		return old, err
+	}
+	staged[tmp] = f.Name
+	f.SHA256 = hex.EncodeToString(sum.Sum(nil))
+
+	if f.original != nil {
+		if tmp, err = stagedName(f.Original); err == nil {
+			err = s.write(tmp, f.original, -1)
+		}
+		if err != nil {
+			unstage()
+			return old, err
+		}
+		staged[tmp] = f.Original
+	}
+
+	// concurrent overwrites of k would keep their previous content under the same revision name
+	unlock := s.locks.lock(k)
+	defer unlock()
+
+	if old, err = s.Lookup(k); err != nil {
+		unstage()
+		return old, err
+	}
+
+	version := old.CurrentVersion()
+	if expected != 0 && expected != version {
+		unstage()
+		return old, ErrVersionMismatch
+	}
+
+	rev := Revision{
+		Version:     version,
+		Name:        revisionName(k, version, old.Name),
+		ContentType: old.ContentType,
+		Size:        old.Size,
+		SHA256:      old.SHA256,
+		ReplacedAt:  time.Now(),
+	}
+
+	if err = s.fs.Rename(old.Name, rev.Name); err != nil {
+		unstage()
+		return old, err
+	}
+
+	// the untouched upload belongs to the replaced content only, it is put aside until the record is stored
+	var keptOriginal string
+	if old.Original != "" {
+		if keptOriginal, err = stagedName(old.Original); err == nil {
+			err = s.fs.Rename(old.Original, keptOriginal)
+		}
+		if err != nil {
+			_ = s.fs.Rename(rev.Name, old.Name)
+			unstage()
+			return old, err
+		}
+	}
+
+	// puts the previous content back so the stored record stays valid
+	published := make([]string, 0, len(staged))
+	rollback := func() {
+		for _, name := range published {
+			if name != old.Name {
+				_ = s.fs.Remove(name)
+			}
+		}
+		_ = s.fs.Rename(rev.Name, old.Name)
+		if keptOriginal != "" {
+			_ = s.fs.Rename(keptOriginal, old.Original)
+		}
+		unstage()
+	}
+
+	for tmp, name := range staged {
+		if err = s.fs.Rename(tmp, name); err != nil {
+			rollback()
+			return old, err
+		}
+		delete(staged, tmp)
+		published = append(published, name)
+	}
+
+	var cur File
+	found, err := s.modify(k, &cur, func() error {
+		// changed by another process
+		if cur.CurrentVersion() != version {
+			return errStale
+		}
+
+		f.Private = cur.Private
+		f.Owner = cur.Owner
+		if f.ExpiresAt == nil {
+			f.ExpiresAt = cur.ExpiresAt
+		}
+		if f.Password == "" {
+			f.Password = cur.Password
+		}
+		f.Version = version + 1
+		f.UploadedAt = rev.ReplacedAt
+		f.Revisions = append(slices.Clip(cur.Revisions), rev)
+
+		cur = f
+		return nil
+	})
+	switch {
+	case errors.Is(err, errStale):
+		err = ErrVersionMismatch
+	case err == nil && !found:
+		err = ErrFileNotFound
+	}
+	if err != nil {
+		rollback()
+		return old, err
+	}
+
+	if keptOriginal != "" {
+		_ = s.fs.Remove(keptOriginal)
+	}
+
+	return f, nil
+}
+
+func (s *store) Original(k string) (File, error) {
+	f, err := s.Lookup(k)
+	if err != nil {
+		return f, err
+	}
+
+	if f.Original == "" {
+		return File{}, ErrFileNotFound
+	}
+
+	blob, openErr := s.open(f.Original)
+	if openErr != nil {
+		return File{}, ErrFileNotFound
+	}
+
+	info, statErr := blob.Stat()
+	if statErr != nil {
+		blob.Close()
+		return File{}, statErr
+	}
+
+	f.Name = f.Original
+	f.Size = info.Size()
+	f.SHA256 = ""
+	f.Reader = blob
+
+	return f, nil
+}
+
+func (s *store) Revision(k string, version int) (File, error) {
+	f, err := s.Lookup(k)
+	if err != nil {
+		return f, err
+	}
+
+	if version == f.CurrentVersion() {
+		found, getErr := s.Get(k, &f)
+		if !found {
+			return f, getErr
+		}
+		return f, nil
+	}
+
+	rev, ok := f.Revision(version)
+	if !ok {
+		return File{}, ErrFileNotFound
+	}
+
+	blob, openErr := s.open(rev.Name)
+	if openErr != nil {
+		return File{}, ErrFileNotFound
+	}
+
+	f.Name = rev.Name
+	f.ContentType = rev.ContentType
+	f.Size = rev.Size
+	f.SHA256 = rev.SHA256
+	f.Version = rev.Version
+	f.Reader = blob
+
+	return f, nil
+}
+
+func (s *store) Derived(f File, key string, render func(dst io.Writer, src io.Reader) error) (File, error) {
+	name := path.Join(derivedDir, fmt.Sprintf("%s@v%d_%s", f.ShortID, f.CurrentVersion(), key))
+
+	if _, statErr := s.fs.Stat(name); statErr != nil {
+		if render == nil {
+			return File{}, ErrFileNotFound
+		}
+		_, err, _ := s.renders.Do(name, func() (interface{}, error) {
+			return nil, s.derive(f.Name, name, render)
+		})
+		if err != nil {
+			return File{}, err
+		}
+	}
+
+	blob, err := s.open(name)
+	if err != nil {
+		return File{}, err
+	}
+
+	info, err := blob.Stat()
+	if err != nil {
+		blob.Close()
+		return File{}, err
+	}
+
+	f.Name = name
+	f.Size = info.Size()
+	f.SHA256 = ""
+	f.Reader = blob
+
+	return f, nil
+}
+
+func (s *store) Link(f File) (string, error) {
+	p, ok := s.fs.(filesystem.Presigner)
+	if !ok {
+		return "", filesystem.ErrNotSupported
+	}
+
+	return p.PresignedURL(f.Name, f.ContentType)
+}
+
+// derive renders the blob src into dst, a partially written derivative is never left under dst.
+func (s *store) derive(src, dst string, render func(dst io.Writer, src io.Reader) error) error {
+	if err := s.fs.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	original, err := s.fs.Open(src)
+	if err != nil {
+		return ErrFileNotFound
+	}
+
+	defer original.Close()
+
+	out, err := s.create(dst)
+	if err != nil {
+		return err
+	}
+
+	if err = render(out, original); err != nil {
+		_ = out.Abort()
+		return err
+	}
+
+	return out.Close()
+}
+
+// originalName returns the blob name of the untouched upload, keeping the extension of the original blob.
+func originalName(k string, name string) string {
+	return k + "@original" + filepath.Ext(name)
+}
+
+// revisionName returns the blob name of a previous version, keeping the extension of the original blob.
+func revisionName(k string, version int, name string) string {
+	return fmt.Sprintf("%s@v%d%s", k, version, filepath.Ext(name))
+}
+
+func (s *store) move(oldK string, f File) error {
+	if m, ok := s.kvStore.(Mover); ok {
+		return m.Move(oldK, f.ShortID, f)
+	}
+
+	if err := s.kvSet(f.ShortID, f); err != nil {
+		return err
+	}
+
+	return s.kvDelete(oldK)
 }
 
 func (s *store) Close() error {
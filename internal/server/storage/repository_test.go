@@ -0,0 +1,259 @@
+package storage_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/labi-le/server/internal/server/storage"
+	"github.com/labi-le/server/pkg/bboltdb"
+	"github.com/labi-le/server/pkg/filesystem"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newStore(t *testing.T) (storage.FileStore, filesystem.Storage) {
+	t.Helper()
+
+	s, fs, _ := openStore(t)
+
+	return s, fs
+}
+
+// openStore returns the store together with the key-value store of its records.
+func openStore(t *testing.T) (storage.FileStore, filesystem.Storage, storage.Store) {
+	t.Helper()
+
+	kv, err := bboltdb.NewStore(bboltdb.Options{Path: filepath.Join(t.TempDir(), "bbolt.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = kv.Close() })
+
+	fs := filesystem.NewMemFS("/files")
+
+	return storage.NewStore(kv, fs), fs, kv
+}
+
+func upload(name, content string) storage.RequestFile {
+	return storage.RequestFile{
+		Name:        name,
+		ShortID:     name,
+		ContentType: "text/plain",
+		Size:        int64(len(content)),
+		Reader:      strings.NewReader(content),
+	}
+}
+
+func readBlob(t *testing.T, fs filesystem.Storage, name string) string {
+	t.Helper()
+
+	blob, err := fs.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %v", name, err)
+	}
+	defer blob.Close()
+
+	content, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+
+	return string(content)
+}
+
+// gatedReader holds the first read until every upload sharing started reads, or a second passed.
+type gatedReader struct {
+	io.Reader
+	started *sync.WaitGroup
+	once    sync.Once
+}
+
+func (r *gatedReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.started.Done()
+
+		all := make(chan struct{})
+		go func() {
+			r.started.Wait()
+			close(all)
+		}()
+
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+		}
+	})
+
+	return r.Reader.Read(p)
+}
+
+// replaceConcurrently overwrites a.txt n times at once expecting the given version.
+func replaceConcurrently(s storage.FileStore, n, expected int) []error {
+	errs := make([]error, n)
+
+	var started, wg sync.WaitGroup
+	started.Add(n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rf := upload("a.txt", fmt.Sprintf("content %d", i))
+			rf.Reader = &gatedReader{Reader: rf.Reader, started: &started}
+			_, errs[i] = s.Replace("a.txt", rf, expected)
+		}()
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func TestConcurrentReplaceKeepsEveryVersion(t *testing.T) {
+	s, fs := newStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	for i, err := range replaceConcurrently(s, n, 0) {
+		if err != nil {
+			t.Fatalf("replace %d: %v", i, err)
+		}
+	}
+
+	f, err := s.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != n+1 || len(f.Revisions) != n {
+		t.Fatalf("version = %d with %d revisions, want %d with %d", f.Version, len(f.Revisions), n+1, n)
+	}
+
+	// every previous content is kept under its own name and matches its checksum
+	seen := make(map[string]bool, n+1)
+	for _, rev := range f.Revisions {
+		content := readBlob(t, fs, rev.Name)
+		sum := sha256.Sum256([]byte(content))
+		if hex.EncodeToString(sum[:]) != rev.SHA256 {
+			t.Errorf("revision %d holds %q, its checksum doesn't match", rev.Version, content)
+		}
+		if seen[content] {
+			t.Errorf("revision %d holds %q twice", rev.Version, content)
+		}
+		seen[content] = true
+	}
+
+	current := readBlob(t, fs, f.Name)
+	if seen[current] {
+		t.Errorf("current content %q is also a revision", current)
+	}
+	if !seen["first"] {
+		t.Error("the first content was lost")
+	}
+}
+
+func TestConcurrentReplaceChecksTheVersion(t *testing.T) {
+	s, _ := newStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced := 0
+	for i, err := range replaceConcurrently(s, 8, 1) {
+		switch {
+		case err == nil:
+			replaced++
+		case !errors.Is(err, storage.ErrVersionMismatch):
+			t.Errorf("replace %d: %v, want %v", i, err, storage.ErrVersionMismatch)
+		}
+	}
+
+	if replaced != 1 {
+		t.Fatalf("%d replaces of version 1 succeeded, want 1", replaced)
+	}
+
+	f, err := s.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Version != 2 || len(f.Revisions) != 1 {
+		t.Fatalf("version = %d with %d revisions, want 2 with 1", f.Version, len(f.Revisions))
+	}
+}
+
+func TestUpdateKeepsConcurrentChanges(t *testing.T) {
+	s, _ := newStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "first")); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Update("a.txt", func(f *storage.File) error {
+				f.ContentType += "+"
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	f, err := s.Lookup("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "text/plain" + strings.Repeat("+", n); f.ContentType != want {
+		t.Fatalf("content type = %q, want %q", f.ContentType, want)
+	}
+}
+
+func TestRemoveStagedKeepsPublishedBlobs(t *testing.T) {
+	s, fs := newStore(t)
+	if err := s.Set("a.txt", upload("a.txt", "content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// left behind by an upload interrupted before its record was stored
+	const staged = "dir/b.txt.0123456789abcdef.upload"
+	if err := fs.MkdirAll("dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := fs.Create(staged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// uploads staged after the given time are still running
+	removed, err := s.RemoveStaged(time.Now().Add(-time.Minute))
+	if err != nil || len(removed) != 0 {
+		t.Fatalf("removed %v, %v before the blob was staged", removed, err)
+	}
+
+	removed, err = s.RemoveStaged(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != staged {
+		t.Fatalf("removed %v, want %s", removed, staged)
+	}
+
+	if _, err = fs.Stat(staged); err == nil {
+		t.Error("the staged blob is still there")
+	}
+	if got := readBlob(t, fs, "a.txt"); got != "content" {
+		t.Errorf("a.txt holds %q", got)
+	}
+}
@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/sigv4"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Namespace is the XML namespace of S3 responses.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3MaxKeys is the largest page of ListObjectsV2.
+const s3MaxKeys = 1000
+
+// s3Time is the format of timestamps inside S3 responses.
+const s3Time = "2006-01-02T15:04:05.000Z"
+
+type s3Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3Buckets struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Location struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ObjectList struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int        `xml:"KeyCount"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+// S3 serves requests signed with AWS Signature Version 4 as a subset of the S3 API,
+// other requests are passed to the next handler. Short IDs are the object keys of a single bucket,
+// the access key is the name of an API key and the secret is the key itself.
+func (r *resource) S3(ctx *fiber.Ctx) error {
+	req := s3Request(ctx)
+	if !sigv4.Signed(req.Header, req.Query) {
+		return ctx.Next()
+	}
+
+	sig, err := sigv4.Verify(req, r.keyOf, time.Now())
+	switch {
+	case errors.Is(err, sigv4.ErrAccessKey):
+		return s3Fail(ctx, http.StatusForbidden, "InvalidAccessKeyId", err)
+	case errors.Is(err, sigv4.ErrSignature):
+		return s3Fail(ctx, http.StatusForbidden, "SignatureDoesNotMatch", err)
+	case errors.Is(err, sigv4.ErrExpired):
+		return s3Fail(ctx, http.StatusForbidden, "RequestTimeTooSkewed", err)
+	case errors.Is(err, sigv4.ErrContentSHA256):
+		return s3Fail(ctx, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err)
+	case err != nil:
+		return s3Fail(ctx, http.StatusBadRequest, "AuthorizationHeaderMalformed", err)
+	}
+	log.SetKeyName(ctx, sig.AccessKey)
+
+	p, err := url.PathUnescape(req.Path)
+	if err != nil {
+		return s3Fail(ctx, http.StatusBadRequest, "InvalidURI", err)
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(p, "/"), "/")
+	method := ctx.Method()
+
+	switch {
+	case bucket == "" && method == http.MethodGet:
+		return r.listBuckets(ctx, sig.AccessKey)
+	case bucket != r.bucket:
+		return s3Fail(ctx, http.StatusNotFound, "NoSuchBucket", errors.New("bucket does not exist"))
+	case key == "" && method == http.MethodGet && req.Query.Has("location"):
+		return s3Reply(ctx, http.StatusOK, s3Location{Xmlns: s3Namespace})
+	case key == "" && method == http.MethodGet:
+		return r.listObjects(ctx, sig.AccessKey, req.Query)
+	case key == "" && method == http.MethodHead:
+		return ctx.SendStatus(http.StatusOK)
+	case key == "":
+		return s3Fail(ctx, http.StatusNotImplemented, "NotImplemented", errors.New("bucket operation is not supported"))
+	case len(req.Query) > 0 && (req.Query.Has("uploads") || req.Query.Has("uploadId")):
+		return s3Fail(ctx, http.StatusNotImplemented, "NotImplemented", errors.New("multipart uploads are not supported"))
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return r.getObject(ctx, sig.AccessKey, key)
+	case http.MethodPut:
+		return r.putObject(ctx, sig, key)
+	case http.MethodDelete:
+		return r.deleteObject(ctx, sig.AccessKey, key)
+	}
+
+	return s3Fail(ctx, http.StatusMethodNotAllowed, "MethodNotAllowed", errors.New("method is not allowed"))
+}
+
+func (r *resource) listBuckets(ctx *fiber.Ctx, name string) error {
+	return s3Reply(ctx, http.StatusOK, s3Buckets{
+		Xmlns:   s3Namespace,
+		Owner:   s3Owner{ID: name, DisplayName: name},
+		Buckets: []s3Bucket{{Name: r.bucket, CreationDate: time.Unix(0, 0).UTC().Format(s3Time)}},
+	})
+}
+
+// listObjects implements ListObjectsV2 over the files of the caller.
+func (r *resource) listObjects(ctx *fiber.Ctx, name string, query url.Values) error {
+	files, err := r.s.List(ctx.UserContext(), name)
+	if err != nil {
+		return s3Fail(ctx, http.StatusInternalServerError, "InternalError", err)
+	}
+
+	list := s3ObjectList{
+		Xmlns:             s3Namespace,
+		Name:              r.bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           s3MaxKeys,
+	}
+
+	if maxKeys := query.Get("max-keys"); maxKeys != "" {
+		n, convErr := strconv.Atoi(maxKeys)
+		if convErr != nil || n < 0 {
+			return s3Fail(ctx, http.StatusBadRequest, "InvalidArgument", ErrInvalidForm)
+		}
+		list.MaxKeys = min(n, s3MaxKeys)
+	}
+
+	after := list.StartAfter
+	if list.ContinuationToken != "" {
+		token, decodeErr := base64.RawURLEncoding.DecodeString(list.ContinuationToken)
+		if decodeErr != nil {
+			return s3Fail(ctx, http.StatusBadRequest, "InvalidArgument", decodeErr)
+		}
+		after = string(token)
+	}
+
+	var last string
+	for _, f := range files {
+		k := f.ShortID
+		if !strings.HasPrefix(k, list.Prefix) || k <= after ||
+			(list.Delimiter != "" && strings.HasSuffix(after, list.Delimiter) && strings.HasPrefix(k, after)) {
+			continue
+		}
+
+		// keys sharing the part up to the delimiter are rolled up into a common prefix
+		if list.Delimiter != "" {
+			if i := strings.Index(k[len(list.Prefix):], list.Delimiter); i >= 0 {
+				common := k[:len(list.Prefix)+i+len(list.Delimiter)]
+				if common == last {
+					continue
+				}
+				if list.KeyCount == list.MaxKeys {
+					list.IsTruncated = true
+					break
+				}
+				list.CommonPrefixes = append(list.CommonPrefixes, s3Prefix{Prefix: common})
+				list.KeyCount++
+				last = common
+				continue
+			}
+		}
+
+		if list.KeyCount == list.MaxKeys {
+			list.IsTruncated = true
+			break
+		}
+
+		list.Contents = append(list.Contents, s3Object{
+			Key:          k,
+			LastModified: f.UploadedAt.UTC().Format(s3Time),
+			ETag:         etag(f.CurrentVersion()),
+			Size:         f.Size,
+			StorageClass: "STANDARD",
+		})
+		list.KeyCount++
+		last = k
+	}
+
+	if list.IsTruncated {
+		list.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+
+	return s3Reply(ctx, http.StatusOK, list)
+}
+
+func (r *resource) getObject(ctx *fiber.Ctx, name, key string) error {
+	file, err := r.s.Get(ctx.UserContext(), key)
+	if err != nil {
+		return s3Fail(ctx, http.StatusNotFound, "NoSuchKey", err)
+	}
+
+	if !mayAccess(name, file) {
+		file.Close() //nolint:errcheck // read-only blob
+		return s3Fail(ctx, http.StatusForbidden, "AccessDenied", ErrInvalidKey)
+	}
+
+	if !file.UploadedAt.IsZero() {
+		ctx.Set(fiber.HeaderLastModified, file.UploadedAt.UTC().Format(http.TimeFormat))
+	}
+
+	return send(ctx, file)
+}
+
+// putObject stores the body as is, metadata is never stripped so the object can be compared with its source.
+func (r *resource) putObject(ctx *fiber.Ctx, sig sigv4.Signature, key string) error {
+	if ctx.Get("X-Amz-Copy-Source") != "" {
+		return s3Fail(ctx, http.StatusNotImplemented, "NotImplemented", errors.New("copying objects is not supported"))
+	}
+
+	if !checkAvailableURL(key) {
+		return s3Fail(ctx, http.StatusBadRequest, "InvalidArgument", r.reject(ErrInvalidURL))
+	}
+
+	body := ctx.Request().Body()
+	if sig.Streaming {
+		var err error
+		if body, err = sig.DecodeChunks(body); err != nil {
+			return s3Fail(ctx, http.StatusForbidden, "SignatureDoesNotMatch", err)
+		}
+	}
+
+	if len(body) == 0 {
+		return s3Fail(ctx, http.StatusBadRequest, "InvalidArgument", r.reject(ErrEmptyFile))
+	}
+
+	contentType := mimetype.Detect(body)
+	req := RequestFile{
+		Name:        blobName(key, contentType.Extension()),
+		ShortID:     key,
+		ContentType: contentType.String(),
+		Size:        int64(len(body)),
+		Owner:       sig.AccessKey,
+		Reader:      bytes.NewReader(body),
+	}
+
+	if err := r.checkQuota(ctx.UserContext(), req.Owner, req.Size); errors.Is(err, ErrQuotaExceeded) {
+		return s3Fail(ctx, http.StatusForbidden, "AccessDenied", r.reject(err))
+	} else if err != nil {
+		return s3Fail(ctx, http.StatusInternalServerError, "InternalError", err)
+	}
+
+	_, err := r.s.Add(ctx.UserContext(), req)
+	if errors.Is(err, ErrFileExists) {
+		allowed, lookupErr := mayOverwrite(ctx.UserContext(), r.s, sig.AccessKey, key)
+		if lookupErr != nil {
+			return s3Fail(ctx, http.StatusInternalServerError, "InternalError", lookupErr)
+		}
+		if !allowed {
+			return s3Fail(ctx, http.StatusForbidden, "AccessDenied", ErrInvalidKey)
+		}
+
+		var file File
+		if file, err = r.s.Replace(ctx.UserContext(), req, 0); err == nil {
+			r.record(ctx, audit.ActionReplace, key, map[string]any{"version": file.Version, "size": req.Size, "via": "s3"})
+			ctx.Set(fiber.HeaderETag, etag(file.Version))
+			return ctx.SendStatus(http.StatusOK)
+		}
+	}
+
+	if err != nil {
+		return s3Fail(ctx, http.StatusInternalServerError, "InternalError", err)
+	}
+
+	r.record(ctx, audit.ActionUpload, key, map[string]any{"size": req.Size, "content_type": req.ContentType, "via": "s3"})
+	ctx.Set(fiber.HeaderETag, etag(1))
+
+	return ctx.SendStatus(http.StatusOK)
+}
+
+// deleteObject removes the file, like S3 it succeeds for missing keys.
+func (r *resource) deleteObject(ctx *fiber.Ctx, name, key string) error {
+	file, err := r.s.Get(ctx.UserContext(), key)
+	if err != nil {
+		return ctx.SendStatus(http.StatusNoContent)
+	}
+
+	file.Close() //nolint:errcheck // only metadata is needed
+
+	if !mayModify(name, file) {
+		return s3Fail(ctx, http.StatusForbidden, "AccessDenied", ErrInvalidKey)
+	}
+
+	if err = r.s.Delete(ctx.UserContext(), key); err != nil && !errors.Is(err, ErrFileNotFound) {
+		return s3Fail(ctx, http.StatusInternalServerError, "InternalError", err)
+	}
+
+	if err == nil {
+		r.record(ctx, audit.ActionDelete, key, map[string]any{"via": "s3"})
+	}
+
+	return ctx.SendStatus(http.StatusNoContent)
+}
+
+// mayAccess reports whether the key with the given name can read a private or protected file.
+func mayAccess(name string, f File) bool {
+	return (!f.Private && f.Password == "") || mayModify(name, f)
+}
+
+// mayModify reports whether the key with the given name can overwrite or delete the file.
+func mayModify(name string, f File) bool {
+	return name == OwnerName || name == f.Owner
+}
+
+// mayOverwrite reports whether the key with the given name may replace the file stored under k.
+// The file is not replaced when its record can't be read, a missing one may be stored again.
+func mayOverwrite(ctx context.Context, s Service, name, k string) (bool, error) {
+	f, err := s.Lookup(ctx, k)
+	switch {
+	case errors.Is(err, ErrFileNotFound):
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+
+	return mayModify(name, f), nil
+}
+
+// s3Request returns the parts of the request covered by a signature.
+func s3Request(ctx *fiber.Ctx) sigv4.Request {
+	header := make(http.Header)
+	ctx.Request().Header.VisitAll(func(k, v []byte) {
+		header.Add(string(k), string(v))
+	})
+
+	query, _ := url.ParseQuery(string(ctx.Request().URI().QueryString()))
+
+	return sigv4.Request{
+		Method: ctx.Method(),
+		Path:   string(ctx.Request().URI().PathOriginal()),
+		Query:  query,
+		Header: header,
+		Host:   string(ctx.Request().Host()),
+		Body:   ctx.Request().Body(),
+	}
+}
+
+func s3Reply(ctx *fiber.Ctx, status int, v any) error {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	ctx.Set(fiber.HeaderContentType, fiber.MIMEApplicationXMLCharsetUTF8)
+
+	return ctx.Status(status).Send(append([]byte(xml.Header), body...))
+}
+
+func s3Fail(ctx *fiber.Ctx, status int, code string, err error) error {
+	return s3Reply(ctx, status, s3Error{
+		Code:     code,
+		Message:  err.Error(),
+		Resource: ctx.Path(),
+	})
+}
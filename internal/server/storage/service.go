@@ -4,9 +4,19 @@ import (
 	"context"
 	"errors"
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/labi-le/server/pkg/metadata"
+	"github.com/labi-le/server/pkg/thumbnail"
+	"github.com/labi-le/server/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/crypto/bcrypt"
 	"io"
+	"mime"
 	"mime/multipart"
+	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var (
@@ -17,25 +27,112 @@ var (
 type Service interface {
 	Add(ctx context.Context, rf RequestFile) (string, error)
 	Get(ctx context.Context, hash string) (File, error)
+	// Lookup returns the stored metadata of a file without opening its content, expired files included.
+	Lookup(ctx context.Context, k string) (File, error)
+	Update(ctx context.Context, k string, u UpdateFile) (File, error)
+	// Replace overwrites an existing file keeping its previous content as a revision.
+	// A non-zero expected version must match the current one.
+	Replace(ctx context.Context, rf RequestFile, expected int) (File, error)
+	// GetRevision returns the given version of a file, it may be the current one.
+	GetRevision(ctx context.Context, k string, version int) (File, error)
+	// GetOriginal returns the upload of a file as it was before metadata was stripped.
+	GetOriginal(ctx context.Context, k string) (File, error)
+	// Thumbnail returns the image resized according to opt, results are cached.
+	Thumbnail(ctx context.Context, k string, opt thumbnail.Options) (File, error)
+	// Poster returns the frame extracted from a video, it appears some time after the upload.
+	Poster(ctx context.Context, k string) (File, error)
+	// List returns the files uploaded with the key of the given owner.
+	List(ctx context.Context, owner string) ([]File, error)
+	// Delete removes a file with all of its versions and derivatives.
+	Delete(ctx context.Context, k string) error
+	// DeleteExpired removes the files past their expiry date at now and returns their keys.
+	DeleteExpired(ctx context.Context, now time.Time) ([]string, error)
+	// Link returns a temporary link to download f directly from the underlying storage.
+	Link(ctx context.Context, f File) (string, error)
+	// Backup takes a snapshot of the records changed since the given version, the caller must close it.
+	Backup(ctx context.Context, since uint64) (*Backup, error)
+	// Check reconciles the records with the blobs, see CheckOptions.
+	Check(ctx context.Context, opts CheckOptions) (Report, error)
+	// Usage counts the stored files and their size, previous versions included.
+	Usage(ctx context.Context) (Usage, error)
+}
+
+// Usage is the space taken by the stored files.
+type Usage struct {
+	Files int
+	Bytes int64
+}
+
+// UpdateFile is a partial change of file metadata, nil fields are left untouched.
+type UpdateFile struct {
+	ShortID     *string `json:"short_id"`
+	ContentType *string `json:"content_type"`
+	// ExpiresIn is the remaining lifetime in seconds counted from now, zero removes the expiry
+	ExpiresIn *int64 `json:"expires_in"`
+	Private   *bool  `json:"private"`
+	// Password protects the file, an empty one removes the protection
+	Password *string `json:"password"`
+	// Rollback restores the content of the given version as a new version
+	Rollback *int `json:"rollback"`
+}
+
+// auditDetail lists the changed fields for the audit log, the password is only reported as set or removed.
+func (u UpdateFile) auditDetail() map[string]any {
+	detail := map[string]any{}
+	if u.ShortID != nil {
+		detail["short_id"] = *u.ShortID
+	}
+	if u.ContentType != nil {
+		detail["content_type"] = *u.ContentType
+	}
+	if u.ExpiresIn != nil {
+		detail["expires_in"] = *u.ExpiresIn
+	}
+	if u.Private != nil {
+		detail["private"] = *u.Private
+	}
+	if u.Password != nil {
+		detail["password"] = *u.Password != ""
+	}
+	if u.Rollback != nil {
+		detail["rollback"] = *u.Rollback
+	}
+
+	return detail
 }
 
 type service struct {
-	store Store
+	store    FileStore
+	analyzer *Analyzer
 }
 
-func NewService(c Store) Service {
+// NewService creates a service, analyzer may be nil when media analysis is disabled.
+func NewService(c FileStore, analyzer *Analyzer) Service {
 	return &service{
-		store: c,
+		store:    c,
+		analyzer: analyzer,
 	}
 }
 
-func (s *service) Add(_ context.Context, rf RequestFile) (string, error) {
-	return rf.ShortID, s.store.Set(rf.ShortID, rf)
+func (s *service) Add(ctx context.Context, rf RequestFile) (_ string, err error) {
+	ctx, span := tracing.Start(ctx, "service.Add", attribute.String("key", rf.ShortID))
+	defer func() { tracing.End(span, err) }()
+
+	if err = s.store.WithContext(ctx).Set(rf.ShortID, rf); err != nil {
+		return rf.ShortID, err
+	}
+
+	s.analyzer.Enqueue(File(rf))
+
+	return rf.ShortID, nil
 }
 
-func (s *service) Get(_ context.Context, k string) (File, error) {
+func (s *service) Get(ctx context.Context, k string) (_ File, err error) {
+	ctx, span := tracing.Start(ctx, "service.Get", attribute.String("key", k))
+	defer func() { tracing.End(span, ignoreNotFound(err)) }()
+
 	var f File
-	found, err := s.store.Get(k, &f)
+	found, err := s.store.WithContext(ctx).Get(k, &f)
 	if err != nil {
 		return f, err
 	}
@@ -44,9 +141,347 @@ func (s *service) Get(_ context.Context, k string) (File, error) {
 		return f, ErrFileNotFound
 	}
 
+	if f.Expired(time.Now()) {
+		f.Close() //nolint:errcheck // read-only blob
+		return File{}, ErrFileNotFound
+	}
+
+	return f, nil
+}
+
+func (s *service) Lookup(ctx context.Context, k string) (File, error) {
+	return s.store.WithContext(ctx).Lookup(k)
+}
+
+func (s *service) Update(_ context.Context, k string, u UpdateFile) (File, error) {
+	f, err := s.store.Lookup(k)
+	if err != nil {
+		return f, err
+	}
+
+	now := time.Now()
+	if f.Expired(now) {
+		return File{}, ErrFileNotFound
+	}
+
+	if u.ContentType != nil {
+		if _, _, parseErr := mime.ParseMediaType(*u.ContentType); parseErr != nil {
+			return f, ErrContentTypeAssertion
+		}
+	}
+
+	if u.ExpiresIn != nil && *u.ExpiresIn < 0 {
+		return f, ErrInvalidArgument
+	}
+
+	var password string
+	if u.Password != nil {
+		if password, err = hashPassword(*u.Password); err != nil {
+			return f, err
+		}
+	}
+
+	if u.Rollback != nil {
+		if _, err = s.rollback(k, *u.Rollback); err != nil {
+			return f, err
+		}
+	}
+
+	// the fields are set on the record as it is now, the rollback and the analyzer may have changed it
+	return s.store.Update(k, func(f *File) error {
+		if f.Expired(now) {
+			return ErrFileNotFound
+		}
+
+		if u.ContentType != nil {
+			f.ContentType = *u.ContentType
+		}
+
+		if u.ExpiresIn != nil {
+			if *u.ExpiresIn == 0 {
+				f.ExpiresAt = nil
+			} else {
+				expires := now.Add(time.Duration(*u.ExpiresIn) * time.Second)
+				f.ExpiresAt = &expires
+			}
+		}
+
+		if u.Private != nil {
+			f.Private = *u.Private
+		}
+
+		if u.Password != nil {
+			f.Password = password
+		}
+
+		if u.ShortID != nil {
+			f.ShortID = *u.ShortID
+		}
+
+		return nil
+	})
+}
+
+func (s *service) Replace(ctx context.Context, rf RequestFile, expected int) (File, error) {
+	f, err := s.store.WithContext(ctx).Replace(rf.ShortID, rf, expected)
+	if err != nil {
+		return f, err
+	}
+
+	s.analyzer.Enqueue(f)
+
+	return f, nil
+}
+
+func (s *service) GetRevision(_ context.Context, k string, version int) (File, error) {
+	f, err := s.store.Revision(k, version)
+	if err != nil {
+		return f, err
+	}
+
+	if f.Expired(time.Now()) {
+		f.Close() //nolint:errcheck // read-only blob
+		return File{}, ErrFileNotFound
+	}
+
 	return f, nil
 }
 
+func (s *service) GetOriginal(_ context.Context, k string) (File, error) {
+	f, err := s.store.Original(k)
+	if err != nil {
+		return f, err
+	}
+
+	if f.Expired(time.Now()) {
+		f.Close() //nolint:errcheck // read-only blob
+		return File{}, ErrFileNotFound
+	}
+
+	return f, nil
+}
+
+func (s *service) Thumbnail(ctx context.Context, k string, opt thumbnail.Options) (File, error) {
+	f, err := s.Get(ctx, k)
+	if err != nil {
+		return f, err
+	}
+
+	// only metadata of the original is needed
+	f.Close() //nolint:errcheck // read-only blob
+
+	if !thumbnail.Supported(f.ContentType) {
+		return f, thumbnail.ErrUnsupportedFormat
+	}
+
+	opt, err = opt.Resolve(f.ContentType)
+	if err != nil {
+		return f, err
+	}
+
+	derived, err := s.store.Derived(f, opt.Key(), func(dst io.Writer, src io.Reader) error {
+		return thumbnail.Render(dst, src, opt)
+	})
+	if err != nil {
+		return f, err
+	}
+
+	derived.ContentType = opt.ContentType()
+
+	return derived, nil
+}
+
+func (s *service) Poster(ctx context.Context, k string) (File, error) {
+	f, err := s.Get(ctx, k)
+	if err != nil {
+		return f, err
+	}
+
+	f.Close() //nolint:errcheck // read-only blob
+
+	poster, err := s.store.Derived(f, posterKey, nil)
+	if err != nil {
+		return f, err
+	}
+
+	poster.ContentType = "image/jpeg"
+
+	return poster, nil
+}
+
+func (s *service) List(_ context.Context, owner string) ([]File, error) {
+	files, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	mine := files[:0]
+	for _, f := range files {
+		if f.Owner == owner && !f.Expired(now) {
+			mine = append(mine, f)
+		}
+	}
+
+	return mine, nil
+}
+
+func (s *service) Delete(_ context.Context, k string) error {
+	return s.store.Delete(k)
+}
+
+func (s *service) DeleteExpired(_ context.Context, now time.Time) ([]string, error) {
+	files, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	for _, f := range files {
+		if !f.Expired(now) {
+			continue
+		}
+
+		err = s.store.Delete(f.ShortID)
+		switch {
+		case errors.Is(err, ErrFileNotFound):
+			// removed meanwhile
+		case err != nil:
+			return deleted, err
+		default:
+			deleted = append(deleted, f.ShortID)
+		}
+	}
+
+	return deleted, nil
+}
+
+func (s *service) Link(_ context.Context, f File) (string, error) {
+	return s.store.Link(f)
+}
+
+func (s *service) Backup(_ context.Context, since uint64) (*Backup, error) {
+	return s.store.Backup(since)
+}
+
+func (s *service) Check(_ context.Context, opts CheckOptions) (Report, error) {
+	return s.store.Check(opts)
+}
+
+func (s *service) Usage(_ context.Context) (Usage, error) {
+	files, err := s.store.List()
+	if err != nil {
+		return Usage{}, err
+	}
+
+	usage := Usage{Files: len(files)}
+	for _, f := range files {
+		usage.Bytes += f.StoredSize()
+	}
+
+	return usage, nil
+}
+
+// rollback stores the content of the given version as the newest one.
+func (s *service) rollback(k string, version int) (File, error) {
+	rev, err := s.store.Revision(k, version)
+	if err != nil {
+		return rev, err
+	}
+
+	defer rev.Close()
+
+	rolled, err := s.store.Replace(k, RequestFile{
+		Name:        blobName(k, filepath.Ext(rev.Name)),
+		ShortID:     k,
+		ContentType: rev.ContentType,
+		Size:        rev.Size,
+		Reader:      rev.Reader,
+	}, 0)
+	if err != nil {
+		return rolled, err
+	}
+
+	s.analyzer.Enqueue(rolled)
+
+	return rolled, nil
+}
+
+// stripMetadata removes EXIF, GPS and XMP blocks from supported images.
+// With keepOriginal the untouched upload is stored as well, it is read again from the start.
+// The stripped content is kept in a temporary file until cleanup is called.
+func stripMetadata(rf RequestFile, keepOriginal bool) (_ RequestFile, cleanup func(), err error) {
+	cleanup = func() {}
+	if !metadata.Supported(rf.ContentType) {
+		return rf, cleanup, nil
+	}
+
+	src, ok := rf.Reader.(io.ReadSeeker)
+	if keepOriginal && !ok {
+		return rf, cleanup, ErrInvalidFile
+	}
+
+	stripped, err := os.CreateTemp("", "stripped-*")
+	if err != nil {
+		return rf, cleanup, err
+	}
+
+	cleanup = func() {
+		_ = stripped.Close()
+		_ = os.Remove(stripped.Name())
+	}
+
+	if stripErr := metadata.Strip(stripped, rf.Reader, rf.ContentType); stripErr != nil {
+		cleanup()
+		return rf, func() {}, ErrInvalidFile
+	}
+
+	size, err := stripped.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = stripped.Seek(0, io.SeekStart)
+	}
+	if err == nil && keepOriginal {
+		_, err = src.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		cleanup()
+		return rf, func() {}, err
+	}
+
+	if keepOriginal {
+		rf.Original = originalName(rf.ShortID, rf.Name)
+		rf.original = src
+	}
+
+	rf.Reader = stripped
+	rf.Size = size
+
+	return rf, cleanup, nil
+}
+
+// hashPassword returns the bcrypt hash of a password, an empty password stays empty.
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", ErrInvalidArgument
+	}
+
+	return string(hash), nil
+}
+
+// blobName returns the name of the blob stored for k, the extension is added unless k already ends with it.
+func blobName(k string, ext string) string {
+	if path.Ext(k) == ext {
+		return k
+	}
+
+	return k + ext
+}
+
 func getContentType(mp multipart.File) (*mimetype.MIME, error) {
 	defer mp.Seek(0, io.SeekStart) //nolint:errcheck // dn
 
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// shortIDPattern extracts short_id from the JSON returned by Upload with sed.
+const shortIDPattern = `s/.*"short_id":"\([^"]*\)".*/\1/p`
+
+// shareX is a ShareX custom uploader, see https://getsharex.com/docs/custom-uploader
+type shareX struct {
+	Version         string            `json:"Version"`
+	Name            string            `json:"Name"`
+	DestinationType string            `json:"DestinationType"`
+	RequestMethod   string            `json:"RequestMethod"`
+	RequestURL      string            `json:"RequestURL"`
+	Headers         map[string]string `json:"Headers"`
+	Body            string            `json:"Body"`
+	FileFormName    string            `json:"FileFormName"`
+	URL             string            `json:"URL"`
+	ThumbnailURL    string            `json:"ThumbnailURL"`
+	ErrorMessage    string            `json:"ErrorMessage"`
+}
+
+var uploadScript = template.Must(template.New("script").Parse(`#!/bin/sh
+# Uploads a file to {{.Server}} and prints the link, the link is copied to the clipboard when possible.
+# usage: upload.sh [file], stdin is uploaded when no file is given
+set -e
+
+server={{.QuotedServer}}
+auth={{.QuotedAuth}}
+
+response=$(curl -sS -X PUT -H "$auth" -F "file=@${1:--}" "$server/")
+short_id=$(printf '%s' "$response" | sed -n '{{.Pattern}}')
+
+case "$response" in
+*'"error"'*) short_id= ;;
+esac
+
+if [ -z "$short_id" ]; then
+	printf '%s\n' "$response" >&2
+	exit 1
+fi
+
+link="$server/$short_id"
+printf '%s\n' "$link"
+
+if command -v wl-copy >/dev/null 2>&1; then
+	printf '%s' "$link" | wl-copy
+elif command -v xclip >/dev/null 2>&1; then
+	printf '%s' "$link" | xclip -selection clipboard
+fi
+`))
+
+type uploader struct {
+	Server       string
+	QuotedServer string
+	QuotedAuth   string
+	Pattern      string
+}
+
+// uploaderKey returns the key the configs are generated for, it may be passed as ?key= for browser downloads.
+func (r *resource) uploaderKey(ctx *fiber.Ctx) (string, bool) {
+	key := ctx.Query("key")
+	if key == "" {
+		key = ctx.Get("authorization")
+	}
+
+	if _, ok := r.nameOf(key); !ok {
+		return "", false
+	}
+
+	return key, true
+}
+
+// ShareX returns a ready to import .sxcu file.
+func (r *resource) ShareX(ctx *fiber.Ctx) error {
+	key, ok := r.uploaderKey(ctx)
+	if !ok {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	server := ctx.BaseURL()
+	config, err := json.MarshalIndent(shareX{
+		Version:         "15.0.0",
+		Name:            ctx.Hostname(),
+		DestinationType: "ImageUploader, TextUploader, FileUploader",
+		RequestMethod:   http.MethodPut,
+		RequestURL:      server + "/",
+		Headers:         map[string]string{"Authorization": key},
+		Body:            "MultipartFormData",
+		FileFormName:    "file",
+		URL:             server + "/{json:short_id}",
+		ThumbnailURL:    server + "/{json:short_id}?w=320",
+		ErrorMessage:    "{json:error}",
+	}, "", "  ")
+	if err != nil {
+		return r.reply.InternalServerError(ctx, err)
+	}
+
+	ctx.Attachment(ctx.Hostname() + ".sxcu")
+	ctx.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSONCharsetUTF8)
+
+	return ctx.Status(http.StatusOK).Send(config)
+}
+
+// Script returns a POSIX shell script uploading a file with curl.
+func (r *resource) Script(ctx *fiber.Ctx) error {
+	key, ok := r.uploaderKey(ctx)
+	if !ok {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	ctx.Attachment("upload.sh")
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+
+	return uploadScript.Execute(ctx.Status(http.StatusOK), uploader{
+		Server:       ctx.BaseURL(),
+		QuotedServer: shellQuote(ctx.BaseURL()),
+		QuotedAuth:   shellQuote("Authorization: " + key),
+		Pattern:      shortIDPattern,
+	})
+}
+
+// Flameshot returns a single command for a hotkey: it takes a screenshot with flameshot,
+// uploads it, copies the link and shows it in a notification (dunst or any other daemon).
+func (r *resource) Flameshot(ctx *fiber.Ctx) error {
+	key, ok := r.uploaderKey(ctx)
+	if !ok {
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+
+	server := ctx.BaseURL()
+	script := fmt.Sprintf(
+		`short_id=$(flameshot gui --raw | curl -sS -X PUT -H %s -F 'file=@-;filename=screenshot.png' %s | sed -n %s)`+
+			` && [ -n "$short_id" ] && link=%s"$short_id"`+
+			` && printf '%%s' "$link" | xclip -selection clipboard`+
+			` && notify-send 'Screenshot uploaded' "$link"`,
+		shellQuote("Authorization: "+key),
+		shellQuote(server+"/"),
+		shellQuote(shortIDPattern),
+		shellQuote(server+"/"),
+	)
+
+	ctx.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+
+	return ctx.Status(http.StatusOK).SendString("sh -c " + shellQuote(script) + "\n")
+}
+
+// shellQuote quotes s as a single word for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,555 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/labi-le/server/pkg/audit"
+	"github.com/labi-le/server/pkg/log"
+	"golang.org/x/net/webdav"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// davPrefix is the path the WebDAV endpoint is mounted at.
+const davPrefix = "/dav"
+
+// WebDAVMethods are the request methods the server must accept for WebDAV besides the standard ones.
+var WebDAVMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"}
+
+// WebDAV serves the files of the caller as a WebDAV share, the password of basic auth is the API key.
+// Paths are short IDs, so a new file gets the custom URL it was created at.
+func (r *resource) WebDAV(ctx *fiber.Ctx) error {
+	_, key, _ := basicAuth(ctx)
+	name, ok := r.nameOf(key)
+	if !ok {
+		ctx.Set(fiber.HeaderWWWAuthenticate, `Basic realm="files"`)
+		return r.reply.Unauthorized(ctx, ErrInvalidKey)
+	}
+	log.SetKeyName(ctx, name)
+
+	dav := &davFS{s: r.s, owner: name, dirs: r.davDirs}
+	dav.record = func(action, target string, detail map[string]any) {
+		detail["via"] = "webdav"
+		r.record(ctx, action, target, detail)
+	}
+	dav.quota = func(size int64) error {
+		err := r.checkQuota(ctx.UserContext(), name, size)
+		if errors.Is(err, ErrQuotaExceeded) {
+			r.reject(err)
+		}
+		return err
+	}
+
+	// the handler sets the content types, every response is treated as an active document
+	isolate(ctx, "")
+
+	return adaptor.HTTPHandler(&webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: dav,
+		LockSystem: r.davLocks,
+	})(ctx)
+}
+
+// basicAuth returns the credentials of the basic Authorization header.
+func basicAuth(ctx *fiber.Ctx) (string, string, bool) {
+	req := http.Request{Header: http.Header{"Authorization": {ctx.Get(fiber.HeaderAuthorization)}}}
+
+	return req.BasicAuth()
+}
+
+// davDirs keeps empty directories created over WebDAV, other directories exist as long as there are files in them.
+type davDirs struct {
+	mu   sync.Mutex
+	dirs map[string]bool
+}
+
+func newDavDirs() *davDirs {
+	return &davDirs{dirs: make(map[string]bool)}
+}
+
+func (d *davDirs) has(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.dirs[name]
+}
+
+func (d *davDirs) add(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dirs[name] = true
+}
+
+// remove forgets name and every directory under it.
+func (d *davDirs) remove(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for dir := range d.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(d.dirs, dir)
+		}
+	}
+}
+
+// under returns the directories inside name.
+func (d *davDirs) under(name string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var dirs []string
+	for dir := range d.dirs {
+		if name == "" || strings.HasPrefix(dir, name+"/") {
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// davFS is a webdav.FileSystem over the files of a single owner.
+type davFS struct {
+	s     Service
+	owner string
+	dirs  *davDirs
+	// record adds a change to the audit log on behalf of the request being served
+	record func(action, target string, detail map[string]any)
+	// quota refuses a file of the given size past the upload quota of the owner
+	quota func(size int64) error
+}
+
+// davKey turns a WebDAV path into a short ID, the root is an empty key.
+func davKey(name string) string {
+	return strings.Trim(path.Clean("/"+name), "/")
+}
+
+// files returns the files of the owner at k and under it, ordered by short ID.
+func (d *davFS) files(ctx context.Context, k string) ([]File, error) {
+	files, err := d.s.List(ctx, d.owner)
+	if err != nil {
+		return nil, err
+	}
+
+	under := files[:0]
+	for _, f := range files {
+		if k == "" || f.ShortID == k || strings.HasPrefix(f.ShortID, k+"/") {
+			under = append(under, f)
+		}
+	}
+
+	return under, nil
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	k := davKey(name)
+	if _, err := d.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+
+	parent, err := d.Stat(ctx, path.Dir("/"+k))
+	if err != nil {
+		return err
+	}
+
+	if !parent.IsDir() {
+		return os.ErrInvalid
+	}
+
+	if !checkAvailableURL(k) {
+		return os.ErrPermission
+	}
+
+	d.dirs.add(k)
+
+	return nil
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	k := davKey(name)
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		info, err := d.Stat(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if info.IsDir() {
+			return &davDir{fs: d, ctx: ctx, info: info.(davInfo)}, nil
+		}
+
+		f, err := d.s.Get(ctx, k)
+		if err != nil {
+			return nil, os.ErrNotExist
+		}
+
+		return &davReader{File: f, info: davInfo{name: path.Base(k), file: &f}}, nil
+	}
+
+	if k == "" || !checkAvailableURL(k) {
+		return nil, os.ErrPermission
+	}
+
+	if parent, err := d.Stat(ctx, path.Dir("/"+k)); err != nil || !parent.IsDir() {
+		return nil, os.ErrNotExist
+	}
+
+	tmp, err := os.CreateTemp("", "dav-*")
+	if err != nil {
+		return nil, err
+	}
+
+	return &davWriter{File: tmp, fs: d, ctx: ctx, key: k}, nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	k := davKey(name)
+	if k == "" {
+		return os.ErrPermission
+	}
+
+	files, err := d.files(ctx, k)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 && !d.dirs.has(k) {
+		return os.ErrNotExist
+	}
+
+	for _, f := range files {
+		if !mayModify(d.owner, f) {
+			return os.ErrPermission
+		}
+
+		if err = d.s.Delete(ctx, f.ShortID); err != nil && !errors.Is(err, ErrFileNotFound) {
+			return err
+		}
+
+		if err == nil {
+			d.record(audit.ActionDelete, f.ShortID, map[string]any{})
+		}
+	}
+
+	d.dirs.remove(k)
+
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldK, newK := davKey(oldName), davKey(newName)
+	if oldK == "" || newK == "" || strings.HasPrefix(newK, oldK+"/") {
+		return os.ErrPermission
+	}
+
+	files, err := d.files(ctx, oldK)
+	if err != nil {
+		return err
+	}
+
+	if len(files) == 0 && !d.dirs.has(oldK) {
+		return os.ErrNotExist
+	}
+
+	for _, f := range files {
+		// oldK is either the file itself or a directory of files
+		short := newK + strings.TrimPrefix(f.ShortID, oldK)
+		if !mayModify(d.owner, f) || !checkAvailableURL(short) {
+			return os.ErrPermission
+		}
+
+		if _, err = d.s.Update(ctx, f.ShortID, UpdateFile{ShortID: &short}); err != nil {
+			if errors.Is(err, ErrFileExists) {
+				return os.ErrExist
+			}
+			return err
+		}
+
+		d.record(audit.ActionRename, f.ShortID, map[string]any{"short_id": short})
+	}
+
+	if d.dirs.has(oldK) {
+		d.dirs.remove(oldK)
+		d.dirs.add(newK)
+	}
+
+	return nil
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	k := davKey(name)
+	if k == "" || d.dirs.has(k) {
+		return davInfo{name: path.Base("/" + k), dir: k}, nil
+	}
+
+	files, err := d.files(ctx, k)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.ShortID == k {
+			return davInfo{name: path.Base(k), file: &f}, nil
+		}
+	}
+
+	if len(files) > 0 || len(d.dirs.under(k)) > 0 {
+		return davInfo{name: path.Base(k), dir: k}, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// davInfo describes a file or a directory, it spares webdav from reading blobs for PROPFIND.
+type davInfo struct {
+	name string
+	// file is nil for directories
+	file *File
+	// dir is the key of the directory
+	dir string
+}
+
+func (i davInfo) Name() string {
+	return i.name
+}
+
+func (i davInfo) Size() int64 {
+	if i.file == nil {
+		return 0
+	}
+
+	return i.file.Size
+}
+
+func (i davInfo) Mode() fs.FileMode {
+	if i.file == nil {
+		return fs.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+func (i davInfo) ModTime() time.Time {
+	if i.file == nil {
+		return time.Time{}
+	}
+
+	return i.file.UploadedAt
+}
+
+func (i davInfo) IsDir() bool {
+	return i.file == nil
+}
+
+func (i davInfo) Sys() any {
+	return nil
+}
+
+func (i davInfo) ContentType(_ context.Context) (string, error) {
+	if i.file == nil {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return i.file.ContentType, nil
+}
+
+func (i davInfo) ETag(_ context.Context) (string, error) {
+	if i.file == nil {
+		return "", webdav.ErrNotImplemented
+	}
+
+	return etag(i.file.CurrentVersion()), nil
+}
+
+// davReader is an opened blob.
+type davReader struct {
+	File
+	info davInfo
+}
+
+func (r *davReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.File.Reader.(io.Seeker)
+	if !ok {
+		return 0, ErrInvalidArgument
+	}
+
+	return seeker.Seek(offset, whence)
+}
+
+func (r *davReader) Readdir(_ int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (r *davReader) Stat() (fs.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *davReader) Write(_ []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+// davDir lists the files and directories directly inside a directory.
+type davDir struct {
+	fs   *davFS
+	ctx  context.Context
+	info davInfo
+	read bool
+}
+
+func (d *davDir) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+
+	files, err := d.fs.files(d.ctx, d.info.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := d.info.dir
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	children := make(map[string]fs.FileInfo)
+	for _, f := range files {
+		child, _, nested := strings.Cut(strings.TrimPrefix(f.ShortID, prefix), "/")
+		if nested {
+			children[child] = davInfo{name: child, dir: prefix + child}
+			continue
+		}
+		if _, found := children[child]; !found {
+			children[child] = davInfo{name: child, file: &f}
+		}
+	}
+
+	for _, dir := range d.fs.dirs.under(d.info.dir) {
+		child, _, _ := strings.Cut(strings.TrimPrefix(dir, prefix), "/")
+		children[child] = davInfo{name: child, dir: prefix + child}
+	}
+
+	infos := make([]fs.FileInfo, 0, len(children))
+	for _, info := range children {
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+
+	return infos, nil
+}
+
+func (d *davDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Close() error {
+	return nil
+}
+
+func (d *davDir) Read(_ []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(_ int64, _ int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(_ []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+// davWriter collects the content in a temporary file and stores it on Close,
+// a new key is added while an existing one is overwritten keeping the previous version.
+type davWriter struct {
+	*os.File
+	fs     *davFS
+	ctx    context.Context
+	key    string
+	closed bool
+}
+
+func (w *davWriter) Readdir(_ int) ([]fs.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (w *davWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+
+	info, err := w.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	contentType, err := mimetype.DetectReader(w.File)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err = w.fs.quota(info.Size()); err != nil {
+		return err
+	}
+
+	req := RequestFile{
+		Name:        blobName(w.key, contentType.Extension()),
+		ShortID:     w.key,
+		ContentType: contentType.String(),
+		Size:        info.Size(),
+		Owner:       w.fs.owner,
+		Reader:      w.File,
+	}
+
+	_, err = w.fs.s.Add(w.ctx, req)
+	if err == nil {
+		w.fs.record(audit.ActionUpload, w.key, map[string]any{"size": req.Size, "content_type": req.ContentType})
+	}
+	if !errors.Is(err, ErrFileExists) {
+		return err
+	}
+
+	allowed, err := mayOverwrite(w.ctx, w.fs.s, w.fs.owner, w.key)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return os.ErrPermission
+	}
+
+	file, err := w.fs.s.Replace(w.ctx, req, 0)
+	if err != nil {
+		return err
+	}
+
+	w.fs.record(audit.ActionReplace, w.key, map[string]any{"version": file.Version, "size": req.Size})
+
+	return nil
+}
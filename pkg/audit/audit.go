@@ -0,0 +1,218 @@
+// Package audit keeps a persistent record of the administrative and destructive actions.
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/dgraph-io/badger"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/log"
+	"io"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	// ActionUpload is an upload to a custom URL, files with a generated short ID are not recorded
+	ActionUpload  = "file.upload"
+	ActionReplace = "file.replace"
+	ActionUpdate  = "file.update"
+	ActionRename  = "file.rename"
+	ActionDelete  = "file.delete"
+	ActionBackup  = "backup.download"
+	ActionRepair  = "fsck.repair"
+	ActionRunJob  = "job.run"
+	// ActionLogLevel is a change of the log level through the admin API
+	ActionLogLevel = "log.level"
+	// ActionConfigReload is a reload of the config on SIGHUP
+	ActionConfigReload = "config.reload"
+	ActionKeyCreate    = "key.create"
+	ActionKeyRevoke    = "key.revoke"
+)
+
+// DefaultLimit and MaxLimit bound the events returned by a single List.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Event is a recorded action.
+type Event struct {
+	// ID orders the events by time and is the cursor of List
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	// Actor is the name of the key the action was taken with, or the signal or the job that triggered it
+	Actor     string         `json:"actor"`
+	IP        string         `json:"ip,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Target    string         `json:"target,omitempty"`
+	Detail    map[string]any `json:"detail,omitempty"`
+}
+
+// Request returns an event of the caller of the request.
+func Request(c *fiber.Ctx, action, target string, detail map[string]any) Event {
+	return Event{
+		Action: action,
+		Actor:  log.KeyName(c),
+		IP:     c.IP(),
+		Target: target,
+		Detail: detail,
+	}
+}
+
+// Query selects the events returned by List, empty fields match any event.
+type Query struct {
+	// Before is the ID the events are listed before, the Next of the previous page
+	Before string
+	// Limit is the number of events in a page, DefaultLimit when zero
+	Limit  int
+	Action string
+	Actor  string
+}
+
+// Page is a part of the audit log, newest events first.
+type Page struct {
+	Events []Event `json:"events"`
+	// Next is the Before of the following page, empty on the last one
+	Next string `json:"next,omitempty"`
+}
+
+// Log is the audit log kept in a badger database of its own,
+// so it survives a restore of the metadata and stays out of the backups.
+type Log struct {
+	db  *badger.DB
+	log log.Logger
+
+	mu   sync.Mutex
+	last int64
+}
+
+// Open opens the audit log in dir creating it when missing.
+func Open(dir string, logger log.Logger) (*Log, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Log{db: db, log: logger}, nil
+}
+
+// Record stores e adding its ID, time and request ID. The action has already happened,
+// so a failure is logged rather than returned. A nil Log records nothing.
+func (l *Log) Record(ctx context.Context, e Event) {
+	if l == nil {
+		return
+	}
+
+	e.Time = time.Now().UTC()
+	e.ID = l.nextID(e.Time)
+	if e.RequestID == "" {
+		e.RequestID = log.RequestID(ctx)
+	}
+
+	value, err := json.Marshal(e)
+	if err == nil {
+		err = l.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(e.ID), value)
+		})
+	}
+
+	if err != nil {
+		l.log.With(ctx, "action", e.Action, "target", e.Target).Error("can't record the audit event: ", err)
+	}
+}
+
+// nextID returns the zero padded Unix time in nanoseconds, IDs of events recorded at once are bumped.
+func (l *Log) nextID(t time.Time) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := t.UnixNano()
+	if n <= l.last {
+		n = l.last + 1
+	}
+	l.last = n
+
+	return fmt.Sprintf("%020d", n)
+}
+
+// List returns a page of the events matching q, newest first.
+func (l *Log) List(q Query) (Page, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+
+	page := Page{Events: []Event{}}
+	err := l.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// IDs are digits, 0xff sorts after all of them
+		start := []byte{0xff}
+		if q.Before != "" {
+			start = []byte(q.Before)
+		}
+
+		for it.Seek(start); it.Valid(); it.Next() {
+			if string(it.Item().Key()) == q.Before {
+				continue
+			}
+
+			var e Event
+			if err := it.Item().Value(func(v []byte) error {
+				return json.Unmarshal(v, &e)
+			}); err != nil {
+				return err
+			}
+
+			if (q.Action != "" && e.Action != q.Action) || (q.Actor != "" && e.Actor != q.Actor) {
+				continue
+			}
+
+			if len(page.Events) == q.Limit {
+				page.Next = page.Events[len(page.Events)-1].ID
+				return nil
+			}
+			page.Events = append(page.Events, e)
+		}
+
+		return nil
+	})
+
+	return page, err
+}
+
+// Export writes all the events to w as JSON lines, oldest first.
+func (l *Log) Export(w io.Writer) error {
+	return l.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := it.Item().Value(func(v []byte) error {
+				if _, err := w.Write(v); err != nil {
+					return err
+				}
+				_, err := w.Write([]byte{'\n'})
+				return err
+			}); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Close flushes the audit log to disk.
+func (l *Log) Close() error {
+	return l.db.Close()
+}
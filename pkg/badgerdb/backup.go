@@ -0,0 +1,87 @@
+package badgerdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/dgraph-io/badger/pb"
+	"io"
+)
+
+// bitDelete marks removed keys in a backup, it mirrors the unexported flag of badger.
+const bitDelete byte = 1 << 0
+
+// maxPendingWrites limits the batches kept in memory while loading a backup.
+const maxPendingWrites = 256
+
+// Backup writes the entries changed since the given version to w, see badger.DB.Backup.
+// It returns the version to pass as since to make the next incremental backup.
+func (s Store) Backup(w io.Writer, since uint64) (uint64, error) {
+	last, err := s.db.Backup(w, since)
+	if err != nil {
+		return 0, err
+	}
+
+	// nothing changed
+	if last < since {
+		return since, nil
+	}
+
+	return last + 1, nil
+}
+
+// Load applies a backup written by Backup.
+// No other writes must happen while it runs.
+func (s Store) Load(r io.Reader) error {
+	return s.db.Load(r, maxPendingWrites)
+}
+
+// ReadBackup calls fn for the latest version of every key of a backup written by Backup,
+// the value is nil for removed keys.
+func (s Store) ReadBackup(r io.Reader, fn func(k string, v []byte) error) error {
+	br := bufio.NewReader(r)
+	for {
+		// a backup is a sequence of protobuf lists each prefixed with its size
+		var size uint64
+		err := binary.Read(br, binary.LittleEndian, &size)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return err
+		}
+
+		list := &pb.KVList{}
+		if err = list.Unmarshal(buf); err != nil {
+			return err
+		}
+
+		// the versions of a key go from the newest one
+		var prev []byte
+		for _, kv := range list.Kv {
+			if prev != nil && string(prev) == string(kv.Key) {
+				continue
+			}
+			prev = kv.Key
+
+			// left by Ping, it was never a record
+			if string(kv.Key) == string(healthKey) {
+				continue
+			}
+
+			value := kv.Value
+			if len(kv.Meta) > 0 && kv.Meta[0]&bitDelete != 0 {
+				value = nil
+			}
+
+			if err = fn(string(kv.Key), value); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,8 +1,13 @@
 package badgerdb
 
 import (
+	"context"
+	"errors"
+
 	"github.com/dgraph-io/badger"
+	"go.opentelemetry.io/otel/attribute"
 
+	"github.com/labi-le/server/pkg/tracing"
 	"github.com/philippgille/gokv/encoding"
 	"github.com/philippgille/gokv/util"
 )
@@ -17,6 +22,11 @@ type Store struct {
 // Values are automatically marshalled to JSON or gob (depending on the configuration).
 // The key must not be "" and the value must not be nil.
 func (s Store) Set(k string, v interface{}) error {
+	return s.SetContext(context.Background(), k, v)
+}
+
+// SetContext is Set recording the transaction as a span under the one in ctx.
+func (s Store) SetContext(ctx context.Context, k string, v interface{}) error {
 	if err := util.CheckKeyAndValue(k, v); err != nil {
 		return err
 	}
@@ -27,7 +37,7 @@ func (s Store) Set(k string, v interface{}) error {
 		return err
 	}
 
-	err = s.db.Update(func(txn *badger.Txn) error {
+	err = s.update(ctx, "set", k, func(txn *badger.Txn) error {
 		return txn.Set([]byte(k), data)
 	})
 	if err != nil {
@@ -43,12 +53,17 @@ func (s Store) Set(k string, v interface{}) error {
 // If no value is found it returns (false, nil).
 // The key must not be "" and the pointer must not be nil.
 func (s Store) Get(k string, v interface{}) (bool, error) {
+	return s.GetContext(context.Background(), k, v)
+}
+
+// GetContext is Get recording the transaction as a span under the one in ctx.
+func (s Store) GetContext(ctx context.Context, k string, v interface{}) (bool, error) {
 	if err := util.CheckKeyAndValue(k, v); err != nil {
 		return false, err
 	}
 
 	var data []byte
-	err := s.db.View(func(txn *badger.Txn) error {
+	err := s.view(ctx, "get", k, func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(k))
 		if err != nil {
 			return err
@@ -77,21 +92,202 @@ func (s Store) Get(k string, v interface{}) (bool, error) {
 // Deleting a non-existing key-value pair does NOT lead to an error.
 // The key must not be "".
 func (s Store) Delete(k string) error {
+	return s.DeleteContext(context.Background(), k)
+}
+
+// DeleteContext is Delete recording the transaction as a span under the one in ctx.
+func (s Store) DeleteContext(ctx context.Context, k string) error {
 	if err := util.CheckKey(k); err != nil {
 		return err
 	}
 
-	return s.db.Update(func(txn *badger.Txn) error {
+	return s.update(ctx, "delete", k, func(txn *badger.Txn) error {
 		return txn.Delete([]byte(k))
 	})
 }
 
+// Move stores the given value for newK and deletes oldK in a single transaction.
+// The keys must not be "" and the value must not be nil.
+func (s Store) Move(oldK, newK string, v interface{}) error {
+	if err := util.CheckKey(oldK); err != nil {
+		return err
+	}
+	if err := util.CheckKeyAndValue(newK, v); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(txn *badger.Txn) error {
+		if err := txn.Set([]byte(newK), data); err != nil {
+			return err
+		}
+		return txn.Delete([]byte(oldK))
+	})
+}
+
+// Modify loads the value stored for k into v, calls fn and stores v in a single transaction.
+// Nothing is stored if fn fails, its error is returned. If no value is found it returns (false, nil)
+// without calling fn. A transaction that conflicts with a concurrent write is retried.
+// The key must not be "" and the pointer must not be nil.
+func (s Store) Modify(k string, v interface{}, fn func() error) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	for {
+		found := false
+		err := s.db.Update(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(k))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			found = true
+
+			data, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err = s.codec.Unmarshal(data, v); err != nil {
+				return err
+			}
+
+			if err = fn(); err != nil {
+				return err
+			}
+
+			if data, err = s.codec.Marshal(v); err != nil {
+				return err
+			}
+			return txn.Set([]byte(k), data)
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+
+		return found, err
+	}
+}
+
+// Insert stores the given value for the given key unless the key already has one, in a single transaction.
+// It returns false without storing anything when the key is taken. A transaction that conflicts
+// with a concurrent write is retried, the retry sees the value written by the other one.
+// The key must not be "" and the value must not be nil.
+func (s Store) Insert(k string, v interface{}) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	for {
+		inserted := false
+		err = s.db.Update(func(txn *badger.Txn) error {
+			_, err := txn.Get([]byte(k))
+			if err == nil {
+				return nil
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+
+			inserted = true
+			return txn.Set([]byte(k), data)
+		})
+		if err == badger.ErrConflict {
+			continue
+		}
+
+		return inserted && err == nil, err
+	}
+}
+
+// Keys returns the keys starting with the given prefix in lexicographical order.
+// An empty prefix returns all keys.
+func (s Store) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		p := []byte(prefix)
+		for it.Seek(p); it.ValidForPrefix(p); it.Next() {
+			keys = append(keys, string(it.Item().KeyCopy(nil)))
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+// healthKey is deleted by Ping, it is never set.
+var healthKey = []byte("\x00health")
+
+// Ping commits a write to make sure the database is open and accepts writes, nothing is left behind.
+func (s Store) Ping(ctx context.Context) error {
+	return s.update(ctx, "ping", string(healthKey), func(txn *badger.Txn) error {
+		return txn.Delete(healthKey)
+	})
+}
+
+// update runs fn in a read-write transaction traced as op on k.
+func (s Store) update(ctx context.Context, op, k string, fn func(txn *badger.Txn) error) error {
+	_, span := tracing.Start(ctx, "badger.Update", attribute.String("db.operation", op), attribute.String("db.key", k))
+	err := s.db.Update(fn)
+	tracing.End(span, err)
+
+	return err
+}
+
+// view runs fn in a read-only transaction traced as op on k, a missing key is not an error of the span.
+func (s Store) view(ctx context.Context, op, k string, fn func(txn *badger.Txn) error) error {
+	_, span := tracing.Start(ctx, "badger.View", attribute.String("db.operation", op), attribute.String("db.key", k))
+	err := s.db.View(fn)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		span.SetAttributes(attribute.Bool("db.found", false))
+		tracing.End(span, nil)
+	} else {
+		tracing.End(span, err)
+	}
+
+	return err
+}
+
 // Close closes the store.
 // It must be called to make sure that all pending updates make their way to disk.
 func (s Store) Close() error {
 	return s.db.Close()
 }
 
+// CollectGarbage rewrites the value log files holding at least discardRatio of stale data
+// until none is left, see badger.DB.RunValueLogGC.
+func (s Store) CollectGarbage(discardRatio float64) error {
+	for {
+		err := s.db.RunValueLogGC(discardRatio)
+		if errors.Is(err, badger.ErrNoRewrite) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Size returns the size of the LSM tree and the value log files in bytes.
+// badger updates it once a minute.
+func (s Store) Size() (lsm, vlog int64) {
+	return s.db.Size()
+}
+
 // Options are the options for the BadgerDB store.
 type Options struct {
 	// Directory for storing the DB files.
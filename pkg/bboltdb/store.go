@@ -0,0 +1,250 @@
+package bboltdb
+
+import (
+	"bytes"
+	"github.com/philippgille/gokv/encoding"
+	"github.com/philippgille/gokv/util"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+// Store is a gokv.Store implementation for bbolt.
+type Store struct {
+	db         *bolt.DB
+	bucketName []byte
+	codec      encoding.Codec
+}
+
+// Set stores the given value for the given key.
+// Values are automatically marshalled to JSON or gob (depending on the configuration).
+// The key must not be "" and the value must not be nil.
+func (s Store) Set(k string, v interface{}) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	// First turn the passed object into something that bbolt can handle
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucketName).Put([]byte(k), data)
+	})
+}
+
+// Get retrieves the stored value for the given key.
+// You need to pass a pointer to the value, so in case of a struct
+// the automatic unmarshalling can populate the fields of the object
+// that v points to with the values of the retrieved object's values.
+// If no value is found it returns (false, nil).
+// The key must not be "" and the pointer must not be nil.
+func (s Store) Get(k string, v interface{}) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// the value is only valid within the transaction
+		if value := tx.Bucket(s.bucketName).Get([]byte(k)); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	// If no value was found return false
+	if data == nil {
+		return false, nil
+	}
+
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Delete deletes the stored value for the given key.
+// Deleting a non-existing key-value pair does NOT lead to an error.
+// The key must not be "".
+func (s Store) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucketName).Delete([]byte(k))
+	})
+}
+
+// Move stores the given value for newK and deletes oldK in a single transaction.
+// The keys must not be "" and the value must not be nil.
+func (s Store) Move(oldK, newK string, v interface{}) error {
+	if err := util.CheckKey(oldK); err != nil {
+		return err
+	}
+	if err := util.CheckKeyAndValue(newK, v); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucketName)
+		if err := b.Put([]byte(newK), data); err != nil {
+			return err
+		}
+		return b.Delete([]byte(oldK))
+	})
+}
+
+// Modify loads the value stored for k into v, calls fn and stores v in a single transaction.
+// Nothing is stored if fn fails, its error is returned. If no value is found it returns (false, nil)
+// without calling fn. The key must not be "" and the pointer must not be nil.
+func (s Store) Modify(k string, v interface{}, fn func() error) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucketName)
+		value := b.Get([]byte(k))
+		if value == nil {
+			return nil
+		}
+		found = true
+
+		if err := s.codec.Unmarshal(value, v); err != nil {
+			return err
+		}
+
+		if err := fn(); err != nil {
+			return err
+		}
+
+		data, err := s.codec.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(k), data)
+	})
+
+	return found, err
+}
+
+// Insert stores the given value for the given key unless the key already has one, in a single transaction.
+// It returns false without storing anything when the key is taken.
+// The key must not be "" and the value must not be nil.
+func (s Store) Insert(k string, v interface{}) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	inserted := false
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucketName)
+		if b.Get([]byte(k)) != nil {
+			return nil
+		}
+
+		inserted = true
+		return b.Put([]byte(k), data)
+	})
+
+	return inserted && err == nil, err
+}
+
+// Keys returns the keys starting with the given prefix in lexicographical order.
+// An empty prefix returns all keys.
+func (s Store) Keys(prefix string) ([]string, error) {
+	var keys []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucketName).Cursor()
+
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+// Close closes the store.
+// It must be called to make sure that all open transactions finish and to release all DB resources.
+func (s Store) Close() error {
+	return s.db.Close()
+}
+
+// Options are the options for the bbolt store.
+type Options struct {
+	// Bucket name for storing the key-value pairs.
+	// Optional ("default" by default).
+	BucketName string
+	// Path of the DB file.
+	// Optional ("bbolt.db" by default).
+	Path string
+	// Encoding format.
+	// Optional (encoding.JSON by default).
+	Codec encoding.Codec
+}
+
+// DefaultOptions is an Options object with default values.
+// BucketName: "default", Path: "bbolt.db", Codec: encoding.JSON
+var DefaultOptions = Options{
+	BucketName: "default",
+	Path:       "bbolt.db",
+	Codec:      encoding.JSON,
+}
+
+// NewStore creates a new bbolt store.
+// Note: bbolt uses an exclusive write lock on the database file so it cannot be shared by multiple processes.
+// Opening it waits for the lock for a second and fails afterwards.
+//
+// You must call the Close() method on the store when you're done working with it.
+func NewStore(options Options) (Store, error) {
+	result := Store{}
+
+	// Set default values
+	if options.BucketName == "" {
+		options.BucketName = DefaultOptions.BucketName
+	}
+	if options.Path == "" {
+		options.Path = DefaultOptions.Path
+	}
+	if options.Codec == nil {
+		options.Codec = DefaultOptions.Codec
+	}
+
+	// Open the bbolt database file, it will be created if it doesn't exist.
+	db, err := bolt.Open(options.Path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return result, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, createErr := tx.CreateBucketIfNotExists([]byte(options.BucketName))
+		return createErr
+	})
+	if err != nil {
+		db.Close()
+		return result, err
+	}
+
+	result.db = db
+	result.bucketName = []byte(options.BucketName)
+	result.codec = options.Codec
+
+	return result, nil
+}
@@ -2,10 +2,22 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/health"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/tracing"
 	"github.com/sethvargo/go-envconfig"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
 )
 
+var ErrInvalid = errors.New("invalid config")
+
 type Config interface {
 	GetServerConn() string
 	GetLogLevel() string
@@ -15,30 +27,210 @@ type Config interface {
 	GetEnableHTTPS() bool
 	GetMaxUploadSize() int
 	GetDiscordLink() string
+	GetStripMetadata() bool
+	// GetRateLimit is the number of requests a client IP may make per minute, zero for no limit
+	GetRateLimit() int
+	// GetUploadQuota is the number of bytes the files of a key other than OWNER_KEY may take, zero for no limit
+	GetUploadQuota() int64
+	GetMediaWorkers() int
+	GetFFprobePath() string
+	GetFFmpegPath() string
+	GetStorageDriver() string
+	GetS3Options() filesystem.S3Options
+	GetS3Redirect() bool
+	GetS3APIBucket() string
+	GetMetadataDriver() string
+	GetMetadataPath() string
+	GetAuditPath() string
+	GetKeysPath() string
+	GetShutdownTimeout() time.Duration
+	GetParallelGoroutines() int
+	JobIsEnabled(name string) bool
+	GetJobSchedule(name string) string
+	// GetScrubRepair is the repair applied by the scrub job: "", "quarantine" or "delete"
+	GetScrubRepair() string
+	GetScrubChecksums() bool
+	GetTracingOptions() tracing.Options
+	GetHealthOptions() health.Options
+	GetTLSCacheDir() string
+	GetAccessLogOptions() log.MiddlewareOptions
+	GetLogOptions() log.Options
 }
 
+// Names of the background jobs.
+const (
+	JobValueLogGC = "value-log-gc"
+	// JobReapExpired deletes the files past their expiry date
+	JobReapExpired = "reap-expired"
+	// JobScrub compares the records with the blobs like the fsck command
+	JobScrub = "scrub"
+)
+
+// config is read from the environment and the config file, see Load.
+// Fields tagged reload are applied by Live.Reload, the others take a restart.
 type config struct {
-	ServerHost string `env:"SERVER_HOST, required"`
-	ServerPort int    `env:"SERVER_PORT, required"`
+	ServerHost string `env:"SERVER_HOST, default=0.0.0.0"`
+	ServerPort int    `env:"SERVER_PORT, default=8000"`
+
+	LogLevel         string   `env:"LOG_LEVEL, default=info" reload:"true"`
+	WhiteListDomains []string `env:"WHITE_LIST_DOMAINS"`
+	VirtualFSPath    string   `env:"VIRTUAL_FS_PATH, default=files"`
+	OwnerKey         string   `env:"OWNER_KEY"`
+	EnableHTTPS      bool     `env:"ENABLE_HTTPS, default=false"`
+	MaxUploadSize    int      `env:"MAX_UPLOAD_SIZE, default=10737418240"`
+	StripMetadata    bool     `env:"STRIP_METADATA, default=true" reload:"true"`
+
+	RateLimit   int   `env:"RATE_LIMIT, default=0" reload:"true"`
+	UploadQuota int64 `env:"UPLOAD_QUOTA, default=0" reload:"true"`
+
+	// LogBodies adds the beginning of request bodies to the access log
+	LogBodies bool `env:"LOG_BODIES, default=false" reload:"true"`
+	// LogRedactAuthorization hides API keys sent in the Authorization header from the access log
+	LogRedactAuthorization bool `env:"LOG_REDACT_AUTHORIZATION, default=true" reload:"true"`
+
+	// LogFormat is either "json" or "console"
+	LogFormat string `env:"LOG_FORMAT, default=json"`
+	// LogOutput is "stdout", "stderr" or the path of a file rotated by size and age
+	LogOutput         string        `env:"LOG_OUTPUT, default=stderr"`
+	LogMaxSize        int64         `env:"LOG_MAX_SIZE, default=104857600"`
+	LogRotateInterval time.Duration `env:"LOG_ROTATE_INTERVAL, default=24h"`
+	LogMaxBackups     int           `env:"LOG_MAX_BACKUPS, default=7"`
+
+	MediaWorkers int    `env:"MEDIA_WORKERS, default=2"`
+	FFprobePath  string `env:"FFPROBE_PATH, default=ffprobe"`
+	FFmpegPath   string `env:"FFMPEG_PATH, default=ffmpeg"`
+
+	// DiscordLink is where /discord redirects to, the page is not found without it
+	DiscordLink string `env:"DISCORD_LINK" reload:"true"`
+
+	// StorageDriver is either "fs" for VIRTUAL_FS_PATH or "s3"
+	StorageDriver string        `env:"STORAGE_DRIVER, default=fs"`
+	S3Endpoint    string        `env:"S3_ENDPOINT"`
+	S3Region      string        `env:"S3_REGION"`
+	S3Bucket      string        `env:"S3_BUCKET"`
+	S3AccessKey   string        `env:"S3_ACCESS_KEY"`
+	S3SecretKey   string        `env:"S3_SECRET_KEY"`
+	S3Prefix      string        `env:"S3_PREFIX"`
+	S3UseSSL      bool          `env:"S3_USE_SSL, default=true"`
+	S3Redirect    bool          `env:"S3_REDIRECT, default=false" reload:"true"`
+	S3PresignTTL  time.Duration `env:"S3_PRESIGN_TTL, default=15m"`
+
+	// S3APIBucket is the bucket name the files are served under by the S3 API
+	S3APIBucket string `env:"S3_API_BUCKET, default=files"`
+
+	// MetadataDriver is the key-value store of file records: "badger", "sqlite" or "bbolt"
+	MetadataDriver string `env:"METADATA_DRIVER, default=badger"`
+	// MetadataPath is a directory for badger and a file for the others, empty for the default of the driver
+	MetadataPath string `env:"METADATA_PATH"`
+
+	// AuditPath is the badger directory of the audit log
+	AuditPath string `env:"AUDIT_PATH, default=audit"`
 
-	LogLevel         string   `env:"LOG_LEVEL, required"`
-	WhiteListDomains []string `env:"WHITE_LIST_DOMAINS, required"`
-	VirtualFSPath    string   `env:"VIRTUAL_FS_PATH, required"`
-	OwnerKey         string   `env:"OWNER_KEY, required"`
-	EnableHTTPS      bool     `env:"ENABLE_HTTPS, required"`
-	MaxUploadSize    int      `env:"MAX_UPLOAD_SIZE, required"`
+	// KeysPath is the JSON file of the API keys added besides OWNER_KEY
+	KeysPath string `env:"KEYS_PATH, default=keys.json"`
 
-	DiscordLink string `env:"DISCORD_LINK, required"`
+	// ShutdownTimeout is how long in-flight requests may take to finish after SIGINT or SIGTERM
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT, default=30s"`
+
+	// ParallelGoroutines is the number of background jobs allowed to run at the same time
+	ParallelGoroutines int `env:"JOBS_PARALLEL_GOROUTINES, default=2"`
+
+	// schedules are described in scheduler.Parse
+	ValueLogGCEnabled  bool   `env:"JOB_VALUE_LOG_GC_ENABLED, default=true"`
+	ValueLogGCSchedule string `env:"JOB_VALUE_LOG_GC_SCHEDULE, default=@every 10m"`
+
+	ReapExpiredEnabled  bool   `env:"JOB_REAP_EXPIRED_ENABLED, default=true"`
+	ReapExpiredSchedule string `env:"JOB_REAP_EXPIRED_SCHEDULE, default=@every 1h"`
+
+	ScrubEnabled  bool   `env:"JOB_SCRUB_ENABLED, default=true"`
+	ScrubSchedule string `env:"JOB_SCRUB_SCHEDULE, default=@daily"`
+	// ScrubRepair is empty to only report the problems, quarantine or delete to repair them
+	ScrubRepair string `env:"JOB_SCRUB_REPAIR"`
+	// ScrubChecksums reads every blob on each run
+	ScrubChecksums bool `env:"JOB_SCRUB_CHECKSUMS, default=false"`
+
+	// TracingEndpoint is the URL of an OTLP/HTTP collector, spans are not exported without it
+	TracingEndpoint    string  `env:"TRACING_ENDPOINT"`
+	TracingServiceName string  `env:"TRACING_SERVICE_NAME, default=server"`
+	TracingSampleRatio float64 `env:"TRACING_SAMPLE_RATIO, default=1"`
+
+	// TLSCacheDir keeps the certificates obtained for WHITE_LIST_DOMAINS, empty for the directory of autocert.NewListener
+	TLSCacheDir string `env:"TLS_CACHE_DIR"`
+
+	HealthCheckTimeout time.Duration `env:"HEALTH_CHECK_TIMEOUT, default=5s"`
+	// the storage is not ready when the free space is below either of the thresholds
+	HealthMinFreeBytes   uint64  `env:"HEALTH_MIN_FREE_BYTES, default=1073741824"`
+	HealthMinFreePercent float64 `env:"HEALTH_MIN_FREE_PERCENT, default=5"`
+	// HealthCertMinValidity is the time left to a certificate below which the server is not ready
+	HealthCertMinValidity time.Duration `env:"HEALTH_CERT_MIN_VALIDITY, default=168h"`
 }
 
 func NewFromENV(ctx context.Context) (Config, error) {
+	return Load(ctx, "")
+}
+
+// Load reads the config from the environment over the YAML or TOML file, when given, over the defaults.
+// Every invalid field is listed in the returned error.
+func Load(ctx context.Context, file string) (Config, error) {
+	return load(ctx, file)
+}
+
+func load(ctx context.Context, file string) (*config, error) {
+	lookuper := envconfig.OsLookuper()
+	var errs []error
+	if file != "" {
+		values, problems, err := readFile(file)
+		if err != nil {
+			return nil, err
+		}
+		// the environment takes precedence over the file
+		lookuper = envconfig.MultiLookuper(lookuper, envconfig.MapLookuper(values))
+		errs = problems
+	}
+
 	c := &config{}
-	if err := envconfig.Process(ctx, c); err != nil {
-		return c, err
+	failed, processErrs := c.process(ctx, lookuper)
+	errs = append(errs, processErrs...)
+	errs = append(errs, c.validate(failed)...)
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w:\n%w", ErrInvalid, errors.Join(errs...))
 	}
+
 	return c, nil
 }
 
+// process reads the fields one by one to report all the values that can't be parsed,
+// the variables of these are returned in failed.
+func (c *config) process(ctx context.Context, lookuper envconfig.Lookuper) (failed map[string]bool, errs []error) {
+	v := reflect.ValueOf(c).Elem()
+
+	failed = make(map[string]bool)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		single := reflect.New(reflect.StructOf([]reflect.StructField{field}))
+		if err := envconfig.ProcessWith(ctx, single.Interface(), lookuper); err != nil {
+			// envconfig names the Go field, the variable is what the user sets
+			if inner := errors.Unwrap(err); inner != nil {
+				err = inner
+			}
+			failed[envName(field)] = true
+			errs = append(errs, fmt.Errorf("%s: %w", envName(field), err))
+			continue
+		}
+
+		v.Field(i).Set(single.Elem().Field(0))
+	}
+
+	return failed, errs
+}
+
+// envName returns the variable a field is read from.
+func envName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("env"), ",")
+	return name
+}
+
 func (c *config) GetServerConn() string {
 	return fmt.Sprintf("%s:%d", c.ServerHost, c.ServerPort)
 }
@@ -70,3 +262,162 @@ func (c *config) GetMaxUploadSize() int {
 func (c *config) GetDiscordLink() string {
 	return c.DiscordLink
 }
+
+func (c *config) GetStripMetadata() bool {
+	return c.StripMetadata
+}
+
+func (c *config) GetRateLimit() int {
+	return c.RateLimit
+}
+
+func (c *config) GetUploadQuota() int64 {
+	return c.UploadQuota
+}
+
+func (c *config) GetMediaWorkers() int {
+	return c.MediaWorkers
+}
+
+func (c *config) GetFFprobePath() string {
+	return c.FFprobePath
+}
+
+func (c *config) GetFFmpegPath() string {
+	return c.FFmpegPath
+}
+
+func (c *config) GetStorageDriver() string {
+	return c.StorageDriver
+}
+
+func (c *config) GetS3Options() filesystem.S3Options {
+	return filesystem.S3Options{
+		Endpoint:   c.S3Endpoint,
+		Region:     c.S3Region,
+		Bucket:     c.S3Bucket,
+		AccessKey:  c.S3AccessKey,
+		SecretKey:  c.S3SecretKey,
+		Prefix:     c.S3Prefix,
+		UseSSL:     c.S3UseSSL,
+		PresignTTL: c.S3PresignTTL,
+	}
+}
+
+func (c *config) GetS3Redirect() bool {
+	return c.S3Redirect
+}
+
+func (c *config) GetS3APIBucket() string {
+	return c.S3APIBucket
+}
+
+func (c *config) GetMetadataDriver() string {
+	return c.MetadataDriver
+}
+
+func (c *config) GetMetadataPath() string {
+	return c.MetadataPath
+}
+
+func (c *config) GetAuditPath() string {
+	return c.AuditPath
+}
+
+func (c *config) GetKeysPath() string {
+	return c.KeysPath
+}
+
+func (c *config) GetShutdownTimeout() time.Duration {
+	return c.ShutdownTimeout
+}
+
+func (c *config) GetParallelGoroutines() int {
+	return c.ParallelGoroutines
+}
+
+// JobIsEnabled reports whether the named job runs on its schedule.
+func (c *config) JobIsEnabled(name string) bool {
+	switch name {
+	case JobValueLogGC:
+		return c.ValueLogGCEnabled
+	case JobReapExpired:
+		return c.ReapExpiredEnabled
+	case JobScrub:
+		return c.ScrubEnabled
+	default:
+		return false
+	}
+}
+
+// GetJobSchedule returns the schedule of the named job.
+func (c *config) GetJobSchedule(name string) string {
+	switch name {
+	case JobValueLogGC:
+		return c.ValueLogGCSchedule
+	case JobReapExpired:
+		return c.ReapExpiredSchedule
+	case JobScrub:
+		return c.ScrubSchedule
+	default:
+		return ""
+	}
+}
+
+func (c *config) GetScrubRepair() string {
+	return c.ScrubRepair
+}
+
+func (c *config) GetScrubChecksums() bool {
+	return c.ScrubChecksums
+}
+
+func (c *config) GetTracingOptions() tracing.Options {
+	return tracing.Options{
+		Endpoint:    c.TracingEndpoint,
+		ServiceName: c.TracingServiceName,
+		SampleRatio: c.TracingSampleRatio,
+	}
+}
+
+func (c *config) GetHealthOptions() health.Options {
+	return health.Options{
+		Timeout:         c.HealthCheckTimeout,
+		MinFreeBytes:    c.HealthMinFreeBytes,
+		MinFreePercent:  c.HealthMinFreePercent,
+		CertMinValidity: c.HealthCertMinValidity,
+	}
+}
+
+func (c *config) GetTLSCacheDir() string {
+	if c.TLSCacheDir != "" {
+		return c.TLSCacheDir
+	}
+
+	// the same place autocert.NewListener uses on Linux
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = "/.cache"
+	}
+
+	return filepath.Join(dir, "golang-autocert")
+}
+
+func (c *config) GetAccessLogOptions() log.MiddlewareOptions {
+	return log.MiddlewareOptions{
+		LogBodies:           c.LogBodies,
+		RedactAuthorization: c.LogRedactAuthorization,
+	}
+}
+
+func (c *config) GetLogOptions() log.Options {
+	return log.Options{
+		Format: c.LogFormat,
+		Output: c.LogOutput,
+		Rotate: log.RotateOptions{
+			MaxSize:    c.LogMaxSize,
+			Interval:   c.LogRotateInterval,
+			MaxBackups: c.LogMaxBackups,
+		},
+	}
+}
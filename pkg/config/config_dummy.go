@@ -1,30 +1,149 @@
 package config
 
+import (
+	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/health"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/tracing"
+	"time"
+)
+
+// DummyConfig is a Config with fixed values for code that needs one without the environment.
 type DummyConfig struct {
 }
 
+var _ Config = DummyConfig{}
+
 const dummy = "dummy"
 
-func (d DummyConfig) GetBillingToken() string {
+func (d DummyConfig) GetServerConn() string {
+	return "127.0.0.1:8000"
+}
+
+func (d DummyConfig) GetLogLevel() string {
+	return "info"
+}
+
+func (d DummyConfig) GetWhiteListDomains() []string {
+	return nil
+}
+
+func (d DummyConfig) GetVirtualFSPath() string {
 	return dummy
 }
 
-func (d DummyConfig) GetDBConn() string {
+func (d DummyConfig) GetOwnerKey() string {
 	return dummy
 }
 
-func (d DummyConfig) GetServerConn() string {
+func (d DummyConfig) GetEnableHTTPS() bool {
+	return false
+}
+
+func (d DummyConfig) GetMaxUploadSize() int {
+	return 100 << 20
+}
+
+func (d DummyConfig) GetDiscordLink() string {
+	return ""
+}
+
+func (d DummyConfig) GetStripMetadata() bool {
+	return true
+}
+
+func (d DummyConfig) GetRateLimit() int {
+	return 0
+}
+
+func (d DummyConfig) GetUploadQuota() int64 {
+	return 0
+}
+
+func (d DummyConfig) GetMediaWorkers() int {
+	return 0
+}
+
+func (d DummyConfig) GetFFprobePath() string {
+	return "ffprobe"
+}
+
+func (d DummyConfig) GetFFmpegPath() string {
+	return "ffmpeg"
+}
+
+func (d DummyConfig) GetStorageDriver() string {
+	return "fs"
+}
+
+func (d DummyConfig) GetS3Options() filesystem.S3Options {
+	return filesystem.S3Options{}
+}
+
+func (d DummyConfig) GetS3Redirect() bool {
+	return false
+}
+
+func (d DummyConfig) GetS3APIBucket() string {
+	return dummy
+}
+
+func (d DummyConfig) GetMetadataDriver() string {
+	return "badger"
+}
+
+func (d DummyConfig) GetMetadataPath() string {
 	return dummy
 }
 
+func (d DummyConfig) GetAuditPath() string {
+	return dummy
+}
+
+func (d DummyConfig) GetKeysPath() string {
+	return dummy
+}
+
+func (d DummyConfig) GetShutdownTimeout() time.Duration {
+	return time.Second
+}
+
 func (d DummyConfig) GetParallelGoroutines() int {
 	return 1
 }
 
-func (d DummyConfig) GetEndpoint() string {
+func (d DummyConfig) JobIsEnabled(string) bool {
+	return false
+}
+
+func (d DummyConfig) GetJobSchedule(string) string {
+	return ""
+}
+
+func (d DummyConfig) GetScrubRepair() string {
+	return ""
+}
+
+func (d DummyConfig) GetScrubChecksums() bool {
+	return false
+}
+
+func (d DummyConfig) GetTracingOptions() tracing.Options {
+	return tracing.Options{ServiceName: dummy}
+}
+
+func (d DummyConfig) GetHealthOptions() health.Options {
+	return health.Options{Timeout: time.Second}
+}
+
+func (d DummyConfig) GetTLSCacheDir() string {
 	return dummy
 }
 
-func (d DummyConfig) JobIsEnabled() bool {
-	return true
+func (d DummyConfig) GetAccessLogOptions() log.MiddlewareOptions {
+	return log.MiddlewareOptions{RedactAuthorization: true}
+}
+
+func (d DummyConfig) GetLogOptions() log.Options {
+	return log.Options{Format: log.FormatJSON, Output: log.OutputStderr}
 }
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownFileFormat = errors.New("config file must be .yaml, .yml or .toml")
+	ErrUnknownField      = errors.New("unknown field")
+)
+
+// readFile returns the values of a YAML or TOML config file by the name of their environment variable.
+// Keys are the variable names in any case, nested tables are joined with an underscore, so
+//
+//	s3:
+//	  bucket: files
+//
+// sets S3_BUCKET. Lists are joined with commas as in the environment.
+// The fields that can't be used are returned in problems, err is set when the file can't be read.
+func readFile(path string) (values map[string]string, problems []error, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, nil, ErrUnknownFileFormat
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values = make(map[string]string)
+	flatten("", doc, values, &problems)
+
+	known := knownNames()
+	for name := range values {
+		if !known[name] {
+			problems = append(problems, fmt.Errorf("%s: %w in %s", name, ErrUnknownField, path))
+		}
+	}
+
+	// the order of a map is random
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Error() < problems[j].Error() })
+
+	return values, problems, nil
+}
+
+func flatten(prefix string, doc map[string]any, values map[string]string, errs *[]error) {
+	for key, value := range doc {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if prefix != "" {
+			name = prefix + "_" + name
+		}
+
+		if table, ok := value.(map[string]any); ok {
+			flatten(name, table, values, errs)
+			continue
+		}
+
+		s, err := scalar(value)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		values[name] = s
+	}
+}
+
+// scalar formats a value of the file as it is written in the environment.
+func scalar(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case []any:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		return "", errors.New("tables are not allowed in lists")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// knownNames returns the variables of all the fields.
+func knownNames() map[string]bool {
+	t := reflect.TypeOf(config{})
+	names := make(map[string]bool, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names[envName(t.Field(i))] = true
+	}
+
+	return names
+}
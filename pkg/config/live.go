@@ -0,0 +1,71 @@
+package config
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// Live is the config in effect while the server runs, Reload replaces the fields tagged reload.
+type Live struct {
+	file string
+
+	// mu serializes the reloads
+	mu      sync.Mutex
+	current atomic.Pointer[config]
+}
+
+// NewLive loads the config as Load does and keeps the file to read it again on Reload.
+func NewLive(ctx context.Context, file string) (*Live, error) {
+	c, err := load(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Live{file: file}
+	l.current.Store(c)
+
+	return l, nil
+}
+
+// Config returns the config in effect, the reloadable fields are to be read from it on every use.
+func (l *Live) Config() Config {
+	return l.current.Load()
+}
+
+// Reload reads the file and the environment again and applies the changed fields tagged reload,
+// the variables of these are returned in applied. The other changes wait for a restart,
+// their variables are returned in restart. Nothing changes when the new config is invalid.
+func (l *Live) Reload(ctx context.Context) (applied, restart []string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next, err := load(ctx, l.file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current := l.current.Load()
+	merged := *current
+
+	cur, nxt, mrg := reflect.ValueOf(current).Elem(), reflect.ValueOf(next).Elem(), reflect.ValueOf(&merged).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		if reflect.DeepEqual(cur.Field(i).Interface(), nxt.Field(i).Interface()) {
+			continue
+		}
+
+		field := cur.Type().Field(i)
+		if field.Tag.Get("reload") != "true" {
+			restart = append(restart, envName(field))
+			continue
+		}
+
+		mrg.Field(i).Set(nxt.Field(i))
+		applied = append(applied, envName(field))
+	}
+
+	l.current.Store(&merged)
+
+	return applied, restart, nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"fmt"
+	"github.com/labi-le/server/pkg/log"
+	"github.com/labi-le/server/pkg/scheduler"
+	"go.uber.org/zap/zapcore"
+	"net/url"
+)
+
+// validate checks the values that parsed but can't work, every problem is returned.
+// The fields that failed to parse are already reported and skipped.
+func (c *config) validate(failed map[string]bool) []error {
+	var errs []error
+	fail := func(name, format string, args ...any) {
+		if !failed[name] {
+			errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, args...)))
+		}
+	}
+
+	if c.ServerPort < 1 || c.ServerPort > 65535 {
+		fail("SERVER_PORT", "%d is not a port", c.ServerPort)
+	}
+
+	if c.OwnerKey == "" {
+		fail("OWNER_KEY", "must be set")
+	}
+
+	if c.LogLevel != "disable" {
+		if _, err := zapcore.ParseLevel(c.LogLevel); err != nil {
+			fail("LOG_LEVEL", "unknown level %q", c.LogLevel)
+		}
+	}
+
+	if c.LogFormat != log.FormatJSON && c.LogFormat != log.FormatConsole {
+		fail("LOG_FORMAT", "must be %s or %s", log.FormatJSON, log.FormatConsole)
+	}
+
+	if c.LogMaxSize < 0 {
+		fail("LOG_MAX_SIZE", "must not be negative")
+	}
+
+	if c.LogRotateInterval < 0 {
+		fail("LOG_ROTATE_INTERVAL", "must not be negative")
+	}
+
+	if c.LogMaxBackups < 0 {
+		fail("LOG_MAX_BACKUPS", "must not be negative")
+	}
+
+	if c.EnableHTTPS && len(c.WhiteListDomains) == 0 {
+		fail("WHITE_LIST_DOMAINS", "certificates are obtained for these domains, must be set with ENABLE_HTTPS")
+	}
+
+	if c.MaxUploadSize <= 0 {
+		fail("MAX_UPLOAD_SIZE", "must be positive")
+	}
+
+	if c.RateLimit < 0 {
+		fail("RATE_LIMIT", "must not be negative")
+	}
+
+	if c.UploadQuota < 0 {
+		fail("UPLOAD_QUOTA", "must not be negative")
+	}
+
+	if c.DiscordLink != "" {
+		if u, err := url.Parse(c.DiscordLink); err != nil || u.Scheme == "" || u.Host == "" {
+			fail("DISCORD_LINK", "%q is not an absolute URL", c.DiscordLink)
+		}
+	}
+
+	if c.MediaWorkers < 0 {
+		fail("MEDIA_WORKERS", "must not be negative")
+	}
+
+	switch c.StorageDriver {
+	case "fs":
+		if c.VirtualFSPath == "" {
+			fail("VIRTUAL_FS_PATH", "must be set for the fs storage driver")
+		}
+	case "s3":
+		if c.S3Endpoint == "" {
+			fail("S3_ENDPOINT", "must be set for the s3 storage driver")
+		}
+		if c.S3Bucket == "" {
+			fail("S3_BUCKET", "must be set for the s3 storage driver")
+		}
+	default:
+		fail("STORAGE_DRIVER", "unknown driver %q, must be fs or s3", c.StorageDriver)
+	}
+
+	switch c.MetadataDriver {
+	case "badger", "sqlite", "bbolt":
+	default:
+		fail("METADATA_DRIVER", "unknown driver %q, must be badger, sqlite or bbolt", c.MetadataDriver)
+	}
+
+	if c.AuditPath == "" {
+		fail("AUDIT_PATH", "must be set")
+	}
+
+	if c.KeysPath == "" {
+		fail("KEYS_PATH", "must be set")
+	}
+
+	if c.ShutdownTimeout <= 0 {
+		fail("SHUTDOWN_TIMEOUT", "must be positive")
+	}
+
+	if c.ParallelGoroutines < 1 {
+		fail("JOBS_PARALLEL_GOROUTINES", "must be at least 1")
+	}
+
+	if _, err := scheduler.Parse(c.ValueLogGCSchedule); err != nil {
+		fail("JOB_VALUE_LOG_GC_SCHEDULE", "%s", err)
+	}
+
+	if _, err := scheduler.Parse(c.ReapExpiredSchedule); err != nil {
+		fail("JOB_REAP_EXPIRED_SCHEDULE", "%s", err)
+	}
+
+	if _, err := scheduler.Parse(c.ScrubSchedule); err != nil {
+		fail("JOB_SCRUB_SCHEDULE", "%s", err)
+	}
+
+	switch c.ScrubRepair {
+	case "", "quarantine", "delete":
+	default:
+		fail("JOB_SCRUB_REPAIR", "unknown repair %q, must be empty, quarantine or delete", c.ScrubRepair)
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		fail("TRACING_SAMPLE_RATIO", "must be between 0 and 1")
+	}
+
+	if c.HealthCheckTimeout <= 0 {
+		fail("HEALTH_CHECK_TIMEOUT", "must be positive")
+	}
+
+	if c.HealthMinFreePercent < 0 || c.HealthMinFreePercent > 100 {
+		fail("HEALTH_MIN_FREE_PERCENT", "must be between 0 and 100")
+	}
+
+	return errs
+}
@@ -1,23 +1,31 @@
 package filesystem
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/spf13/afero"
 	"os"
+	"path"
 )
 
+// PendingDir keeps the files being written until they are complete.
+const PendingDir = ".pending"
+
 type Filesystem struct {
 	afero.Fs
+	// root is the directory on disk, empty in memory
+	root string
 }
 
 func New(path string) Storage {
 	if err := os.MkdirAll(path, 0755); err != nil {
 		panic(err)
 	}
-	return &Filesystem{afero.NewBasePathFs(afero.NewOsFs(), path)}
+	return &Filesystem{Fs: afero.NewBasePathFs(afero.NewOsFs(), path), root: path}
 }
 
 func NewMemFS(path string) Storage {
-	return &Filesystem{afero.NewBasePathFs(afero.NewMemMapFs(), path)}
+	return &Filesystem{Fs: afero.NewBasePathFs(afero.NewMemMapFs(), path)}
 }
 
 func (f *Filesystem) Create(name string) (File, error) {
@@ -31,3 +39,66 @@ func (f *Filesystem) Open(name string) (File, error) {
 func (f *Filesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
 	return f.Fs.OpenFile(name, flag, perm)
 }
+
+// CreateAtomic creates a file in PendingDir, it is synced and moved to name when closed.
+func (f *Filesystem) CreateAtomic(name string) (PendingFile, error) {
+	if err := f.MkdirAll(PendingDir, 0755); err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+
+	tmp := path.Join(PendingDir, hex.EncodeToString(suffix))
+	file, err := f.Fs.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pendingFile{File: file, fs: f, tmp: tmp, name: name}, nil
+}
+
+// RemovePending removes PendingDir with the writes interrupted by a crash.
+func (f *Filesystem) RemovePending() error {
+	return f.RemoveAll(PendingDir)
+}
+
+// pendingFile is a temporary file moved into place once it is complete.
+type pendingFile struct {
+	afero.File
+	fs   *Filesystem
+	tmp  string
+	name string
+}
+
+func (p *pendingFile) Close() error {
+	err := p.File.Sync()
+	if closeErr := p.File.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = p.fs.Rename(p.tmp, p.name)
+	}
+
+	if err != nil {
+		_ = p.fs.Remove(p.tmp)
+		return err
+	}
+
+	// the rename survives a crash once the directory is synced
+	if dir, openErr := p.fs.Fs.Open(path.Dir(p.name)); openErr == nil {
+		_ = dir.Sync()
+		_ = dir.Close()
+	}
+
+	return nil
+}
+
+func (p *pendingFile) Abort() error {
+	_ = p.File.Close()
+
+	return p.fs.Remove(p.tmp)
+}
@@ -0,0 +1,453 @@
+package filesystem
+
+import (
+	"context"
+	"errors"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var ErrNotSupported = errors.New("operation is not supported by the storage")
+
+var errAborted = errors.New("upload is aborted")
+
+// s3PartSize bounds the memory used by a single streaming upload.
+const s3PartSize = 16 << 20
+
+// S3Options configure a bucket of an S3 compatible object storage such as AWS S3 or MinIO.
+type S3Options struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to every object key, it allows sharing a bucket
+	Prefix string
+	UseSSL bool
+	// PresignTTL is the lifetime of direct download links
+	PresignTTL time.Duration
+}
+
+// S3 stores files as objects of a bucket, directories are emulated with key prefixes.
+type S3 struct {
+	client *minio.Client
+	opts   S3Options
+}
+
+// NewS3 connects to the object storage and creates the bucket if it does not exist.
+func NewS3(opts S3Options) (*S3, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, opts.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if mkErr := client.MakeBucket(ctx, opts.Bucket, minio.MakeBucketOptions{Region: opts.Region}); mkErr != nil {
+			return nil, mkErr
+		}
+	}
+
+	return &S3{client: client, opts: opts}, nil
+}
+
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join("/", s.opts.Prefix, name), "/")
+}
+
+// Create starts a streaming multipart upload, the object appears when the file is closed.
+func (s *S3) Create(name string) (File, error) {
+	return s.upload(name), nil
+}
+
+// CreateAtomic starts an upload like Create does, objects show up complete in any case.
+func (s *S3) CreateAtomic(name string) (PendingFile, error) {
+	return s.upload(name), nil
+}
+
+func (s *S3) upload(name string) *s3Writer {
+	pr, pw := io.Pipe()
+	w := &s3Writer{name: name, pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		_, err := s.client.PutObject(context.Background(), s.opts.Bucket, s.key(name), pr, -1,
+			minio.PutObjectOptions{PartSize: s3PartSize},
+		)
+		pr.CloseWithError(err) //nolint:errcheck // always nil
+		w.done <- err
+	}()
+
+	return w
+}
+
+// RemovePending does nothing, incomplete multipart uploads are left to the lifecycle rules of the bucket.
+func (s *S3) RemovePending() error {
+	return nil
+}
+
+func (s *S3) Mkdir(_ string, _ os.FileMode) error {
+	return nil
+}
+
+func (s *S3) MkdirAll(_ string, _ os.FileMode) error {
+	return nil
+}
+
+// Open returns the object for ranged reads, a key prefix is opened as a directory.
+func (s *S3) Open(name string) (File, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &s3Dir{s3: s, name: name}, nil
+	}
+
+	// the object is read lazily, reads fail rather than return the content of a later overwrite
+	opts := minio.GetObjectOptions{}
+	if oi, ok := info.(objectInfo); ok && oi.info.ETag != "" {
+		_ = opts.SetMatchETag(oi.info.ETag)
+	}
+
+	obj, err := s.client.GetObject(context.Background(), s.opts.Bucket, s.key(name), opts)
+	if err != nil {
+		return nil, s.pathError("open", name, err)
+	}
+
+	return &s3Reader{Object: obj, name: name}, nil
+}
+
+func (s *S3) OpenFile(name string, flag int, _ os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE) != 0 {
+		if flag&os.O_APPEND != 0 {
+			return nil, ErrNotSupported
+		}
+		return s.Create(name)
+	}
+
+	return s.Open(name)
+}
+
+func (s *S3) Remove(name string) error {
+	if _, err := s.Stat(name); err != nil {
+		return err
+	}
+
+	err := s.client.RemoveObject(context.Background(), s.opts.Bucket, s.key(name), minio.RemoveObjectOptions{})
+	return s.pathError("remove", name, err)
+}
+
+func (s *S3) RemoveAll(p string) error {
+	ctx := context.Background()
+	prefix := s.key(p)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	objects := s.client.ListObjects(ctx, s.opts.Bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true})
+	for err := range s.client.RemoveObjects(ctx, s.opts.Bucket, objects, minio.RemoveObjectsOptions{}) {
+		return err.Err
+	}
+
+	// p may be a single object as well
+	if _, err := s.Stat(p); err == nil {
+		return s.Remove(p)
+	}
+
+	return nil
+}
+
+// Rename copies the object on the server side and removes the old one.
+func (s *S3) Rename(oldname, newname string) error {
+	ctx := context.Background()
+
+	_, err := s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.opts.Bucket, Object: s.key(newname)},
+		minio.CopySrcOptions{Bucket: s.opts.Bucket, Object: s.key(oldname)},
+	)
+	if err != nil {
+		return s.pathError("rename", oldname, err)
+	}
+
+	return s.client.RemoveObject(ctx, s.opts.Bucket, s.key(oldname), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Stat(name string) (os.FileInfo, error) {
+	ctx := context.Background()
+
+	// the root is not an object
+	if s.key(name) == s.key("") {
+		return dirInfo("/"), nil
+	}
+
+	info, err := s.client.StatObject(ctx, s.opts.Bucket, s.key(name), minio.StatObjectOptions{})
+	if err == nil {
+		return objectInfo{info: info, name: path.Base(name)}, nil
+	}
+
+	if !isNotFound(err) {
+		return nil, s.pathError("stat", name, err)
+	}
+
+	// no such object, it still may be a directory
+	prefix := s.key(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	for obj := range s.client.ListObjects(ctx, s.opts.Bucket, minio.ListObjectsOptions{Prefix: prefix, MaxKeys: 1}) {
+		if obj.Err != nil {
+			return nil, s.pathError("stat", name, obj.Err)
+		}
+		return dirInfo(path.Base(name)), nil
+	}
+
+	if prefix == "" {
+		return dirInfo("/"), nil
+	}
+
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (s *S3) Name() string {
+	return "S3"
+}
+
+func (s *S3) Chmod(_ string, _ os.FileMode) error {
+	return nil
+}
+
+func (s *S3) Chown(_ string, _, _ int) error {
+	return nil
+}
+
+func (s *S3) Chtimes(_ string, _ time.Time, _ time.Time) error {
+	return nil
+}
+
+func (s *S3) PresignedURL(name, contentType string) (string, error) {
+	params := url.Values{}
+	if contentType != "" {
+		params.Set("response-content-type", contentType)
+	}
+
+	u, err := s.client.PresignedGetObject(context.Background(), s.opts.Bucket, s.key(name), s.opts.PresignTTL, params)
+	if err != nil {
+		return "", err
+	}
+
+	return u.String(), nil
+}
+
+func (s *S3) pathError(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if isNotFound(err) {
+		err = os.ErrNotExist
+	}
+
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+type objectInfo struct {
+	info minio.ObjectInfo
+	name string
+}
+
+func (o objectInfo) Name() string       { return o.name }
+func (o objectInfo) Size() int64        { return o.info.Size }
+func (o objectInfo) Mode() os.FileMode  { return 0644 }
+func (o objectInfo) ModTime() time.Time { return o.info.LastModified }
+func (o objectInfo) IsDir() bool        { return false }
+func (o objectInfo) Sys() interface{}   { return o.info }
+
+type dirInfo string
+
+func (d dirInfo) Name() string       { return string(d) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() os.FileMode  { return os.ModeDir | 0755 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
+
+// s3Writer streams written data into a multipart upload.
+type s3Writer struct {
+	readOnly
+	name    string
+	pw      *io.PipeWriter
+	written int64
+	done    chan error
+	closed  bool
+	err     error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.pw.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Close completes the upload and reports its error.
+func (w *s3Writer) Close() error {
+	if !w.closed {
+		w.closed = true
+		w.pw.Close() //nolint:errcheck // always nil
+		w.err = <-w.done
+	}
+
+	return w.err
+}
+
+// Abort fails the upload so that nothing is stored.
+func (w *s3Writer) Abort() error {
+	if !w.closed {
+		w.closed = true
+		w.pw.CloseWithError(errAborted) //nolint:errcheck // always nil
+		<-w.done
+		w.err = errAborted
+	}
+
+	return nil
+}
+
+func (w *s3Writer) Name() string {
+	return w.name
+}
+
+func (w *s3Writer) Stat() (os.FileInfo, error) {
+	return objectInfo{info: minio.ObjectInfo{Size: w.written}, name: path.Base(w.name)}, nil
+}
+
+func (w *s3Writer) Sync() error {
+	return nil
+}
+
+// s3Reader reads an object with ranged requests.
+type s3Reader struct {
+	*minio.Object
+	name string
+}
+
+func (r *s3Reader) Name() string {
+	return r.name
+}
+
+func (r *s3Reader) Stat() (os.FileInfo, error) {
+	info, err := r.Object.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return objectInfo{info: info, name: path.Base(r.name)}, nil
+}
+
+func (r *s3Reader) Write(_ []byte) (int, error)            { return 0, ErrNotSupported }
+func (r *s3Reader) WriteAt(_ []byte, _ int64) (int, error) { return 0, ErrNotSupported }
+func (r *s3Reader) WriteString(_ string) (int, error)      { return 0, ErrNotSupported }
+func (r *s3Reader) Truncate(_ int64) error                 { return ErrNotSupported }
+func (r *s3Reader) Sync() error                            { return nil }
+
+func (r *s3Reader) Readdir(_ int) ([]os.FileInfo, error) {
+	return nil, ErrNotSupported
+}
+
+func (r *s3Reader) Readdirnames(_ int) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// s3Dir lists the objects and prefixes directly under a prefix.
+type s3Dir struct {
+	readOnly
+	s3   *S3
+	name string
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
+
+func (d *s3Dir) Name() string {
+	return d.name
+}
+
+func (d *s3Dir) Stat() (os.FileInfo, error) {
+	return dirInfo(path.Base(d.name)), nil
+}
+
+func (d *s3Dir) Sync() error {
+	return nil
+}
+
+// Readdir returns all entries, count is ignored.
+func (d *s3Dir) Readdir(_ int) ([]os.FileInfo, error) {
+	prefix := d.s3.key(d.name)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var infos []os.FileInfo
+	for obj := range d.s3.client.ListObjects(context.Background(), d.s3.opts.Bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return infos, obj.Err
+		}
+
+		name := strings.TrimPrefix(obj.Key, prefix)
+		if strings.HasSuffix(name, "/") {
+			infos = append(infos, dirInfo(strings.TrimSuffix(name, "/")))
+			continue
+		}
+		infos = append(infos, objectInfo{info: obj, name: name})
+	}
+
+	return infos, nil
+}
+
+func (d *s3Dir) Readdirnames(n int) ([]string, error) {
+	infos, err := d.Readdir(n)
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+
+	return names, err
+}
+
+// readOnly rejects every operation a sequential object can't support.
+type readOnly struct{}
+
+func (readOnly) Read(_ []byte) (int, error)             { return 0, ErrNotSupported }
+func (readOnly) ReadAt(_ []byte, _ int64) (int, error)  { return 0, ErrNotSupported }
+func (readOnly) Seek(_ int64, _ int) (int64, error)     { return 0, ErrNotSupported }
+func (readOnly) Write(_ []byte) (int, error)            { return 0, ErrNotSupported }
+func (readOnly) WriteAt(_ []byte, _ int64) (int, error) { return 0, ErrNotSupported }
+func (readOnly) WriteString(_ string) (int, error)      { return 0, ErrNotSupported }
+func (readOnly) Truncate(_ int64) error                 { return ErrNotSupported }
+func (readOnly) Readdir(_ int) ([]os.FileInfo, error)   { return nil, ErrNotSupported }
+func (readOnly) Readdirnames(_ int) ([]string, error)   { return nil, ErrNotSupported }
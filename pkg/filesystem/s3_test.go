@@ -0,0 +1,511 @@
+package filesystem_test
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/labi-le/server/pkg/filesystem"
+	"github.com/labi-le/server/pkg/sigv4"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "access"
+	testSecretKey = "secret"
+	testBucket    = "files"
+)
+
+// fakeS3 is an in-memory object storage serving the part of the S3 API the driver uses.
+// Requests are checked with the signature verification of the S3 API handlers.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]bool
+	// objects are keyed by bucket/key
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	fake := &fakeS3{
+		buckets: make(map[string]bool),
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int][]byte),
+	}
+
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	return fake, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := f.verify(r)
+	if err != nil {
+		fakeError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	if key == "" {
+		f.serveBucket(w, r, bucket, query)
+		return
+	}
+
+	if !f.buckets[bucket] {
+		fakeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	object := bucket + "/" + key
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		fakeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadID string `xml:"UploadId"`
+		}{Bucket: bucket, Key: key, UploadID: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		if r.Header.Get("X-Amz-Copy-Source") == "" {
+			parts[n] = body
+			w.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+			return
+		}
+
+		// a part copied from another object, Rename copies on the server side this way
+		data, ok := f.copySource(r)
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey", r.Header.Get("X-Amz-Copy-Source"))
+			return
+		}
+		parts[n] = data
+		fakeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyPartResult"`
+			ETag         string
+			LastModified string
+		}{ETag: fmt.Sprintf(`"part%d"`, n), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchUpload", key)
+			return
+		}
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+
+		var data []byte
+		for _, n := range numbers {
+			data = append(data, parts[n]...)
+		}
+		f.objects[object] = data
+		delete(f.uploads, query.Get("uploadId"))
+		fakeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"object"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		data, ok := f.copySource(r)
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey", r.Header.Get("X-Amz-Copy-Source"))
+			return
+		}
+		f.objects[object] = data
+		fakeXML(w, struct {
+			XMLName      xml.Name `xml:"CopyObjectResult"`
+			ETag         string
+			LastModified string
+		}{ETag: `"object"`, LastModified: time.Now().UTC().Format(time.RFC3339)})
+	case r.Method == http.MethodPut:
+		f.objects[object] = body
+		w.Header().Set("ETag", `"object"`)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := f.objects[object]
+		if !ok {
+			fakeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("ETag", `"object"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, key, time.Time{}, strings.NewReader(string(data)))
+	case r.Method == http.MethodDelete:
+		delete(f.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// copySource returns the content of the object named in X-Amz-Copy-Source, cut to X-Amz-Copy-Source-Range.
+func (f *fakeS3) copySource(r *http.Request) ([]byte, bool) {
+	source, _ := url.PathUnescape(strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "/"))
+	data, ok := f.objects[source]
+	if !ok {
+		return nil, false
+	}
+
+	var start, end int
+	if _, err := fmt.Sscanf(r.Header.Get("X-Amz-Copy-Source-Range"), "bytes=%d-%d", &start, &end); err == nil {
+		data = data[start : end+1]
+	}
+
+	return data, true
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, query url.Values) {
+	switch r.Method {
+	case http.MethodHead:
+		if !f.buckets[bucket] {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case http.MethodPut:
+		f.buckets[bucket] = true
+	case http.MethodGet:
+		f.list(w, bucket, query)
+	default:
+		fakeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// list answers ListObjectsV2, the continuation of truncated results is not supported.
+func (f *fakeS3) list(w http.ResponseWriter, bucket string, query url.Values) {
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	maxKeys, err := strconv.Atoi(query.Get("max-keys"))
+	if err != nil || maxKeys <= 0 {
+		maxKeys = 1000
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for object := range f.objects {
+		if key, ok := strings.CutPrefix(object, bucket+"/"); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var (
+		contents []content
+		prefixes []commonPrefix
+		seen     = make(map[string]bool)
+	)
+	for _, key := range keys {
+		if len(contents)+len(prefixes) == maxKeys {
+			break
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				dir := key[:len(prefix)+i+len(delimiter)]
+				if !seen[dir] {
+					seen[dir] = true
+					prefixes = append(prefixes, commonPrefix{Prefix: dir})
+				}
+				continue
+			}
+		}
+
+		contents = append(contents, content{
+			Key:          key,
+			LastModified: time.Now().UTC().Format(time.RFC3339),
+			ETag:         `"object"`,
+			Size:         len(f.objects[bucket+"/"+key]),
+		})
+	}
+
+	fakeXML(w, struct {
+		XMLName        xml.Name `xml:"ListBucketResult"`
+		Name           string
+		Prefix         string
+		KeyCount       int
+		MaxKeys        int
+		Delimiter      string
+		IsTruncated    bool
+		Contents       []content
+		CommonPrefixes []commonPrefix
+	}{
+		Name:           bucket,
+		Prefix:         prefix,
+		KeyCount:       len(contents) + len(prefixes),
+		MaxKeys:        maxKeys,
+		Delimiter:      delimiter,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	})
+}
+
+// verify checks the signature of r and returns its payload.
+func (f *fakeS3) verify(r *http.Request) ([]byte, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// net/http keeps the length out of the header
+	header := r.Header.Clone()
+	if r.ContentLength >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(r.ContentLength, 10))
+	}
+
+	sig, err := sigv4.Verify(sigv4.Request{
+		Method: r.Method,
+		Path:   r.URL.EscapedPath(),
+		Query:  r.URL.Query(),
+		Header: header,
+		Host:   r.Host,
+		Body:   body,
+	}, func(accessKey string) (string, bool) {
+		return testSecretKey, accessKey == testAccessKey
+	}, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.Streaming {
+		return sig.DecodeChunks(body)
+	}
+
+	return body, nil
+}
+
+func fakeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(v)
+}
+
+func fakeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_ = xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func newTestS3(t *testing.T, endpoint string) *filesystem.S3 {
+	t.Helper()
+
+	s3, err := filesystem.NewS3(filesystem.S3Options{
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		Bucket:    testBucket,
+		AccessKey: testAccessKey,
+		SecretKey: testSecretKey,
+		Prefix:    "blobs",
+	})
+	if err != nil {
+		t.Fatalf("NewS3: %v", err)
+	}
+
+	return s3
+}
+
+func writeObject(t *testing.T, s3 *filesystem.S3, name, content string) {
+	t.Helper()
+
+	file, err := s3.CreateAtomic(name)
+	if err != nil {
+		t.Fatalf("CreateAtomic(%s): %v", name, err)
+	}
+	if _, err = io.WriteString(file, content); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	if err = file.Close(); err != nil {
+		t.Fatalf("close %s: %v", name, err)
+	}
+}
+
+func readObject(t *testing.T, s3 *filesystem.S3, name string) string {
+	t.Helper()
+
+	file, err := s3.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", name, err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+
+	return string(data)
+}
+
+func TestS3CreatesTheBucket(t *testing.T) {
+	fake, endpoint := newFakeS3(t)
+	newTestS3(t, endpoint)
+
+	if !fake.buckets[testBucket] {
+		t.Fatalf("bucket %s was not created", testBucket)
+	}
+}
+
+func TestS3RejectsWrongCredentials(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+
+	_, err := filesystem.NewS3(filesystem.S3Options{
+		Endpoint:  endpoint,
+		Region:    "us-east-1",
+		Bucket:    testBucket,
+		AccessKey: testAccessKey,
+		SecretKey: "wrong",
+	})
+	if err == nil {
+		t.Fatal("NewS3 succeeded with a wrong secret")
+	}
+}
+
+func TestS3WriteReadAndStat(t *testing.T) {
+	fake, endpoint := newFakeS3(t)
+	s3 := newTestS3(t, endpoint)
+
+	writeObject(t, s3, "dir/file.txt", "hello")
+
+	if _, ok := fake.objects[testBucket+"/blobs/dir/file.txt"]; !ok {
+		t.Fatal("the object is not stored under the prefix")
+	}
+
+	if got := readObject(t, s3, "dir/file.txt"); got != "hello" {
+		t.Fatalf("content = %q, want %q", got, "hello")
+	}
+
+	info, err := s3.Stat("dir/file.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.IsDir() || info.Size() != 5 || info.Name() != "file.txt" {
+		t.Fatalf("Stat = %s dir=%v size=%d, want file.txt of 5 bytes", info.Name(), info.IsDir(), info.Size())
+	}
+
+	dir, err := s3.Stat("dir")
+	if err != nil {
+		t.Fatalf("Stat(dir): %v", err)
+	}
+	if !dir.IsDir() {
+		t.Fatal("a key prefix is not reported as a directory")
+	}
+
+	if _, err = s3.Stat("missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat(missing) = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3AbortLeavesNothing(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	s3 := newTestS3(t, endpoint)
+
+	file, err := s3.CreateAtomic("aborted")
+	if err != nil {
+		t.Fatalf("CreateAtomic: %v", err)
+	}
+	if _, err = io.WriteString(file, "partial"); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err = file.Abort(); err != nil {
+		t.Fatalf("Abort: %v", err)
+	}
+
+	if _, err = s3.Stat("aborted"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after Abort = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3RenameAndRemove(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	s3 := newTestS3(t, endpoint)
+
+	writeObject(t, s3, "old", "content")
+
+	if err := s3.Rename("old", "new/name"); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+	if _, err := s3.Stat("old"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat(old) after Rename = %v, want os.ErrNotExist", err)
+	}
+	if got := readObject(t, s3, "new/name"); got != "content" {
+		t.Fatalf("renamed content = %q, want %q", got, "content")
+	}
+
+	if err := s3.Remove("new/name"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := s3.Stat("new/name"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Stat after Remove = %v, want os.ErrNotExist", err)
+	}
+	if err := s3.Remove("new/name"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Remove of a missing object = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestS3Readdir(t *testing.T) {
+	_, endpoint := newFakeS3(t)
+	s3 := newTestS3(t, endpoint)
+
+	writeObject(t, s3, "a", "1")
+	writeObject(t, s3, "sub/b", "22")
+	writeObject(t, s3, "sub/deeper/c", "333")
+
+	root, err := s3.Open("")
+	if err != nil {
+		t.Fatalf("Open(root): %v", err)
+	}
+	defer root.Close()
+
+	infos, err := root.Readdir(-1)
+	if err != nil {
+		t.Fatalf("Readdir: %v", err)
+	}
+
+	got := make([]string, 0, len(infos))
+	for _, info := range infos {
+		got = append(got, fmt.Sprintf("%s dir=%v", info.Name(), info.IsDir()))
+	}
+
+	want := []string{"a dir=false", "sub dir=true"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("Readdir = %v, want %v", got, want)
+	}
+}
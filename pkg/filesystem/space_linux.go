@@ -0,0 +1,17 @@
+package filesystem
+
+import "syscall"
+
+func (f *Filesystem) Space() (free, total uint64, err error) {
+	if f.root == "" {
+		return 0, 0, ErrNotSupported
+	}
+
+	var stat syscall.Statfs_t
+	if err = syscall.Statfs(f.root, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	// blocks reserved for root are not available to the server
+	return stat.Bavail * uint64(stat.Bsize), stat.Blocks * uint64(stat.Bsize), nil
+}
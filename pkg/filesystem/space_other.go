@@ -0,0 +1,7 @@
+//go:build !linux
+
+package filesystem
+
+func (f *Filesystem) Space() (free, total uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
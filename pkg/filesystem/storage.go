@@ -73,3 +73,32 @@ type Storage interface {
 	// Chtimes changes the access and modification times of the named file
 	Chtimes(name string, atime time.Time, mtime time.Time) error
 }
+
+// Presigner is implemented by storages able to hand out direct download links.
+type Presigner interface {
+	// PresignedURL returns a temporary link to download the named file,
+	// the file is served with the given content type.
+	PresignedURL(name, contentType string) (string, error)
+}
+
+// PendingFile is a file that shows up in the storage complete when it is closed,
+// Abort discards it instead.
+type PendingFile interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// AtomicCreator is implemented by storages able to create files that show up complete or not at all.
+type AtomicCreator interface {
+	CreateAtomic(name string) (PendingFile, error)
+	// RemovePending removes the files left behind by writes interrupted by a crash,
+	// it must run before any file is created.
+	RemovePending() error
+}
+
+// SpaceReporter is implemented by storages that know how much space is left.
+type SpaceReporter interface {
+	// Space returns the bytes available to the server and the size of the volume,
+	// it fails with ErrNotSupported when the storage can't tell.
+	Space() (free, total uint64, err error)
+}
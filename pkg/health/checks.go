@@ -0,0 +1,132 @@
+package health
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/labi-le/server/pkg/filesystem"
+	"golang.org/x/crypto/acme/autocert"
+	"strings"
+	"time"
+)
+
+var (
+	ErrLowSpace     = errors.New("free space is below the threshold")
+	ErrCertExpiring = errors.New("certificate expires soon")
+)
+
+// probeFile is written and removed by Writable, it sits with the uploads in progress.
+const probeFile = filesystem.PendingDir + "/health"
+
+// Writable creates and removes a small file in the storage.
+func Writable(fs filesystem.Storage) Check {
+	return func(context.Context) (string, error) {
+		if err := fs.MkdirAll(filesystem.PendingDir, 0755); err != nil {
+			return "", err
+		}
+
+		file, err := fs.Create(probeFile)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = file.WriteString(time.Now().Format(time.RFC3339Nano))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		if removeErr := fs.Remove(probeFile); err == nil {
+			err = removeErr
+		}
+
+		return "", err
+	}
+}
+
+// FreeSpace fails when the storage has less free space than both thresholds allow,
+// it passes for storages that can't tell.
+func FreeSpace(fs filesystem.Storage, minBytes uint64, minPercent float64) Check {
+	return func(context.Context) (string, error) {
+		reporter, ok := fs.(filesystem.SpaceReporter)
+		if !ok {
+			return "not reported by the storage", nil
+		}
+
+		free, total, err := reporter.Space()
+		if errors.Is(err, filesystem.ErrNotSupported) {
+			return "not reported by the storage", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var percent float64
+		if total > 0 {
+			percent = float64(free) / float64(total) * 100
+		}
+
+		detail := fmt.Sprintf("%s free of %s (%.1f%%)", humanize.IBytes(free), humanize.IBytes(total), percent)
+		if free < minBytes || percent < minPercent {
+			return detail, ErrLowSpace
+		}
+
+		return detail, nil
+	}
+}
+
+// Certificates fails when a certificate obtained for one of the domains expires within minValidity.
+// Domains without a certificate pass, it is obtained on the first request.
+func Certificates(cache autocert.Cache, domains []string, minValidity time.Duration) Check {
+	return func(ctx context.Context) (string, error) {
+		var details []string
+		for _, domain := range domains {
+			data, err := cache.Get(ctx, domain)
+			if errors.Is(err, autocert.ErrCacheMiss) {
+				details = append(details, domain+" not issued yet")
+				continue
+			}
+			if err != nil {
+				return strings.Join(details, ", "), err
+			}
+
+			notAfter, err := expiry(data)
+			if err != nil {
+				return strings.Join(details, ", "), fmt.Errorf("%s: %w", domain, err)
+			}
+
+			left := time.Until(notAfter).Truncate(time.Hour)
+			details = append(details, fmt.Sprintf("%s expires in %s", domain, left))
+			if left < minValidity {
+				return strings.Join(details, ", "), fmt.Errorf("%w: %s", ErrCertExpiring, domain)
+			}
+		}
+
+		return strings.Join(details, ", "), nil
+	}
+}
+
+// expiry returns the end of the validity of the leaf certificate cached by autocert,
+// the entry holds the private key followed by the chain.
+func expiry(data []byte) (time.Time, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return time.Time{}, errors.New("no certificate in the cache entry")
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		return cert.NotAfter, nil
+	}
+}
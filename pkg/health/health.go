@@ -0,0 +1,152 @@
+// Package health runs the checks of the dependencies probed by the container orchestrator.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status of a check or of the whole report.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Kind tells which probes run a check.
+type Kind int
+
+const (
+	// Liveness checks fail when the process is broken and a restart helps, readiness probes run them too.
+	Liveness Kind = iota
+	// Readiness checks fail when the server can't take requests for now.
+	Readiness
+)
+
+// Check returns an error when the dependency is unusable, the detail is shown in the report.
+type Check func(ctx context.Context) (detail string, err error)
+
+// Options configure the checks.
+type Options struct {
+	// Timeout bounds every check
+	Timeout time.Duration
+	// MinFreeBytes and MinFreePercent are the free space below which the storage is not ready
+	MinFreeBytes   uint64
+	MinFreePercent float64
+	// CertMinValidity is the time left to a certificate below which the server is not ready,
+	// certificates are renewed 30 days before they expire
+	CertMinValidity time.Duration
+}
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of a probe, its status fails when any of the checks fails.
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// OK reports whether all the checks passed.
+func (r Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+type check struct {
+	name string
+	kind Kind
+	run  Check
+}
+
+// Checker holds the checks of the server.
+type Checker struct {
+	timeout time.Duration
+	checks  []check
+}
+
+func New(timeout time.Duration) *Checker {
+	return &Checker{timeout: timeout}
+}
+
+// Add registers a check, it must be called before the probes are served.
+func (c *Checker) Add(name string, kind Kind, run Check) {
+	c.checks = append(c.checks, check{name: name, kind: kind, run: run})
+}
+
+// Run runs the checks of the given kind at the same time, readiness includes the liveness checks.
+func (c *Checker) Run(ctx context.Context, kind Kind) Report {
+	report := Report{Status: StatusOK, Checks: []Result{}}
+
+	var selected []check
+	for _, ch := range c.checks {
+		if ch.kind <= kind {
+			selected = append(selected, ch)
+		}
+	}
+
+	results := make([]Result, len(selected))
+	var wg sync.WaitGroup
+	for i, ch := range selected {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx, ch)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range results {
+		if result.Status != StatusOK {
+			report.Status = StatusFail
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	return report
+}
+
+func (c *Checker) run(ctx context.Context, ch check) Result {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	result := Result{Name: ch.name, Status: StatusOK}
+
+	// a check stuck on I/O is reported once the timeout passes
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result.Detail, result.Error = runCheck(ctx, ch.run)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return Result{Name: ch.name, Status: StatusFail, Error: ctx.Err().Error(), Duration: time.Since(start).String()}
+	}
+
+	if result.Error != "" {
+		result.Status = StatusFail
+	}
+	result.Duration = time.Since(start).String()
+
+	return result
+}
+
+func runCheck(ctx context.Context, run Check) (string, string) {
+	detail, err := run(ctx)
+	if err != nil {
+		return detail, err.Error()
+	}
+
+	return detail, ""
+}
@@ -0,0 +1,244 @@
+// Package keys keeps the API keys handed out besides OWNER_KEY in a JSON file.
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidName = errors.New("key name must be 1-64 letters, digits, dots, dashes or underscores")
+	ErrNameTaken   = errors.New("key name is taken")
+	ErrNotFound    = errors.New("key not found")
+	ErrRevoked     = errors.New("key is already revoked")
+)
+
+// DefaultSize is the number of random bytes in a generated key.
+const DefaultSize = 32
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Key is an API key, a revoked one keeps its name taken so its files are not handed to a new key.
+type Key struct {
+	Name      string     `json:"name"`
+	Key       string     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Revoked reports whether the key no longer grants access.
+func (k Key) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Store is the key file loaded in memory, changes are written through to the file.
+// Only one process may change the file at a time.
+type Store struct {
+	path string
+	// reserved names can't be given to a key, such as the name of OWNER_KEY
+	reserved []string
+
+	mu   sync.RWMutex
+	keys map[string]Key
+}
+
+// Open loads the key file at path, a missing file holds no keys.
+func Open(path string, reserved ...string) (*Store, error) {
+	s := &Store{path: path, reserved: reserved, keys: make(map[string]Key)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []Key
+	if err = json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	for _, k := range keys {
+		s.keys[k.Name] = k
+	}
+
+	return s, nil
+}
+
+// Generate returns a random key of size bytes encoded for use in headers and URLs.
+func Generate(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// List returns the keys sorted by name, revoked ones included.
+func (s *Store) List() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.sorted()
+}
+
+func (s *Store) sorted() []Key {
+	keys := make([]Key, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+
+	return keys
+}
+
+// Name returns the name of a key that is not revoked.
+func (s *Store) Name(key string) (string, bool) {
+	if key == "" {
+		return "", false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// every key is compared so the time taken doesn't tell how many match
+	name, found := "", false
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 && !k.Revoked() {
+			name, found = k.Name, true
+		}
+	}
+
+	return name, found
+}
+
+// Key returns the key with the given name unless it is revoked.
+func (s *Store) Key(name string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	k, ok := s.keys[name]
+	if !ok || k.Revoked() {
+		return "", false
+	}
+
+	return k.Key, true
+}
+
+// Add generates a key with the given name, names of revoked keys can't be reused.
+func (s *Store) Add(name string) (Key, error) {
+	if !validName.MatchString(name) {
+		return Key{}, ErrInvalidName
+	}
+
+	for _, reserved := range s.reserved {
+		if name == reserved {
+			return Key{}, ErrNameTaken
+		}
+	}
+
+	key, err := Generate(DefaultSize)
+	if err != nil {
+		return Key{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[name]; ok {
+		return Key{}, ErrNameTaken
+	}
+
+	k := Key{Name: name, Key: key, CreatedAt: time.Now().UTC()}
+	s.keys[name] = k
+	if err = s.save(); err != nil {
+		delete(s.keys, name)
+		return Key{}, err
+	}
+
+	return k, nil
+}
+
+// Revoke stops the key with the given name from granting access.
+func (s *Store) Revoke(name string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k, ok := s.keys[name]
+	switch {
+	case !ok:
+		return Key{}, ErrNotFound
+	case k.Revoked():
+		return k, ErrRevoked
+	}
+
+	now := time.Now().UTC()
+	revoked := k
+	revoked.RevokedAt = &now
+	s.keys[name] = revoked
+	if err := s.save(); err != nil {
+		s.keys[name] = k
+		return Key{}, err
+	}
+
+	return revoked, nil
+}
+
+// save replaces the key file, a crash leaves either the old or the new one.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(s.path)
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// the keys are secrets
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(data)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// Mask keeps the first characters of long keys, short ones are hidden entirely.
+func Mask(key string) string {
+	const shown = 4
+	if len(key) < 4*shown {
+		return strings.Repeat("*", len(key))
+	}
+
+	return key[:shown] + strings.Repeat("*", len(key)-shown)
+}
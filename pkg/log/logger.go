@@ -3,12 +3,16 @@ package log
 
 import (
 	"context"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/utils"
 	"github.com/google/uuid"
+	"github.com/labi-le/server/pkg/tracing"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // Logger is a logger that supports log levels, context and structured logging.
@@ -62,6 +66,7 @@ func NewWithZap(l *zap.Logger) Logger {
 //
 // If the context contains request ID and/or correlation ID information (recorded via WithRequestID()
 // and WithCorrelationID()), they will be added to every log message generated by the new logger.
+// So are the trace and span IDs of a span in the context.
 //
 // The arguments should be specified as a sequence of name, value pairs with names being strings.
 // The arguments will also be added to every log message generated by the logger.
@@ -76,6 +81,9 @@ func (l *logger) With(ctx context.Context, args ...interface{}) Logger {
 		if status, ok := ctx.Value(cacheStatusIDKey).(string); ok {
 			args = append(args, zap.String("cache_status", status))
 		}
+		if traceID, spanID := tracing.IDs(ctx); traceID != "" {
+			args = append(args, zap.String("trace_id", traceID), zap.String("span_id", spanID))
+		}
 	}
 	if len(args) > 0 {
 		return &logger{l.SugaredLogger.With(args...)}
@@ -102,6 +110,12 @@ func WithRequest(ctx context.Context, req *fasthttp.Request) context.Context {
 	return ctx
 }
 
+// RequestID returns the request ID recorded in ctx by WithRequest, it is empty outside of a request.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
 // getCorrelationID extracts the correlation ID from the HTTP request
 func getCorrelationID(req *fasthttp.Request) string {
 	return string(req.Header.Peek("X-Correlation-ID"))
@@ -112,21 +126,120 @@ func getRequestID(req *fasthttp.Request) string {
 	return string(req.Header.Peek("X-Request-ID"))
 }
 
-func LoggerMiddleware(l Logger) func(c *fiber.Ctx) error {
+// keyNameLocal holds the name of the key a request was authenticated with.
+const keyNameLocal = "log.key_name"
+
+// maxLoggedBody is the part of a request body written to the access log.
+const maxLoggedBody = 1024
+
+// SetKeyName records the name of the key the request was authenticated with for the access log.
+func SetKeyName(c *fiber.Ctx, name string) {
+	c.Locals(keyNameLocal, name)
+}
+
+// KeyName returns the name of the key the request was authenticated with, it is empty for anonymous requests.
+func KeyName(c *fiber.Ctx) string {
+	name, _ := c.Locals(keyNameLocal).(string)
+	return name
+}
+
+// MiddlewareOptions configure the access log.
+type MiddlewareOptions struct {
+	// LogBodies adds the beginning of request bodies, uploaded files are replaced with their size
+	LogBodies bool
+	// RedactAuthorization hides the value of the Authorization header, it is logged only when set
+	RedactAuthorization bool
+}
+
+// accessMessage is the message of the access log lines, they are never sampled.
+const accessMessage = "access"
+
+// LoggerMiddleware writes an access log line once the handler returns,
+// server errors are logged at error level and client errors at warn level.
+// Streamed responses are still being sent at that moment, their latency excludes the transfer.
+// The options are read for every request, they may change while the server runs.
+func LoggerMiddleware(l Logger, options func() MiddlewareOptions) func(c *fiber.Ctx) error {
 	return func(c *fiber.Ctx) error {
-		var body string
-		contentType := utils.UnsafeString(c.Request().Header.ContentType())
-		if contentType == "multipart/form-data; boundary=boundary" {
-			body = " ------ FILE " + strconv.Itoa(c.Request().Header.ContentLength()) + " size ------"
-		} else {
-			body = utils.UnsafeString(c.Body())
+		start := time.Now()
+		opts := options()
+
+		ctx := WithRequest(c.UserContext(), c.Request())
+		c.SetUserContext(ctx)
+		c.Set(fiber.HeaderXRequestID, ctx.Value(requestIDKey).(string))
+
+		err := c.Next()
+
+		// the error handler sets the status after the middleware returns
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
 		}
 
-		l.With(
-			WithRequest(c.Context(), c.Request()),
-		).
-			Info(c.String(), body)
+		fields := []interface{}{
+			zap.String("method", c.Method()),
+			zap.String("path", c.Path()),
+			zap.Int("status", status),
+			zap.Duration("latency", time.Since(start)),
+			zap.Int("bytes_in", len(c.Request().Body())),
+			zap.String("ip", c.IP()),
+			zap.String("user_agent", c.Get(fiber.HeaderUserAgent)),
+		}
+
+		// buffered bodies get their Content-Length when the response is written
+		if !c.Response().IsBodyStream() {
+			fields = append(fields, zap.Int("bytes_out", len(c.Response().Body())))
+		} else if n := c.Response().Header.ContentLength(); n >= 0 {
+			fields = append(fields, zap.Int("bytes_out", n))
+		}
 
-		return c.Next()
+		if name, ok := c.Locals(keyNameLocal).(string); ok {
+			fields = append(fields, zap.String("key_name", name))
+		}
+
+		if auth := c.Get(fiber.HeaderAuthorization); auth != "" {
+			if opts.RedactAuthorization {
+				auth = "[redacted]"
+			}
+			fields = append(fields, zap.String("authorization", auth))
+		}
+
+		if opts.LogBodies {
+			fields = append(fields, zap.String("body", loggedBody(c)))
+		}
+
+		if err != nil {
+			fields = append(fields, zap.Error(err))
+		}
+
+		access := l.With(ctx, fields...)
+		switch {
+		case status >= fiber.StatusInternalServerError:
+			access.Error(accessMessage)
+		case status >= fiber.StatusBadRequest:
+			access.Warn(accessMessage)
+		default:
+			access.Info(accessMessage)
+		}
+
+		return err
+	}
+}
+
+// loggedBody returns the beginning of the request body, uploaded files are replaced with their size.
+func loggedBody(c *fiber.Ctx) string {
+	contentType := utils.UnsafeString(c.Request().Header.ContentType())
+	if strings.HasPrefix(contentType, fiber.MIMEMultipartForm) {
+		return "------ FILE " + strconv.Itoa(c.Request().Header.ContentLength()) + " size ------"
 	}
+
+	body := c.Body()
+	if len(body) > maxLoggedBody {
+		return string(body[:maxLoggedBody]) + "..."
+	}
+
+	return string(body)
 }
@@ -0,0 +1,123 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"time"
+)
+
+// Log formats.
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Log outputs besides a file path.
+const (
+	OutputStdout = "stdout"
+	OutputStderr = "stderr"
+)
+
+var ErrUnknownFormat = errors.New("unknown log format")
+
+// Options configure where and how the root logger writes.
+type Options struct {
+	// Format is either FormatJSON or FormatConsole
+	Format string
+	// Output is OutputStdout, OutputStderr or the path of a file
+	Output string
+	// Rotate applies to a file output
+	Rotate RotateOptions
+	// Development adds the stack traces of warnings and panics on DPanic
+	Development bool
+}
+
+// Build creates the root zap logger writing the entries enabled by level,
+// the level can be changed while the logger is in use.
+// The returned closer flushes and closes the log file.
+func Build(opts Options, level zap.AtomicLevel) (*zap.Logger, io.Closer, error) {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	if opts.Development {
+		encoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+
+	var encoder zapcore.Encoder
+	switch opts.Format {
+	case FormatJSON:
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	case FormatConsole:
+		// epoch timestamps are meant for machines
+		encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnknownFormat, opts.Format)
+	}
+
+	var out zapcore.WriteSyncer
+	var closer io.Closer = nopCloser{}
+	switch opts.Output {
+	case OutputStdout:
+		out = zapcore.Lock(os.Stdout)
+	case OutputStderr, "":
+		out = zapcore.Lock(os.Stderr)
+	default:
+		file, err := OpenRotating(opts.Output, opts.Rotate)
+		if err != nil {
+			return nil, nil, err
+		}
+		out, closer = file, file
+	}
+
+	core := zapcore.NewCore(encoder, out, level)
+	zapOpts := []zap.Option{zap.AddCaller(), zap.ErrorOutput(zapcore.Lock(os.Stderr))}
+	if opts.Development {
+		zapOpts = append(zapOpts, zap.Development(), zap.AddStacktrace(zap.WarnLevel))
+	} else {
+		// same sampling as zap.NewProduction, every request still gets its access line
+		core = accessExempt{
+			sampled: zapcore.NewSamplerWithOptions(core, time.Second, 100, 100),
+			all:     core,
+		}
+		zapOpts = append(zapOpts, zap.AddStacktrace(zap.ErrorLevel))
+	}
+
+	return zap.New(core, zapOpts...), closer, nil
+}
+
+// accessExempt samples the entries except the access lines written by LoggerMiddleware.
+type accessExempt struct {
+	sampled zapcore.Core
+	all     zapcore.Core
+}
+
+func (c accessExempt) Enabled(level zapcore.Level) bool {
+	return c.all.Enabled(level)
+}
+
+func (c accessExempt) With(fields []zapcore.Field) zapcore.Core {
+	return accessExempt{sampled: c.sampled.With(fields), all: c.all.With(fields)}
+}
+
+func (c accessExempt) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Message == accessMessage {
+		return c.all.Check(ent, ce)
+	}
+
+	return c.sampled.Check(ent, ce)
+}
+
+func (c accessExempt) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.all.Write(ent, fields)
+}
+
+func (c accessExempt) Sync() error {
+	return c.all.Sync()
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,183 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is put between the name and the extension of a rotated file.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotateOptions configure the rotation of the log file.
+type RotateOptions struct {
+	// MaxSize is the size in bytes the file is rotated at, zero disables it
+	MaxSize int64
+	// Interval is the time the file is rotated after, zero disables it
+	Interval time.Duration
+	// MaxBackups is the number of rotated files kept, zero keeps all of them
+	MaxBackups int
+}
+
+// RotatingFile is a log file renamed with a timestamp once it grows past the size
+// or gets older than the interval, writes continue to a new file at the same path.
+type RotatingFile struct {
+	path string
+	opts RotateOptions
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+}
+
+// OpenRotating opens the log file at path appending to it.
+func OpenRotating(path string, opts RotateOptions) (*RotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f := &RotatingFile{path: path, opts: opts}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the entry still goes to the reopened file when the rotation fails
+	var rotateErr error
+	if f.due(int64(len(p))) {
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+
+	return n, err
+}
+
+func (f *RotatingFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.file.Sync()
+}
+
+// Close flushes and closes the file.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.file.Sync(); err != nil {
+		f.file.Close()
+		return err
+	}
+
+	return f.file.Close()
+}
+
+// due reports whether the file is to be rotated before n more bytes are written,
+// a single entry larger than MaxSize still goes to a file of its own.
+func (f *RotatingFile) due(n int64) bool {
+	if f.opts.MaxSize > 0 && f.size > 0 && f.size+n > f.opts.MaxSize {
+		return true
+	}
+
+	return f.opts.Interval > 0 && time.Since(f.openedAt) >= f.opts.Interval
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	// the age of a file kept from the previous run is unknown, it is counted from the start
+	f.openedAt = time.Now()
+
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return f.reopen(err)
+	}
+
+	if err := os.Rename(f.path, f.backupName(time.Now())); err != nil {
+		return f.reopen(err)
+	}
+
+	if err := f.open(); err != nil {
+		return f.reopen(err)
+	}
+
+	return f.prune()
+}
+
+// reopen opens the file again after a rotation failed past closing it and returns err,
+// a file that can't be opened is retried on the next rotation.
+func (f *RotatingFile) reopen(err error) error {
+	if openErr := f.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+
+	return err
+}
+
+func (f *RotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.Format(backupTimeFormat) + ext
+}
+
+// prune removes the oldest rotated files past MaxBackups.
+func (f *RotatingFile) prune() error {
+	if f.opts.MaxBackups <= 0 {
+		return nil
+	}
+
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, name := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err == nil {
+			backups = append(backups, name)
+		}
+	}
+
+	// the timestamps sort in the order the files were rotated
+	sort.Strings(backups)
+	for len(backups) > f.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+
+	return nil
+}
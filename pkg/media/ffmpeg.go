@@ -0,0 +1,156 @@
+// Package media extracts metadata and poster frames from audio and video files.
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+var ErrNoVideo = errors.New("no video stream")
+
+// Info describes the streams of a media file.
+type Info struct {
+	// Duration in seconds
+	Duration   float64 `json:"duration"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	VideoCodec string  `json:"video_codec,omitempty"`
+	AudioCodec string  `json:"audio_codec,omitempty"`
+}
+
+// Prober reads media files from the local filesystem.
+type Prober interface {
+	// Probe returns the metadata of the file at path.
+	Probe(ctx context.Context, path string) (Info, error)
+	// Poster writes a JPEG frame taken at the given second of the video at path.
+	Poster(ctx context.Context, path string, at float64, dst io.Writer) error
+}
+
+// FFmpeg is a Prober running the ffprobe and ffmpeg binaries.
+type FFmpeg struct {
+	ffprobe string
+	ffmpeg  string
+}
+
+// NewFFmpeg looks up the binaries in PATH unless absolute paths are given.
+func NewFFmpeg(ffprobe, ffmpeg string) (*FFmpeg, error) {
+	probePath, err := exec.LookPath(ffprobe)
+	if err != nil {
+		return nil, err
+	}
+
+	mpegPath, err := exec.LookPath(ffmpeg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FFmpeg{ffprobe: probePath, ffmpeg: mpegPath}, nil
+}
+
+// inputOptions keep the binaries on the local file, uploads may be playlists or concat lists naming
+// other files or URLs. Only the demuxers of common audio and video containers are allowed.
+var inputOptions = []string{
+	"-protocol_whitelist", "file,pipe",
+	"-format_whitelist", "mov,matroska,avi,asf,flv,mpegts,mpeg,ogg,mp3,aac,flac,wav,aiff,amr",
+}
+
+type probeOutput struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+	Streams []struct {
+		CodecType string `json:"codec_type"`
+		CodecName string `json:"codec_name"`
+		Width     int    `json:"width"`
+		Height    int    `json:"height"`
+	} `json:"streams"`
+}
+
+func (f *FFmpeg) Probe(ctx context.Context, path string) (Info, error) {
+	var info Info
+
+	args := append([]string{
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format", "-show_streams",
+	}, inputOptions...)
+
+	out, err := run(ctx, f.ffprobe, append(args, "file:"+path)...)
+	if err != nil {
+		return info, err
+	}
+
+	var parsed probeOutput
+	if jsonErr := json.Unmarshal(out, &parsed); jsonErr != nil {
+		return info, jsonErr
+	}
+
+	info.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	for _, s := range parsed.Streams {
+		switch {
+		case s.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = s.CodecName
+			info.Width = s.Width
+			info.Height = s.Height
+		case s.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = s.CodecName
+		}
+	}
+
+	return info, nil
+}
+
+func (f *FFmpeg) Poster(ctx context.Context, path string, at float64, dst io.Writer) error {
+	args := append([]string{
+		"-v", "error",
+		"-ss", strconv.FormatFloat(at, 'f', 3, 64),
+	}, inputOptions...)
+
+	out, err := run(ctx, f.ffmpeg, append(args,
+		"-i", "file:"+path,
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	)...)
+	if err != nil {
+		return err
+	}
+
+	if len(out) == 0 {
+		return ErrNoVideo
+	}
+
+	_, err = dst.Write(out)
+	return err
+}
+
+// PosterTime picks a representative moment of a video with the given duration.
+func PosterTime(duration float64) float64 {
+	if duration > 2 {
+		return 1
+	}
+
+	return duration / 2
+}
+
+func run(ctx context.Context, name string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.Bytes(), nil
+}
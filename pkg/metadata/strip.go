@@ -0,0 +1,237 @@
+// Package metadata removes EXIF, GPS and XMP data from images without re-encoding them.
+//
+// Orientation is part of EXIF as well, so cameras that rely on it may show
+// a stripped photo rotated.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var ErrMalformed = errors.New("malformed image")
+
+// Supported reports whether images of the given content type can be stripped.
+func Supported(contentType string) bool {
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	}
+
+	return false
+}
+
+// Strip copies the image from src to dst without metadata blocks.
+// Images of unsupported types are copied as is.
+func Strip(dst io.Writer, src io.Reader, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEG(dst, bufio.NewReader(src))
+	case "image/png":
+		return stripPNG(dst, src)
+	case "image/webp":
+		return stripWebP(dst, src)
+	}
+
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+const (
+	jpegSOI  = 0xD8
+	jpegEOI  = 0xD9
+	jpegSOS  = 0xDA
+	jpegAPP1 = 0xE1
+	jpegAPPD = 0xED
+	jpegCOM  = 0xFE
+)
+
+// stripJPEG drops APP1 (EXIF, XMP), APP13 (Photoshop, IPTC) and comment segments.
+// JFIF, ICC profiles and Adobe segments are kept since they affect how colors are rendered.
+func stripJPEG(dst io.Writer, src *bufio.Reader) error {
+	var soi [2]byte
+	if _, err := io.ReadFull(src, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != jpegSOI {
+		return ErrMalformed
+	}
+
+	if _, err := dst.Write(soi[:]); err != nil {
+		return err
+	}
+
+	for {
+		marker, err := readMarker(src)
+		if err != nil {
+			return err
+		}
+
+		// markers without a payload
+		if marker == jpegEOI || marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			if _, wErr := dst.Write([]byte{0xFF, marker}); wErr != nil {
+				return wErr
+			}
+			if marker == jpegEOI {
+				return nil
+			}
+			continue
+		}
+
+		var size [2]byte
+		if _, err = io.ReadFull(src, size[:]); err != nil {
+			return ErrMalformed
+		}
+
+		length := int64(binary.BigEndian.Uint16(size[:]))
+		if length < 2 {
+			return ErrMalformed
+		}
+
+		if marker == jpegAPP1 || marker == jpegAPPD || marker == jpegCOM {
+			if _, err = src.Discard(int(length - 2)); err != nil {
+				return ErrMalformed
+			}
+			continue
+		}
+
+		if _, err = dst.Write([]byte{0xFF, marker, size[0], size[1]}); err != nil {
+			return err
+		}
+
+		if marker == jpegSOS {
+			// entropy coded data follows, metadata can't appear there
+			_, err = io.Copy(dst, src)
+			return err
+		}
+
+		if _, err = io.CopyN(dst, src, length-2); err != nil {
+			return ErrMalformed
+		}
+	}
+}
+
+// readMarker skips fill bytes and returns the next marker code.
+func readMarker(src *bufio.Reader) (byte, error) {
+	b, err := src.ReadByte()
+	if err != nil || b != 0xFF {
+		return 0, ErrMalformed
+	}
+
+	for {
+		if b, err = src.ReadByte(); err != nil {
+			return 0, ErrMalformed
+		}
+		if b != 0xFF {
+			return b, nil
+		}
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngDropped are the chunks carrying EXIF, XMP (inside iTXt) or free form text.
+var pngDropped = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+func stripPNG(dst io.Writer, src io.Reader) error {
+	sig := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(src, sig); err != nil || !bytes.Equal(sig, pngSignature) {
+		return ErrMalformed
+	}
+
+	if _, err := dst.Write(sig); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(src, header[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return ErrMalformed
+		}
+
+		// data and crc
+		length := int64(binary.BigEndian.Uint32(header[:4])) + 4
+		if pngDropped[string(header[4:])] {
+			if _, err := io.CopyN(io.Discard, src, length); err != nil {
+				return ErrMalformed
+			}
+			continue
+		}
+
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+
+		if _, err := io.CopyN(dst, src, length); err != nil {
+			return ErrMalformed
+		}
+
+		if string(header[4:]) == "IEND" {
+			return nil
+		}
+	}
+}
+
+const (
+	webpFlagXMP  = 1 << 2
+	webpFlagEXIF = 1 << 3
+)
+
+// stripWebP drops EXIF and XMP chunks and clears their flags in the VP8X header.
+// The whole image is buffered because the RIFF size precedes the chunks.
+func stripWebP(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return ErrMalformed
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for rest := data[12:]; len(rest) > 0; {
+		if len(rest) < 8 {
+			return ErrMalformed
+		}
+
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		end := 8 + size + size%2
+		if size < 0 || end > len(rest) {
+			return ErrMalformed
+		}
+
+		chunk := rest[:end]
+		rest = rest[end:]
+
+		switch string(chunk[:4]) {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			if size < 1 {
+				return ErrMalformed
+			}
+			chunk = append([]byte(nil), chunk...)
+			chunk[8] &^= webpFlagXMP | webpFlagEXIF
+		}
+
+		out.Write(chunk)
+	}
+
+	riff := out.Bytes()
+	binary.LittleEndian.PutUint32(riff[4:8], uint32(len(riff)-8))
+
+	_, err = dst.Write(riff)
+	return err
+}
@@ -0,0 +1,155 @@
+// Package metrics exposes the server metrics in the Prometheus format.
+package metrics
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const namespace = "server"
+
+// Metrics collects the HTTP metrics and the metrics registered by other parts of the server.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	uploaded   prometheus.Counter
+	downloaded prometheus.Counter
+	active     prometheus.Gauge
+	rejected   *prometheus.CounterVec
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "Handled requests by route, method and status.",
+		}, []string{"route", "method", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time spent in the handlers by route and method, streamed bodies excluded.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		uploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "Bytes received in request bodies.",
+		}),
+		downloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes sent in response bodies of a known length.",
+		}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "active_transfers",
+			Help:      "Requests being received, handled or sent.",
+		}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rejected_uploads_total",
+			Help:      "Uploads refused by reason.",
+		}, []string{"reason"}),
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.latency, m.uploaded, m.downloaded, m.active, m.rejected,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return m
+}
+
+// MustRegister adds collectors of other parts of the server.
+func (m *Metrics) MustRegister(cs ...prometheus.Collector) {
+	m.registry.MustRegister(cs...)
+}
+
+// GaugeFunc registers a gauge whose value is taken from fn on every scrape.
+func (m *Metrics) GaugeFunc(name, help string, fn func() float64) {
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// Handler serves the metrics to Prometheus.
+func (m *Metrics) Handler() fiber.Handler {
+	return adaptor.HTTPHandler(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// Middleware counts the requests with their latency and the bytes transferred.
+func (m *Metrics) Middleware() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		start := time.Now()
+		err := ctx.Next()
+
+		// the error handler sets the status after the middleware returns
+		status := ctx.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+		}
+
+		route := ctx.Route().Path
+		// the method points into the request buffer that is reused by the next request
+		method := utils.CopyString(ctx.Method())
+		m.requests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+		m.latency.WithLabelValues(route, method).Observe(time.Since(start).Seconds())
+
+		if n := ctx.Request().Header.ContentLength(); n > 0 {
+			m.uploaded.Add(float64(n))
+		}
+
+		if n := ctx.Response().Header.ContentLength(); n > 0 && method != fiber.MethodHead {
+			m.downloaded.Add(float64(n))
+		}
+
+		return err
+	}
+}
+
+// Rejected counts an upload refused for the given reason.
+func (m *Metrics) Rejected(reason string) {
+	m.rejected.WithLabelValues(reason).Inc()
+}
+
+// ConnState tracks the connections busy with a request, set it as fasthttp.Server.ConnState.
+// A connection stays active until its response is sent, streamed bodies included.
+func (m *Metrics) ConnState(conn net.Conn, state fasthttp.ConnState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, active := m.conns[conn]
+	switch {
+	case state == fasthttp.StateActive && !active:
+		m.conns[conn] = struct{}{}
+		m.active.Inc()
+	case state != fasthttp.StateActive && active:
+		delete(m.conns, conn)
+		m.active.Dec()
+	}
+}
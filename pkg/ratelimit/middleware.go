@@ -0,0 +1,37 @@
+package ratelimit
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/response"
+	"strconv"
+)
+
+var ErrTooManyRequests = errors.New("too many requests, try again later")
+
+// Middleware refuses the requests of a client IP past limit in a window of l.
+// The limit is read for every request, so it may change while the server runs, zero lets every request through.
+// Requests to the exempt paths, such as health checks, are neither counted nor refused.
+func Middleware(l *Limiter, limit func() int, reply *response.Reply, exempt ...string) fiber.Handler {
+	skip := make(map[string]bool, len(exempt))
+	for _, p := range exempt {
+		skip[p] = true
+	}
+
+	retryAfter := strconv.Itoa(int(l.window.Seconds()))
+
+	return func(ctx *fiber.Ctx) error {
+		n := limit()
+		if n <= 0 || skip[ctx.Path()] {
+			return ctx.Next()
+		}
+
+		if !l.Allow(ctx.IP(), n) {
+			// the window of the client may end sooner, it is not tracked precisely
+			ctx.Set(fiber.HeaderRetryAfter, retryAfter)
+			return reply.TooManyRequests(ctx, ErrTooManyRequests)
+		}
+
+		return ctx.Next()
+	}
+}
@@ -0,0 +1,95 @@
+// Package ratelimit counts events by key in fixed windows of time.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter counts the events of every key since the start of its current window.
+// The limit is given on every check, so it can change while the limiter is in use.
+type Limiter struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	counts map[string]*count
+	// swept is the last time the expired windows were removed
+	swept time.Time
+}
+
+type count struct {
+	start time.Time
+	n     int
+}
+
+// New returns a limiter with windows of the given length.
+func New(window time.Duration) *Limiter {
+	return &Limiter{window: window, counts: make(map[string]*count), swept: time.Now()}
+}
+
+// Exceeded reports whether key has had at least limit events in its current window.
+func (l *Limiter) Exceeded(key string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.current(key, time.Now())
+
+	return c != nil && c.n >= limit
+}
+
+// Allow records an event of key unless it would go over limit, it reports whether the event was recorded.
+func (l *Limiter) Allow(key string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if c := l.current(key, now); c != nil && c.n >= limit {
+		return false
+	}
+	l.add(key, now)
+
+	return true
+}
+
+// Add records an event of key.
+func (l *Limiter) Add(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.add(key, time.Now())
+}
+
+func (l *Limiter) add(key string, now time.Time) {
+	c := l.current(key, now)
+	if c == nil {
+		c = &count{start: now}
+		l.counts[key] = c
+	}
+	c.n++
+
+	l.sweep(now)
+}
+
+// current returns the count of key, nil when its window is over.
+func (l *Limiter) current(key string, now time.Time) *count {
+	c, ok := l.counts[key]
+	if !ok || now.Sub(c.start) >= l.window {
+		return nil
+	}
+
+	return c
+}
+
+// sweep removes the windows that are over once per window, so idle keys don't pile up.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < l.window {
+		return
+	}
+	l.swept = now
+
+	for key, c := range l.counts {
+		if now.Sub(c.start) >= l.window {
+			delete(l.counts, key)
+		}
+	}
+}
@@ -71,6 +71,10 @@ func (r *Reply) Created(ctx *fiber.Ctx, data any) error {
 	return request(ctx, r.l, http.StatusCreated, data)
 }
 
+func (r *Reply) Accepted(ctx *fiber.Ctx, data any) error {
+	return request(ctx, r.l, http.StatusAccepted, data)
+}
+
 func (r *Reply) NoContent(ctx *fiber.Ctx, err error) error {
 	return request(ctx, r.l, http.StatusNoContent, err)
 }
@@ -91,6 +95,10 @@ func (r *Reply) Conflict(ctx *fiber.Ctx, data any) error {
 	return request(ctx, r.l, http.StatusConflict, data)
 }
 
+func (r *Reply) PreconditionFailed(ctx *fiber.Ctx, err error) error {
+	return request(ctx, r.l, http.StatusPreconditionFailed, err)
+}
+
 func (r *Reply) UnprocessableEntity(ctx *fiber.Ctx, err error) error {
 	return request(ctx, r.l, http.StatusUnprocessableEntity, err)
 }
@@ -99,6 +107,6 @@ func (r *Reply) TooManyRequests(ctx *fiber.Ctx, err error) error {
 	return request(ctx, r.l, http.StatusTooManyRequests, err)
 }
 
-func (r *Reply) ServiceUnavailable(ctx *fiber.Ctx, err error) error {
-	return request(ctx, r.l, http.StatusServiceUnavailable, err)
+func (r *Reply) ServiceUnavailable(ctx *fiber.Ctx, data any) error {
+	return request(ctx, r.l, http.StatusServiceUnavailable, data)
 }
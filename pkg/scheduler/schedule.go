@@ -0,0 +1,183 @@
+package scheduler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// Schedule tells when a job runs next.
+type Schedule interface {
+	// Next returns the first moment to run after t.
+	Next(t time.Time) time.Time
+}
+
+// every runs at a fixed interval counted from the previous run.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+var descriptors = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// Parse reads a schedule written as
+//
+//	10m                an interval in the format of time.ParseDuration
+//	@every 10m         the same
+//	@hourly, @daily, @weekly or @monthly
+//	*/15 3-5 * * 1,3   a five-field cron expression: minute, hour, day of month, month, day of week
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if cron, ok := descriptors[spec]; ok {
+		spec = cron
+	}
+
+	interval, isEvery := strings.CutPrefix(spec, "@every ")
+	if d, err := time.ParseDuration(strings.TrimSpace(interval)); err == nil {
+		if d <= 0 {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, spec)
+		}
+		return every(d), nil
+	}
+
+	if isEvery {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, spec)
+	}
+
+	return parseCron(spec)
+}
+
+// cron matches the moments whose fields are all set in the bitmasks.
+type cron struct {
+	minute, hour, dom, month, dow uint64
+	// anyDom and anyDow are set for a star in the day field, then only the other one counts
+	anyDom, anyDow bool
+}
+
+// cronFields are the bounds of the fields of a cron expression.
+var cronFields = [5]struct{ min, max int }{
+	{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6},
+}
+
+func parseCron(spec string) (Schedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchedule, spec)
+	}
+
+	var masks [5]uint64
+	for i, field := range fields {
+		mask, err := parseField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrInvalidSchedule, spec, err)
+		}
+		masks[i] = mask
+	}
+
+	return &cron{
+		minute: masks[0],
+		hour:   masks[1],
+		dom:    masks[2],
+		month:  masks[3],
+		dow:    masks[4],
+		anyDom: fields[2] == "*",
+		anyDow: fields[4] == "*",
+	}, nil
+}
+
+// parseField turns a comma separated list of *, n, a-b, optionally followed by /step, into a bitmask.
+func parseField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			from, to, isRange := strings.Cut(rng, "-")
+
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("bad value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("bad range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+
+	return mask, nil
+}
+
+// maxCronSearch bounds the search of a matching minute, a valid expression matches within a few years.
+const maxCronSearch = 5 * 366 * 24 * time.Hour
+
+func (c *cron) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxCronSearch)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	// such as February 30th
+	return time.Time{}
+}
+
+// dayMatches follows cron: when both day fields are restricted either of them is enough.
+func (c *cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dow
+	case c.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
@@ -0,0 +1,259 @@
+// Package scheduler runs maintenance jobs in the background on cron-like schedules.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/labi-le/server/pkg/log"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownJob = errors.New("unknown job")
+	ErrRunning    = errors.New("job is already running")
+)
+
+// historySize is the number of the latest runs kept for every job.
+const historySize = 10
+
+// Job is a named piece of work run on a schedule.
+type Job struct {
+	Name string
+	// Schedule is parsed with Parse
+	Schedule string
+	// Disabled jobs are not scheduled, they still may be started by hand
+	Disabled bool
+	Run      func(ctx context.Context) error
+}
+
+// Run is the outcome of a single run of a job.
+type Run struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Status describes a job with its latest runs, the newest one goes first.
+type Status struct {
+	Name     string     `json:"name"`
+	Schedule string     `json:"schedule"`
+	Enabled  bool       `json:"enabled"`
+	Running  bool       `json:"running"`
+	NextRun  *time.Time `json:"next_run,omitempty"`
+	LastRun  *Run       `json:"last_run,omitempty"`
+	History  []Run      `json:"history"`
+}
+
+type entry struct {
+	job      Job
+	schedule Schedule
+	trigger  chan struct{}
+
+	// guarded by the mutex of the scheduler
+	running bool
+	next    time.Time
+	history []Run
+}
+
+// Scheduler runs the added jobs, at most the given number at once.
+type Scheduler struct {
+	log log.Logger
+
+	mu      sync.Mutex
+	entries []*entry
+	slots   chan struct{}
+	wg      sync.WaitGroup
+}
+
+// New creates a scheduler running up to parallel jobs at the same time.
+func New(parallel int, l log.Logger) *Scheduler {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	return &Scheduler{
+		log:   l,
+		slots: make(chan struct{}, parallel),
+	}
+}
+
+// Add registers a job, it must be called before Start.
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := Parse(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", job.Name, err)
+	}
+
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("job %s: %w: %s never comes", job.Name, ErrInvalidSchedule, job.Schedule)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if e.job.Name == job.Name {
+			return fmt.Errorf("job %s is added twice", job.Name)
+		}
+	}
+
+	s.entries = append(s.entries, &entry{
+		job:      job,
+		schedule: schedule,
+		trigger:  make(chan struct{}, 1),
+	})
+
+	return nil
+}
+
+// Start runs the jobs until ctx is done, Wait returns once the running ones finish.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		s.wg.Add(1)
+		go s.loop(ctx, e)
+	}
+}
+
+// Wait blocks until the jobs stop after the context passed to Start is done.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// Trigger starts a job right away unless it is running.
+func (s *Scheduler) Trigger(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range s.entries {
+		if e.job.Name != name {
+			continue
+		}
+
+		if e.running {
+			return ErrRunning
+		}
+
+		select {
+		case e.trigger <- struct{}{}:
+			return nil
+		default:
+			return ErrRunning
+		}
+	}
+
+	return ErrUnknownJob
+}
+
+// Status returns the state of every job in the order they were added.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]Status, 0, len(s.entries))
+	for _, e := range s.entries {
+		status := Status{
+			Name:     e.job.Name,
+			Schedule: e.job.Schedule,
+			Enabled:  !e.job.Disabled,
+			Running:  e.running,
+			History:  make([]Run, len(e.history)),
+		}
+
+		if !e.next.IsZero() {
+			next := e.next
+			status.NextRun = &next
+		}
+
+		// the history is kept oldest first
+		for i, run := range e.history {
+			status.History[len(e.history)-1-i] = run
+		}
+		if len(status.History) > 0 {
+			status.LastRun = &status.History[0]
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func (s *Scheduler) loop(ctx context.Context, e *entry) {
+	defer s.wg.Done()
+
+	for {
+		var (
+			timer *time.Timer
+			fire  <-chan time.Time
+		)
+		if next := s.plan(e); !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-fire:
+		case <-e.trigger:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case s.slots <- struct{}{}:
+		}
+
+		s.run(ctx, e)
+		<-s.slots
+	}
+}
+
+// plan sets the next run of e, it is zero for disabled jobs and schedules that never fire.
+func (s *Scheduler) plan(e *entry) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.next = time.Time{}
+	if !e.job.Disabled {
+		e.next = e.schedule.Next(time.Now())
+	}
+
+	return e.next
+}
+
+func (s *Scheduler) run(ctx context.Context, e *entry) {
+	s.mu.Lock()
+	e.running = true
+	s.mu.Unlock()
+
+	run := Run{StartedAt: time.Now()}
+	err := e.job.Run(ctx)
+	run.FinishedAt = time.Now()
+
+	if err != nil {
+		run.Error = err.Error()
+		s.log.Warnf("job %s failed: %s", e.job.Name, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.running = false
+	e.history = append(e.history, run)
+	if len(e.history) > historySize {
+		e.history = e.history[len(e.history)-historySize:]
+	}
+}
@@ -0,0 +1,353 @@
+// Package sigv4 verifies requests signed with AWS Signature Version 4,
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+package sigv4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed         = errors.New("malformed signature")
+	ErrAccessKey         = errors.New("unknown access key")
+	ErrSignature         = errors.New("signature does not match")
+	ErrExpired           = errors.New("request has expired")
+	ErrContentSHA256     = errors.New("payload hash does not match")
+	ErrUnsupportedScheme = errors.New("unsupported signature algorithm")
+)
+
+const (
+	algorithm     = "AWS4-HMAC-SHA256"
+	timeFormat    = "20060102T150405Z"
+	unsigned      = "UNSIGNED-PAYLOAD"
+	streaming     = "STREAMING-"
+	unsignedChunk = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	chunkSigning  = "AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256   = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxClockSkew  = 15 * time.Minute
+	maxPresignTTL = 7 * 24 * time.Hour
+)
+
+// Credentials returns the secret of an access key.
+type Credentials func(accessKey string) (secret string, ok bool)
+
+// Request is the part of an HTTP request covered by the signature.
+type Request struct {
+	Method string
+	// Path is the request path as sent by the client, still escaped
+	Path   string
+	Query  url.Values
+	Header http.Header
+	// Host is the value of the Host header
+	Host string
+	Body []byte
+}
+
+// Signature is the result of a successful verification.
+type Signature struct {
+	AccessKey string
+	// Streaming reports whether the body is sent in aws-chunked encoding, see DecodeChunks
+	Streaming bool
+
+	payload string
+	date    string
+	scope   string
+	seed    string
+	key     []byte
+}
+
+// Signed reports whether the request carries a signature in the header or in the query.
+func Signed(header http.Header, query url.Values) bool {
+	return strings.HasPrefix(header.Get("Authorization"), "AWS4-") || query.Get("X-Amz-Algorithm") != ""
+}
+
+// Verify checks the signature of r at the moment now.
+func Verify(r Request, creds Credentials, now time.Time) (Signature, error) {
+	if r.Query.Get("X-Amz-Algorithm") != "" {
+		return verifyQuery(r, creds, now)
+	}
+
+	return verifyHeader(r, creds, now)
+}
+
+// authorization holds the fields of a signature, wherever they came from.
+type authorization struct {
+	credential    string
+	signedHeaders []string
+	signature     string
+	date          string
+	payload       string
+}
+
+func verifyHeader(r Request, creds Credentials, now time.Time) (Signature, error) {
+	scheme, params, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok {
+		return Signature{}, ErrMalformed
+	}
+
+	if scheme != algorithm {
+		return Signature{}, ErrUnsupportedScheme
+	}
+
+	auth := authorization{
+		date:    r.Header.Get("X-Amz-Date"),
+		payload: r.Header.Get("X-Amz-Content-Sha256"),
+	}
+	for _, param := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		switch k {
+		case "Credential":
+			auth.credential = v
+		case "SignedHeaders":
+			auth.signedHeaders = strings.Split(v, ";")
+		case "Signature":
+			auth.signature = v
+		}
+	}
+
+	if auth.date == "" {
+		auth.date = r.Header.Get("Date")
+	}
+
+	signedAt, err := time.Parse(timeFormat, auth.date)
+	if err != nil {
+		return Signature{}, ErrMalformed
+	}
+
+	if d := now.Sub(signedAt); d > maxClockSkew || d < -maxClockSkew {
+		return Signature{}, ErrExpired
+	}
+
+	switch {
+	case auth.payload == "":
+		// the body is signed without the header as well, it can't be swapped for another one
+		auth.payload = hashHex(r.Body)
+	case auth.payload != unsigned && !strings.HasPrefix(auth.payload, streaming) && hashHex(r.Body) != auth.payload:
+		return Signature{}, ErrContentSHA256
+	}
+
+	return check(r, auth, r.Query, creds)
+}
+
+func verifyQuery(r Request, creds Credentials, now time.Time) (Signature, error) {
+	if r.Query.Get("X-Amz-Algorithm") != algorithm {
+		return Signature{}, ErrUnsupportedScheme
+	}
+
+	auth := authorization{
+		credential:    r.Query.Get("X-Amz-Credential"),
+		signedHeaders: strings.Split(r.Query.Get("X-Amz-SignedHeaders"), ";"),
+		signature:     r.Query.Get("X-Amz-Signature"),
+		date:          r.Query.Get("X-Amz-Date"),
+		payload:       unsigned,
+	}
+
+	signedAt, err := time.Parse(timeFormat, auth.date)
+	if err != nil {
+		return Signature{}, ErrMalformed
+	}
+
+	seconds, err := strconv.Atoi(r.Query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > maxPresignTTL {
+		return Signature{}, ErrMalformed
+	}
+
+	if now.Before(signedAt.Add(-maxClockSkew)) || now.After(signedAt.Add(time.Duration(seconds)*time.Second)) {
+		return Signature{}, ErrExpired
+	}
+
+	// the signature can't sign itself
+	query := make(url.Values, len(r.Query))
+	for k, v := range r.Query {
+		if k != "X-Amz-Signature" {
+			query[k] = v
+		}
+	}
+
+	return check(r, auth, query, creds)
+}
+
+func check(r Request, auth authorization, query url.Values, creds Credentials) (Signature, error) {
+	// Credential=<access key>/<date>/<region>/<service>/aws4_request
+	parts := strings.Split(auth.credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || !strings.HasPrefix(auth.date, parts[1]) {
+		return Signature{}, ErrMalformed
+	}
+
+	secret, ok := creds(parts[0])
+	if !ok {
+		return Signature{}, ErrAccessKey
+	}
+
+	sig := Signature{
+		AccessKey: parts[0],
+		Streaming: strings.HasPrefix(auth.payload, streaming),
+		payload:   auth.payload,
+		date:      auth.date,
+		scope:     strings.Join(parts[1:], "/"),
+		seed:      auth.signature,
+		key:       signingKey(secret, parts[1], parts[2], parts[3]),
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		canonicalPath(r.Path),
+		canonicalQuery(query),
+		canonicalHeaders(r, auth.signedHeaders),
+		strings.Join(auth.signedHeaders, ";"),
+		auth.payload,
+	}, "\n")
+
+	expected := sig.sign(algorithm, hashHex([]byte(canonical)))
+	if !hmac.Equal([]byte(expected), []byte(auth.signature)) {
+		return Signature{}, ErrSignature
+	}
+
+	return sig, nil
+}
+
+// DecodeChunks returns the payload of an aws-chunked body checking the signature of every chunk.
+// Trailing headers such as checksums are skipped.
+func (s Signature) DecodeChunks(body []byte) ([]byte, error) {
+	var (
+		payload []byte
+		prev    = s.seed
+	)
+
+	for {
+		// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+		line, rest, ok := bytes.Cut(body, []byte("\r\n"))
+		if !ok {
+			return nil, ErrMalformed
+		}
+
+		sizeHex, params, _ := bytes.Cut(line, []byte(";"))
+		size, err := strconv.ParseInt(string(sizeHex), 16, 64)
+		if err != nil || size < 0 || int64(len(rest)) < size {
+			return nil, ErrMalformed
+		}
+
+		data := rest[:size]
+		if s.payload != unsignedChunk {
+			signature, found := bytes.CutPrefix(params, []byte("chunk-signature="))
+			if !found {
+				return nil, ErrMalformed
+			}
+
+			expected := s.sign(chunkSigning, prev+"\n"+emptySHA256+"\n"+hashHex(data))
+			if !hmac.Equal([]byte(expected), signature) {
+				return nil, ErrSignature
+			}
+			prev = expected
+		}
+
+		if size == 0 {
+			return payload, nil
+		}
+
+		payload = append(payload, data...)
+		body = bytes.TrimPrefix(rest[size:], []byte("\r\n"))
+	}
+}
+
+// sign signs the string made of the algorithm, the date and the scope followed by tail.
+func (s Signature) sign(algorithm, tail string) string {
+	return hex.EncodeToString(hmacSHA256(s.key, algorithm+"\n"+s.date+"\n"+s.scope+"\n"+tail))
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// canonicalPath encodes every segment of the path once, as S3 does.
+func canonicalPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if unescaped, err := url.PathUnescape(segment); err == nil {
+			segment = unescaped
+		}
+		segments[i] = escape(segment)
+	}
+
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, escape(k)+"="+escape(v))
+		}
+	}
+
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(r Request, signed []string) string {
+	var b strings.Builder
+	for _, name := range signed {
+		value := strings.Join(r.Header.Values(name), ",")
+		if name == "host" {
+			value = r.Host
+		}
+
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(strings.Fields(value), " "))
+		b.WriteByte('\n')
+	}
+
+	return b.String()
+}
+
+// escape percent-encodes everything except the unreserved characters of RFC 3986.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+	}
+
+	return b.String()
+}
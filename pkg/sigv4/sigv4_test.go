@@ -0,0 +1,82 @@
+package sigv4
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	accessKey = "owner"
+	secret    = "secret"
+)
+
+func credentials(k string) (string, bool) {
+	return secret, k == accessKey
+}
+
+// signHeader signs r in the Authorization header for the given payload hash, like a client would.
+// The hash is not sent in X-Amz-Content-Sha256.
+func signHeader(r *Request, payload string, now time.Time) {
+	date := now.UTC().Format(timeFormat)
+	r.Header.Set("X-Amz-Date", date)
+
+	signed := []string{"host", "x-amz-date"}
+	scope := date[:8] + "/us-east-1/s3/aws4_request"
+	sig := Signature{date: date, scope: scope, key: signingKey(secret, date[:8], "us-east-1", "s3")}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		canonicalPath(r.Path),
+		canonicalQuery(r.Query),
+		canonicalHeaders(*r, signed),
+		strings.Join(signed, ";"),
+		payload,
+	}, "\n")
+
+	r.Header.Set("Authorization", algorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+sig.sign(algorithm, hashHex([]byte(canonical))))
+}
+
+func TestVerifySignsTheBodyWithoutTheContentHashHeader(t *testing.T) {
+	now := time.Now()
+	newRequest := func(body string) Request {
+		return Request{
+			Method: http.MethodPut,
+			Path:   "/files/a.txt",
+			Query:  url.Values{},
+			Header: http.Header{},
+			Host:   "localhost",
+			Body:   []byte(body),
+		}
+	}
+
+	r := newRequest("content")
+	signHeader(&r, hashHex(r.Body), now)
+	if _, err := Verify(r, credentials, now); err != nil {
+		t.Fatalf("request signed for its body: %v", err)
+	}
+
+	// a signature made for an empty body doesn't carry another one
+	r = newRequest("")
+	signHeader(&r, hashHex(nil), now)
+	if _, err := Verify(r, credentials, now); err != nil {
+		t.Fatalf("request signed for an empty body: %v", err)
+	}
+
+	r.Body = []byte("injected")
+	if _, err := Verify(r, credentials, now); !errors.Is(err, ErrSignature) {
+		t.Fatalf("request with a body added after signing: %v, want %v", err, ErrSignature)
+	}
+
+	// the header must match the body it announces
+	r = newRequest("content")
+	r.Header.Set("X-Amz-Content-Sha256", hashHex(nil))
+	signHeader(&r, hashHex(nil), now)
+	if _, err := Verify(r, credentials, now); !errors.Is(err, ErrContentSHA256) {
+		t.Fatalf("request announcing another body: %v, want %v", err, ErrContentSHA256)
+	}
+}
@@ -0,0 +1,250 @@
+package sqlitedb
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/philippgille/gokv/encoding"
+	"github.com/philippgille/gokv/util"
+	"strings"
+
+	// registers the "sqlite3" driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Store is a gokv.Store implementation for SQLite.
+// Unlike BadgerDB and bbolt the database can be read by other processes while the server is running.
+type Store struct {
+	db    *sql.DB
+	codec encoding.Codec
+}
+
+// Set stores the given value for the given key.
+// Values are automatically marshalled to JSON or gob (depending on the configuration).
+// The key must not be "" and the value must not be nil.
+func (s Store) Set(k string, v interface{}) error {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return err
+	}
+
+	// First turn the passed object into something that SQLite can handle
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v`, k, data)
+	return err
+}
+
+// Get retrieves the stored value for the given key.
+// You need to pass a pointer to the value, so in case of a struct
+// the automatic unmarshalling can populate the fields of the object
+// that v points to with the values of the retrieved object's values.
+// If no value is found it returns (false, nil).
+// The key must not be "" and the pointer must not be nil.
+func (s Store) Get(k string, v interface{}) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	var data []byte
+	err := s.db.QueryRow(`SELECT v FROM kv WHERE k = ?`, k).Scan(&data)
+	// If no value was found return false
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, s.codec.Unmarshal(data, v)
+}
+
+// Delete deletes the stored value for the given key.
+// Deleting a non-existing key-value pair does NOT lead to an error.
+// The key must not be "".
+func (s Store) Delete(k string) error {
+	if err := util.CheckKey(k); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`DELETE FROM kv WHERE k = ?`, k)
+	return err
+}
+
+// Move stores the given value for newK and deletes oldK in a single transaction.
+// The keys must not be "" and the value must not be nil.
+func (s Store) Move(oldK, newK string, v interface{}) error {
+	if err := util.CheckKey(oldK); err != nil {
+		return err
+	}
+	if err := util.CheckKeyAndValue(newK, v); err != nil {
+		return err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`INSERT INTO kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO UPDATE SET v = excluded.v`, newK, data); err != nil {
+		tx.Rollback() //nolint:errcheck // the insert error is more important
+		return err
+	}
+
+	if _, err = tx.Exec(`DELETE FROM kv WHERE k = ?`, oldK); err != nil {
+		tx.Rollback() //nolint:errcheck // the delete error is more important
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Modify loads the value stored for k into v, calls fn and stores v in a single transaction.
+// Nothing is stored if fn fails, its error is returned. If no value is found it returns (false, nil)
+// without calling fn. The key must not be "" and the pointer must not be nil.
+func (s Store) Modify(k string, v interface{}, fn func() error) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	// the single connection keeps other writers out until the transaction ends
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+
+	var data []byte
+	err = tx.QueryRow(`SELECT v FROM kv WHERE k = ?`, k).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, tx.Rollback()
+	} else if err != nil {
+		tx.Rollback() //nolint:errcheck // the query error is more important
+		return false, err
+	}
+
+	err = s.codec.Unmarshal(data, v)
+	if err == nil {
+		err = fn()
+	}
+	if err == nil {
+		data, err = s.codec.Marshal(v)
+	}
+	if err == nil {
+		_, err = tx.Exec(`UPDATE kv SET v = ? WHERE k = ?`, data, k)
+	}
+
+	if err != nil {
+		tx.Rollback() //nolint:errcheck // the first error is more important
+		return true, err
+	}
+
+	return true, tx.Commit()
+}
+
+// Insert stores the given value for the given key unless the key already has one, in a single statement.
+// It returns false without storing anything when the key is taken.
+// The key must not be "" and the value must not be nil.
+func (s Store) Insert(k string, v interface{}) (bool, error) {
+	if err := util.CheckKeyAndValue(k, v); err != nil {
+		return false, err
+	}
+
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.Exec(`INSERT INTO kv (k, v) VALUES (?, ?) ON CONFLICT (k) DO NOTHING`, k, data)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// Keys returns the keys starting with the given prefix in lexicographical order.
+// An empty prefix returns all keys.
+func (s Store) Keys(prefix string) ([]string, error) {
+	// LIKE is case-insensitive and has wildcards, substr of a blob compares the bytes as they are
+	rows, err := s.db.Query(`SELECT k FROM kv WHERE substr(CAST(k AS BLOB), 1, ?) = CAST(? AS BLOB) ORDER BY k`, len(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var k string
+		if err = rows.Scan(&k); err != nil {
+			return keys, err
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// Close closes the store.
+// It must be called to make sure that all pending updates make their way to disk.
+func (s Store) Close() error {
+	return s.db.Close()
+}
+
+// Options are the options for the SQLite store.
+type Options struct {
+	// Path of the DB file.
+	// Optional ("sqlite.db" by default).
+	Path string
+	// Encoding format.
+	// Optional (encoding.JSON by default).
+	Codec encoding.Codec
+}
+
+// DefaultOptions is an Options object with default values.
+// Path: "sqlite.db", Codec: encoding.JSON
+var DefaultOptions = Options{
+	Path:  "sqlite.db",
+	Codec: encoding.JSON,
+}
+
+// NewStore creates a new SQLite store.
+// The WAL journal lets readers in other processes work next to the server.
+//
+// You must call the Close() method on the store when you're done working with it.
+func NewStore(options Options) (Store, error) {
+	result := Store{}
+
+	// Set default values
+	if options.Path == "" {
+		options.Path = DefaultOptions.Path
+	}
+	if options.Codec == nil {
+		options.Codec = DefaultOptions.Codec
+	}
+
+	dsn := "file:" + strings.ReplaceAll(options.Path, "?", "%3f") + "?_journal_mode=WAL&_busy_timeout=5000"
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return result, err
+	}
+
+	// SQLite allows a single writer, concurrent writes would fail with "database is locked"
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (k TEXT PRIMARY KEY, v BLOB NOT NULL)`); err != nil {
+		db.Close()
+		return result, err
+	}
+
+	result.db = db
+	result.codec = options.Codec
+
+	return result, nil
+}
@@ -0,0 +1,200 @@
+// Package thumbnail resizes and converts images without any C dependencies.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+
+	"golang.org/x/image/draw"
+
+	// registers the webp decoder for image.Decode
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrInvalidOptions    = errors.New("invalid thumbnail options")
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+	ErrTooLarge          = errors.New("image has too many pixels")
+)
+
+// MaxDimension limits the size of generated images.
+const MaxDimension = 4096
+
+// MaxPixels limits the size of source images, a decoded image takes up to 8 bytes per pixel.
+const MaxPixels = 50_000_000
+
+// Fit describes how the image is placed into the requested box.
+type Fit string
+
+const (
+	// FitCover fills the whole box cropping what does not fit.
+	FitCover Fit = "cover"
+	// FitContain scales the image to fit inside the box keeping the aspect ratio.
+	FitContain Fit = "contain"
+	// FitFill stretches the image to the exact box size.
+	FitFill Fit = "fill"
+)
+
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+)
+
+const jpegQuality = 85
+
+// Options of a derived image.
+// Zero Width or Height is calculated from the aspect ratio, both zero keep the original size.
+// A calculated side is kept within MaxDimension, the other one shrinks with it.
+type Options struct {
+	Width  int
+	Height int
+	Fit    Fit
+	Format string
+}
+
+var decodable = map[string]string{
+	"image/jpeg": FormatJPEG,
+	"image/png":  FormatPNG,
+	"image/gif":  FormatGIF,
+	"image/webp": FormatPNG,
+}
+
+// Supported reports whether images of the given content type can be used as a source.
+func Supported(contentType string) bool {
+	_, ok := decodable[contentType]
+	return ok
+}
+
+// Resolve fills the defaults for an image of the given content type and validates the options.
+// Images are kept in their own format unless it cannot be encoded, webp becomes png.
+func (o Options) Resolve(contentType string) (Options, error) {
+	if o.Format == "" {
+		o.Format = decodable[contentType]
+	}
+
+	if o.Fit == "" {
+		o.Fit = FitCover
+	}
+
+	switch {
+	case o.Width < 0 || o.Height < 0 || o.Width > MaxDimension || o.Height > MaxDimension:
+		return o, ErrInvalidOptions
+	case o.Fit != FitCover && o.Fit != FitContain && o.Fit != FitFill:
+		return o, ErrInvalidOptions
+	case o.Format != FormatJPEG && o.Format != FormatPNG && o.Format != FormatGIF:
+		return o, ErrUnsupportedFormat
+	}
+
+	return o, nil
+}
+
+// Key identifies the derived image, it is safe to use as a part of a file name.
+func (o Options) Key() string {
+	return fmt.Sprintf("%dx%d_%s.%s", o.Width, o.Height, o.Fit, o.Format)
+}
+
+// ContentType of the derived image.
+func (o Options) ContentType() string {
+	return "image/" + o.Format
+}
+
+// Render decodes the image from src, resizes it and writes it to dst in the requested format.
+// Sources above MaxPixels are rejected before they are decoded.
+func Render(dst io.Writer, src io.Reader, o Options) error {
+	// the header is read twice, the second time from the buffer
+	var header bytes.Buffer
+	cfg, _, err := image.DecodeConfig(io.TeeReader(src, &header))
+	if err != nil {
+		return ErrUnsupportedFormat
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return ErrTooLarge
+	}
+
+	img, _, err := image.Decode(io.MultiReader(&header, src))
+	if err != nil {
+		return ErrUnsupportedFormat
+	}
+
+	resized := resize(img, o)
+
+	switch o.Format {
+	case FormatJPEG:
+		return jpeg.Encode(dst, resized, &jpeg.Options{Quality: jpegQuality})
+	case FormatPNG:
+		return png.Encode(dst, resized)
+	case FormatGIF:
+		return gif.Encode(dst, resized, nil)
+	}
+
+	return ErrUnsupportedFormat
+}
+
+func resize(img image.Image, o Options) image.Image {
+	src := img.Bounds()
+	sw, sh := src.Dx(), src.Dy()
+	w, h := o.Width, o.Height
+
+	switch {
+	case w == 0 && h == 0, sw == 0 || sh == 0:
+		return img
+	case w == 0:
+		w = max(1, sw*h/sh)
+		// a wide image would get a side far beyond the requested one
+		if w > MaxDimension {
+			w, h = MaxDimension, max(1, sh*MaxDimension/sw)
+		}
+	case h == 0:
+		h = max(1, sh*w/sw)
+		if h > MaxDimension {
+			w, h = max(1, sw*MaxDimension/sh), MaxDimension
+		}
+	default:
+		switch o.Fit {
+		case FitContain:
+			if sw*h > sh*w {
+				h = max(1, sh*w/sw)
+			} else {
+				w = max(1, sw*h/sh)
+			}
+		case FitCover:
+			src = crop(src, w, h)
+		case FitFill:
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+
+	return dst
+}
+
+// crop returns the centered part of r having the aspect ratio of w:h.
+func crop(r image.Rectangle, w, h int) image.Rectangle {
+	sw, sh := r.Dx(), r.Dy()
+	if sw*h > sh*w {
+		cw := sh * w / h
+		x := r.Min.X + (sw-cw)/2
+		return image.Rect(x, r.Min.Y, x+cw, r.Max.Y)
+	}
+
+	ch := sw * h / w
+	y := r.Min.Y + (sh-ch)/2
+	return image.Rect(r.Min.X, y, r.Max.X, y+ch)
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
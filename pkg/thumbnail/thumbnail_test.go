@@ -0,0 +1,55 @@
+package thumbnail_test
+
+import (
+	"bytes"
+	"github.com/labi-le/server/pkg/thumbnail"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestRenderKeepsTheCalculatedSideWithinMaxDimension(t *testing.T) {
+	tests := []struct {
+		name          string
+		width, height int
+		opts          thumbnail.Options
+		wantW, wantH  int
+	}{
+		{"tall image by width", 1, 20_000, thumbnail.Options{Width: thumbnail.MaxDimension}, 1, thumbnail.MaxDimension},
+		{"wide image by height", 20_000, 2, thumbnail.Options{Height: 2048}, thumbnail.MaxDimension, 1},
+		{"within bounds", 100, 50, thumbnail.Options{Width: 200}, 200, 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := tt.opts.Resolve("image/png")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			if err = thumbnail.Render(&out, bytes.NewReader(encodePNG(t, tt.width, tt.height)), opts); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := png.DecodeConfig(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != tt.wantW || cfg.Height != tt.wantH {
+				t.Errorf("rendered %dx%d, want %dx%d", cfg.Width, cfg.Height, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
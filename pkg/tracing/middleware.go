@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/valyala/fasthttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware starts a server span for every request continuing the trace from its traceparent header.
+// The span is put in the user context of the request, handlers pass ctx.UserContext() down.
+func Middleware() fiber.Handler {
+	return func(ctx *fiber.Ctx) error {
+		parent := otel.GetTextMapPropagator().Extract(ctx.UserContext(), requestCarrier{&ctx.Request().Header})
+
+		method := utils.CopyString(ctx.Method())
+		spanCtx, span := otel.Tracer(instrumentation).Start(parent, method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", method),
+				attribute.String("url.path", utils.CopyString(ctx.Path())),
+			),
+		)
+		defer span.End()
+
+		ctx.SetUserContext(spanCtx)
+		err := ctx.Next()
+
+		status := ctx.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var fiberErr *fiber.Error
+			if errors.As(err, &fiberErr) {
+				status = fiberErr.Code
+			}
+			span.RecordError(err)
+		}
+
+		// the route is known once the request is matched
+		route := ctx.Route().Path
+		span.SetName(method + " " + route)
+		span.SetAttributes(
+			attribute.String("http.route", route),
+			attribute.Int("http.response.status_code", status),
+		)
+		if status >= fiber.StatusInternalServerError {
+			span.SetStatus(codes.Error, utils.StatusMessage(status))
+		}
+
+		return err
+	}
+}
+
+// requestCarrier reads the propagated context from the request headers.
+type requestCarrier struct {
+	header *fasthttp.RequestHeader
+}
+
+func (c requestCarrier) Get(key string) string {
+	return string(c.header.Peek(key))
+}
+
+func (c requestCarrier) Set(key, value string) {
+	c.header.Set(key, value)
+}
+
+func (c requestCarrier) Keys() []string {
+	keys := make([]string, 0, c.header.Len())
+	c.header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+
+	return keys
+}
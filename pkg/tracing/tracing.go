@@ -0,0 +1,87 @@
+// Package tracing records OpenTelemetry spans and sends them to an OTLP collector.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentation = "github.com/labi-le/server"
+
+// Options configure the export of spans.
+type Options struct {
+	// Endpoint is the URL of the OTLP/HTTP collector such as http://127.0.0.1:4318, empty disables the export
+	Endpoint string
+	// ServiceName tells this server apart in the collector
+	ServiceName string
+	// SampleRatio is the share of the traces started here that are recorded,
+	// the decision of the caller is followed for requests with a traceparent
+	SampleRatio float64
+}
+
+// Setup installs the W3C trace context propagator and, with an endpoint, the exporter of spans.
+// The returned function flushes the spans that are not sent yet.
+func Setup(ctx context.Context, opts Options) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	if opts.Endpoint == "" {
+		// incoming trace IDs still reach the logs
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil && !errors.Is(err, resource.ErrSchemaURLConflict) {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start opens a span under the one in ctx, it does nothing until Setup is given an endpoint.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End closes the span marking it as failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// IDs returns the trace and span IDs of the span in ctx, they are empty without a span.
+func IDs(ctx context.Context) (traceID, spanID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", ""
+	}
+
+	return sc.TraceID().String(), sc.SpanID().String()
+}
@@ -0,0 +1,142 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/labi-le/server/pkg/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http/httptest"
+	"testing"
+)
+
+const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// record installs a provider keeping the ended spans in memory.
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+		_ = provider.Shutdown(context.Background())
+	})
+
+	return recorder
+}
+
+func attr(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, kv := range attrs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+
+	return attribute.Value{}
+}
+
+func TestEndMarksTheSpanAsFailed(t *testing.T) {
+	recorder := record(t)
+
+	ctx, parent := tracing.Start(context.Background(), "parent")
+	_, child := tracing.Start(ctx, "child", attribute.String("file", "a.png"))
+	tracing.End(child, errors.New("disk full"))
+	tracing.End(parent, nil)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended spans = %d, want 2", len(spans))
+	}
+
+	failed, ok := spans[0], spans[1]
+	if failed.Name() != "child" || ok.Name() != "parent" {
+		t.Fatalf("span names = %q, %q", failed.Name(), ok.Name())
+	}
+	if failed.Parent().SpanID() != ok.SpanContext().SpanID() {
+		t.Error("child span is not under its parent")
+	}
+	if got := attr(failed.Attributes(), "file").AsString(); got != "a.png" {
+		t.Errorf("file attribute = %q", got)
+	}
+	if failed.Status().Code != codes.Error || failed.Status().Description != "disk full" {
+		t.Errorf("failed status = %+v", failed.Status())
+	}
+	if len(failed.Events()) != 1 || failed.Events()[0].Name != "exception" {
+		t.Errorf("failed events = %+v, want the recorded error", failed.Events())
+	}
+	if ok.Status().Code != codes.Unset {
+		t.Errorf("parent status = %+v", ok.Status())
+	}
+}
+
+func TestMiddlewareContinuesTheTrace(t *testing.T) {
+	recorder := record(t)
+
+	app := fiber.New()
+	app.Use(tracing.Middleware())
+	app.Get("/files/:name", func(ctx *fiber.Ctx) error {
+		// spans of the handler belong to the request span
+		_, span := tracing.Start(ctx.UserContext(), "read")
+		tracing.End(span, nil)
+
+		return ctx.SendStatus(fiber.StatusOK)
+	})
+	app.Get("/broken", func(*fiber.Ctx) error {
+		return errors.New("broken")
+	})
+
+	req := httptest.NewRequest(fiber.MethodGet, "/files/a.png", nil)
+	req.Header.Set("traceparent", traceparent)
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/broken", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("ended spans = %d, want 3", len(spans))
+	}
+
+	read, server, broken := spans[0], spans[1], spans[2]
+	if server.Name() != "GET /files/:name" {
+		t.Errorf("server span name = %q", server.Name())
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %s, want the one of the traceparent", got)
+	}
+	if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("parent span id = %s, want the one of the traceparent", got)
+	}
+	if read.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("handler span is not under the server span")
+	}
+	if got := attr(server.Attributes(), "http.response.status_code").AsInt64(); got != fiber.StatusOK {
+		t.Errorf("status code attribute = %d", got)
+	}
+	if server.Status().Code != codes.Unset {
+		t.Errorf("server span status = %+v", server.Status())
+	}
+
+	if broken.Parent().IsValid() {
+		t.Error("request without traceparent got a parent span")
+	}
+	if got := attr(broken.Attributes(), "http.response.status_code").AsInt64(); got != fiber.StatusInternalServerError {
+		t.Errorf("status code attribute = %d", got)
+	}
+	if broken.Status().Code != codes.Error {
+		t.Errorf("failed request status = %+v", broken.Status())
+	}
+}